@@ -0,0 +1,250 @@
+package histosketch
+
+import (
+	"fmt"
+	"math"
+)
+
+// Pseudo-probability added to every bin by KLDivergence so that bins that are
+// empty in q don't make the divergence infinite.
+const klSmoothing = 1e-6
+
+// Returns the fraction of the weight of h in each of n equal-width bins
+// dividing [lo, hi], estimated from Sum like Bins does.
+func (h Sketch) binFractions(lo, hi float64, n int) []float64 {
+	f := make([]float64, n)
+	below := 0.0
+	for i := range f {
+		x := lo + (hi-lo)*float64(i+1)/float64(n)
+		if i == n-1 {
+			x = hi
+		}
+		s := h.Sum(x)
+		f[i] = (s - below) / h.count
+		below = s
+	}
+	return f
+}
+
+// The smallest range containing all of the values in both p and q.
+func unionRange(p, q *Sketch) (lo, hi float64) {
+	return math.Min(p.min, q.min), math.Max(p.max, q.max)
+}
+
+// Returns an estimate of the Kullback-Leibler divergence of q from p, in nats.
+// Both sketches are discretized into the same n equal-width bins dividing the
+// union of their [Min(), Max()] ranges, and the divergence is the sum over
+// the bins of p*log(p/q), where p and q are the fractions of each sketch's
+// weight in the bin. To keep bins that are empty in q from making the
+// divergence infinite, a small pseudo-probability is added to every bin of
+// both sketches before normalizing. The result depends on the number of bins:
+// more bins resolve finer differences, but also leave more bins nearly empty,
+// where the smoothing dominates. Note that KL divergence isn't symmetric:
+// KLDivergence(p, q, n) and KLDivergence(q, p, n) are generally different.
+// Returns NaN if either sketch is empty. Panics if bins is less than 1.
+func KLDivergence(p, q *Sketch, bins int) float64 {
+	if bins < 1 {
+		panic(fmt.Sprintf("bad argument, number of bins must be at least 1, got %v", bins))
+	}
+	if len(p.cs) == 0 || len(q.cs) == 0 {
+		return math.NaN()
+	}
+	lo, hi := unionRange(p, q)
+	if lo == hi {
+		return 0.0
+	}
+	pf, qf := p.binFractions(lo, hi, bins), q.binFractions(lo, hi, bins)
+	norm := 1.0 + float64(bins)*klSmoothing
+	for i := range pf {
+		pf[i] = (math.Max(pf[i], 0) + klSmoothing) / norm
+		qf[i] = (math.Max(qf[i], 0) + klSmoothing) / norm
+	}
+	return kl(pf, qf)
+}
+
+// Returns the sum of p*log(p/q) over corresponding fractions in pf and qf,
+// treating terms where p is 0 as 0.
+func kl(pf, qf []float64) float64 {
+	d := 0.0
+	for i, pi := range pf {
+		if pi > 0 {
+			d += pi * math.Log(pi/qf[i])
+		}
+	}
+	return d
+}
+
+// Returns an estimate of the Jensen-Shannon divergence between p and q, in
+// nats: 0.5*KL(p, m) + 0.5*KL(q, m), where m is the even mixture of p and q.
+// The sketches are discretized into bins like KLDivergence does, but no
+// smoothing is needed since m is nonzero wherever p or q is. Unlike KL
+// divergence, this is symmetric and bounded: it's in [0, log 2], with 0 for
+// identical sketches and log 2 for sketches with no bins in common. Returns
+// NaN if either sketch is empty. Panics if bins is less than 1.
+func JSDivergence(p, q *Sketch, bins int) float64 {
+	if bins < 1 {
+		panic(fmt.Sprintf("bad argument, number of bins must be at least 1, got %v", bins))
+	}
+	if len(p.cs) == 0 || len(q.cs) == 0 {
+		return math.NaN()
+	}
+	lo, hi := unionRange(p, q)
+	if lo == hi {
+		return 0.0
+	}
+	pf, qf := p.binFractions(lo, hi, bins), q.binFractions(lo, hi, bins)
+	mf := make([]float64, bins)
+	for i := range pf {
+		pf[i], qf[i] = math.Max(pf[i], 0), math.Max(qf[i], 0)
+		mf[i] = (pf[i] + qf[i]) / 2
+	}
+	d := 0.5*kl(pf, mf) + 0.5*kl(qf, mf)
+	// Rounding can push the sum just outside of its bounds.
+	return math.Min(math.Max(d, 0.0), math.Ln2)
+}
+
+// Returns an estimate of the total variation distance between p and q: half
+// the sum over bins of the absolute difference between the fractions of each
+// sketch's weight in the bin, using the same binning as KLDivergence. It's the
+// largest difference between the fractions of p and q that any set of bins
+// can have, so it's in [0, 1], with 0 for identical sketches and 1 for
+// sketches with no bins in common. Returns NaN if either sketch is empty.
+// Panics if bins is less than 1.
+func TotalVariation(p, q *Sketch, bins int) float64 {
+	if bins < 1 {
+		panic(fmt.Sprintf("bad argument, number of bins must be at least 1, got %v", bins))
+	}
+	if len(p.cs) == 0 || len(q.cs) == 0 {
+		return math.NaN()
+	}
+	lo, hi := unionRange(p, q)
+	if lo == hi {
+		return 0.0
+	}
+	pf, qf := p.binFractions(lo, hi, bins), q.binFractions(lo, hi, bins)
+	d := 0.0
+	for i := range pf {
+		d += math.Abs(math.Max(pf[i], 0) - math.Max(qf[i], 0))
+	}
+	return math.Min(d/2, 1.0)
+}
+
+// Number of evenly spaced quantiles Wasserstein1 compares.
+const wassersteinGrid = 1000
+
+// Returns an estimate of the 1-Wasserstein (earth mover's) distance between p
+// and q: the integral of |CDF_p(x) - CDF_q(x)| over x, which in one dimension
+// is also the integral of |Quantile_p(u) - Quantile_q(u)| over u in [0, 1].
+// The latter is estimated with the midpoint rule over a grid of 1000
+// quantiles of each sketch. Unlike KLDivergence, this is a true metric and
+// doesn't need the sketches' ranges to overlap: if q is p shifted by c, the
+// distance is c. Returns NaN if either sketch is empty.
+func Wasserstein1(p, q *Sketch) float64 {
+	if len(p.cs) == 0 || len(q.cs) == 0 {
+		return math.NaN()
+	}
+	us := make([]float64, wassersteinGrid)
+	for i := range us {
+		us[i] = (float64(i) + 0.5) / wassersteinGrid
+	}
+	pq, qq := p.Quantiles(us), q.Quantiles(us)
+	d := 0.0
+	for i := range us {
+		d += math.Abs(pq[i] - qq[i])
+	}
+	return d / wassersteinGrid
+}
+
+// Number of evenly spaced points KSStatistic compares the CDFs at, in
+// addition to the values of the centroids of both sketches.
+const ksGrid = 1000
+
+// Returns an estimate of the two-sample Kolmogorov-Smirnov statistic of p and
+// q: the largest absolute difference between their CDFs. The CDFs are
+// compared at 1000 evenly spaced points across the union of the sketches'
+// [Min(), Max()] ranges, and on either side of every centroid of both
+// sketches, where the CDFs can jump. This is an approximation on top of the
+// estimated CDFs themselves, so it's only as accurate as the sketches'
+// quantile estimates. Returns NaN if either sketch is empty.
+func KSStatistic(p, q *Sketch) float64 {
+	if len(p.cs) == 0 || len(q.cs) == 0 {
+		return math.NaN()
+	}
+	lo, hi := unionRange(p, q)
+	xs := make([]float64, 0, ksGrid+1+2*(len(p.cs)+len(q.cs)))
+	for i := 0; i <= ksGrid; i++ {
+		xs = append(xs, lo+(hi-lo)*float64(i)/ksGrid)
+	}
+	for _, cs := range [][]centroid{p.cs, q.cs} {
+		for _, c := range cs {
+			xs = append(xs, c.p, math.Nextafter(c.p, math.Inf(-1)))
+		}
+	}
+	pc, qc := p.CDFs(xs), q.CDFs(xs)
+	d := 0.0
+	for i := range xs {
+		d = math.Max(d, math.Abs(pc[i]-qc[i]))
+	}
+	return d
+}
+
+// A CompareReport describes how two sketches differ. See Sketch.Compare.
+type CompareReport struct {
+	// Differences in Count, Min and Max, as the other sketch's minus h's.
+	CountDelta, MinDelta, MaxDelta float64
+	// The maximum number of centroids and the number of centroids in use of
+	// h and of the other sketch, in that order.
+	Capacity, Centroids [2]int
+	// The largest absolute differences between the values and between the
+	// weights of centroids at the same index, and the indexes they occur at,
+	// or -1 if there are no centroids to compare. Only the first
+	// min(Centroids[0], Centroids[1]) centroids are compared.
+	MaxValueDelta, MaxWeightDelta float64
+	MaxValueIndex, MaxWeightIndex int
+	// The number of compared centroids that are exact in one sketch but
+	// merged in the other.
+	ExactMismatches int
+	// The estimated Kolmogorov-Smirnov statistic of the two sketches, or NaN
+	// if either is empty. See KSStatistic.
+	KS float64
+}
+
+// Returns a report of how h and x differ, both in their centroids and in the
+// distributions they estimate. Where Equal only says whether two sketches
+// match, the report says where and by how much they don't, which helps track
+// down why two sketches that should be the same, like a sketch and its
+// serialized copy or the same shards merged in different orders, diverge.
+func (h Sketch) Compare(x *Sketch) CompareReport {
+	r := CompareReport{
+		CountDelta:     x.count - h.count,
+		MinDelta:       x.Min() - h.Min(),
+		MaxDelta:       x.Max() - h.Max(),
+		Capacity:       [2]int{h.capacity(), x.capacity()},
+		Centroids:      [2]int{len(h.cs), len(x.cs)},
+		MaxValueIndex:  -1,
+		MaxWeightIndex: -1,
+		KS:             KSStatistic(&h, x),
+	}
+	for i := 0; i < len(h.cs) && i < len(x.cs); i++ {
+		c, d := h.cs[i], x.cs[i]
+		if dv := math.Abs(d.p - c.p); r.MaxValueIndex < 0 || dv > r.MaxValueDelta {
+			r.MaxValueDelta, r.MaxValueIndex = dv, i
+		}
+		if dw := math.Abs(math.Abs(d.m) - math.Abs(c.m)); r.MaxWeightIndex < 0 || dw > r.MaxWeightDelta {
+			r.MaxWeightDelta, r.MaxWeightIndex = dw, i
+		}
+		if (c.m > 0) != (d.m > 0) {
+			r.ExactMismatches++
+		}
+	}
+	return r
+}
+
+// Formats the report on a single line, for logging. Deltas of Count, Min and
+// Max are signed, the other sketch's minus h's.
+func (r CompareReport) String() string {
+	return fmt.Sprintf("{count=%+v min=%+v max=%+v centroids=%v/%v capacity=%v/%v "+
+		"value-delta=%v@%v weight-delta=%v@%v exact-mismatches=%v ks=%v}",
+		r.CountDelta, r.MinDelta, r.MaxDelta, r.Centroids[0], r.Centroids[1], r.Capacity[0], r.Capacity[1],
+		r.MaxValueDelta, r.MaxValueIndex, r.MaxWeightDelta, r.MaxWeightIndex, r.ExactMismatches, r.KS)
+}
@@ -0,0 +1,182 @@
+package histosketch
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestKLDivergence(t *testing.T) {
+	rand.Seed(0)
+	a, b, c := New(32), New(32), New(32)
+	for i := 0; i < 10000; i++ {
+		a.Add(rand.NormFloat64())
+		b.Add(rand.NormFloat64())
+		c.Add(rand.NormFloat64()*2.0 + 1.0)
+	}
+	if d := KLDivergence(a, a, 20); math.Abs(d) > 1e-12 {
+		t.Errorf("Want KLDivergence(a, a) = 0, got %v", d)
+	}
+	same, diff := KLDivergence(a, b, 20), KLDivergence(a, c, 20)
+	if same < 0 || same > 0.01 {
+		t.Errorf("Want small divergence between samples of the same distribution, got %v", same)
+	}
+	// KL(N(0,1) || N(1,4)) = log(2) + (1 + 1)/8 - 1/2 ~= 0.443.
+	if math.Abs(diff-0.443) > 0.05 {
+		t.Errorf("Want divergence near 0.443 between N(0,1) and N(1,4), got %v", diff)
+	}
+	if rev := KLDivergence(c, a, 20); math.Abs(rev-diff) < 0.05 {
+		t.Errorf("Want KLDivergence to be asymmetric, got %v both ways", rev)
+	}
+	if d := KLDivergence(a, New(4), 20); !math.IsNaN(d) {
+		t.Errorf("Want NaN divergence from an empty sketch, got %v", d)
+	}
+}
+
+func TestJSDivergence(t *testing.T) {
+	rand.Seed(0)
+	a, b, c, far := New(32), New(32), New(32), New(32)
+	for i := 0; i < 10000; i++ {
+		a.Add(rand.NormFloat64())
+		b.Add(rand.NormFloat64())
+		c.Add(rand.NormFloat64()*2.0 + 1.0)
+		far.Add(rand.Float64() + 100.0)
+	}
+	if d := JSDivergence(a, a, 20); d != 0 {
+		t.Errorf("Want JSDivergence(a, a) = 0, got %v", d)
+	}
+	for _, x := range []*Sketch{b, c, far} {
+		if d, e := JSDivergence(a, x, 20), JSDivergence(x, a, 20); math.Abs(d-e) > 1e-12 {
+			t.Errorf("Want JSDivergence to be symmetric, got %v and %v", d, e)
+		}
+	}
+	same, diff := JSDivergence(a, b, 20), JSDivergence(a, c, 20)
+	if same < 0 || same > 0.01 || diff < same || diff > math.Ln2 {
+		t.Errorf("Want 0 <= %v < %v <= log 2 for divergences to similar and different sketches", same, diff)
+	}
+	// With disjoint supports, every bin of the mixture is half of one sketch.
+	if d := JSDivergence(a, far, 1000); math.Abs(d-math.Ln2) > 1e-3 {
+		t.Errorf("Want divergence near log 2 between disjoint sketches, got %v", d)
+	}
+	if d := JSDivergence(a, New(4), 20); !math.IsNaN(d) {
+		t.Errorf("Want NaN divergence from an empty sketch, got %v", d)
+	}
+}
+
+func TestTotalVariation(t *testing.T) {
+	rand.Seed(0)
+	a, b, u, far := New(32), New(32), New(32), New(32)
+	for i := 0; i < 10000; i++ {
+		a.Add(rand.Float64())
+		b.Add(rand.Float64())
+		u.Add(rand.Float64() + 0.5)
+		far.Add(rand.Float64() + 100.0)
+	}
+	if d := TotalVariation(a, a, 20); d != 0 {
+		t.Errorf("Want TotalVariation(a, a) = 0, got %v", d)
+	}
+	if d, e := TotalVariation(a, u, 20), TotalVariation(u, a, 20); math.Abs(d-e) > 1e-12 {
+		t.Errorf("Want TotalVariation to be symmetric, got %v and %v", d, e)
+	}
+	if d := TotalVariation(a, b, 20); d < 0 || d > 0.05 {
+		t.Errorf("Want small distance between samples of the same distribution, got %v", d)
+	}
+	// U(0, 1) and U(0.5, 1.5) overlap on half of their weight.
+	if d := TotalVariation(a, u, 30); math.Abs(d-0.5) > 0.05 {
+		t.Errorf("Want distance near 0.5 between U(0, 1) and U(0.5, 1.5), got %v", d)
+	}
+	if d := TotalVariation(a, far, 1000); math.Abs(d-1.0) > 1e-3 {
+		t.Errorf("Want distance near 1 between disjoint sketches, got %v", d)
+	}
+	if d := TotalVariation(a, New(4), 20); !math.IsNaN(d) {
+		t.Errorf("Want NaN distance from an empty sketch, got %v", d)
+	}
+}
+
+func TestWasserstein1(t *testing.T) {
+	rand.Seed(0)
+	a, b := New(32), New(32)
+	for i := 0; i < 10000; i++ {
+		x := rand.ExpFloat64()
+		a.Add(x)
+		b.Add(x + 3.5)
+	}
+	if d := Wasserstein1(a, b); math.Abs(d-3.5) > 1e-9 {
+		t.Errorf("Want distance 3.5 to a shifted sketch, got %v", d)
+	}
+	if d, e := Wasserstein1(a, b), Wasserstein1(b, a); d != e {
+		t.Errorf("Want Wasserstein1 to be symmetric, got %v and %v", d, e)
+	}
+	if d := Wasserstein1(a, a); d != 0 {
+		t.Errorf("Want Wasserstein1(a, a) = 0, got %v", d)
+	}
+	if d := Wasserstein1(New(4), a); !math.IsNaN(d) {
+		t.Errorf("Want NaN distance from an empty sketch, got %v", d)
+	}
+}
+
+func TestKSStatistic(t *testing.T) {
+	rand.Seed(0)
+	a, b, c := New(32), New(32), New(32)
+	for i := 0; i < 10000; i++ {
+		a.Add(rand.Float64())
+		b.Add(rand.Float64())
+		c.Add(rand.Float64() + 0.25)
+	}
+	if d := KSStatistic(a, a); d != 0 {
+		t.Errorf("Want KSStatistic(a, a) = 0, got %v", d)
+	}
+	if d := KSStatistic(a, b); d > 0.03 {
+		t.Errorf("Want small KS statistic for samples of the same distribution, got %v", d)
+	}
+	// U[0, 1] and U[0.25, 1.25] differ by 0.25 in CDF over [0.25, 1].
+	if d := KSStatistic(a, c); math.Abs(d-0.25) > 0.03 {
+		t.Errorf("Want KS statistic near 0.25 for shifted uniforms, got %v", d)
+	}
+	x, y := New(4), New(4)
+	x.Add(1.0)
+	y.Add(2.0)
+	if d := KSStatistic(x, y); d != 1.0 {
+		t.Errorf("Want KS statistic 1 for disjoint point masses, got %v", d)
+	}
+	if d := KSStatistic(a, New(4)); !math.IsNaN(d) {
+		t.Errorf("Want NaN KS statistic with an empty sketch, got %v", d)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	rand.Seed(0)
+	a := New(16)
+	for i := 0; i < 1000; i++ {
+		a.Add(rand.NormFloat64())
+	}
+	if r := a.Compare(a.Clone()); r.CountDelta != 0 || r.MaxValueDelta != 0 || r.MaxWeightDelta != 0 ||
+		r.ExactMismatches != 0 || r.KS != 0 {
+		t.Errorf("Want no differences comparing a sketch with its clone, got %v", r)
+	}
+	b := a.Clone()
+	b.cs[3].p += 0.5
+	b.cs[7].m -= 2
+	b.count -= 2
+	r := a.Compare(b)
+	if r.MaxValueIndex != 3 || math.Abs(r.MaxValueDelta-0.5) > 1e-12 {
+		t.Errorf("Want value delta 0.5 at centroid 3, got %v at %v", r.MaxValueDelta, r.MaxValueIndex)
+	}
+	if r.MaxWeightIndex != 7 || r.MaxWeightDelta != 2 {
+		t.Errorf("Want weight delta 2 at centroid 7, got %v at %v", r.MaxWeightDelta, r.MaxWeightIndex)
+	}
+	if r.CountDelta != -2 || !(r.KS > 0) {
+		t.Errorf("Want Count delta -2 and a positive KS statistic, got %v and %v", r.CountDelta, r.KS)
+	}
+	e := New(8)
+	e.Add(1.0)
+	r = e.Compare(New(4))
+	if r.Capacity != [2]int{8, 4} || r.Centroids != [2]int{1, 0} || r.MaxValueIndex != -1 || !math.IsNaN(r.KS) {
+		t.Errorf("Want capacities 8/4, centroids 1/0, no compared centroids and NaN KS, got %v", r)
+	}
+	want := "{count=-1 min=NaN max=NaN centroids=1/0 capacity=8/4 " +
+		"value-delta=0@-1 weight-delta=0@-1 exact-mismatches=0 ks=NaN}"
+	if got := r.String(); got != want {
+		t.Errorf("Want %v from String, got %v", want, got)
+	}
+}
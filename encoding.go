@@ -0,0 +1,432 @@
+package histosketch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Version of the binary serialization format written by MarshalBinary. The
+// format is:
+//
+//	version (1 byte)
+//	maximum number of centroids (uint32)
+//	min, max, count (float64 each)
+//	number of centroids (uint32)
+//	value, weight for each centroid (float64 each)
+//
+// All integers and floats are little-endian. Weights of merged centroids are
+// negative, as they are in memory.
+const binaryVersion = 2
+
+// Size in bytes of everything in the binary format before the centroids.
+const binaryHeaderSize = 1 + 4 + 3*8 + 4
+
+// Serialization for use with encoding.BinaryMarshaler and gob/encoding. See
+// tests for an example.
+func (h Sketch) MarshalBinary() ([]byte, error) {
+	return h.AppendBinary(make([]byte, 0, binaryHeaderSize+16*len(h.cs)))
+}
+
+// Appends the same bytes that MarshalBinary returns to b and returns the
+// extended buffer, so that many sketches can be written into one reusable
+// buffer without allocating a new slice for each. This is the
+// encoding.BinaryAppender interface from Go 1.24. The error is always nil.
+func (h Sketch) AppendBinary(b []byte) ([]byte, error) {
+	h.cs = h.compressed()
+	b = append(b, binaryVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(h.capacity()))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(h.min))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(h.max))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(h.count))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(h.cs)))
+	for _, c := range h.cs {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c.p))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c.m))
+	}
+	return b, nil
+}
+
+// Deserialization for use with encoding.BinaryUnmarshaler and gob/encoding.
+// See tests for an example. Returns an error and leaves h unchanged if data
+// is truncated or otherwise malformed, claims a maximum of more than 2^24
+// centroids, or doesn't describe a valid Sketch according to Validate. Also
+// reads the text-based format written by earlier versions of MarshalBinary.
+func (h *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("Can't unmarshal Sketch from empty data")
+	}
+	if bytes.HasPrefix(data, []byte("1\n")) {
+		return h.unmarshalV1(data)
+	}
+	if data[0] != binaryVersion {
+		return errors.New(fmt.Sprintf("Unknown serialization version '%v'", data[0]))
+	}
+	if len(data) < binaryHeaderSize {
+		return errors.New(fmt.Sprintf("Truncated Sketch header: got %v bytes, want %v",
+			len(data), binaryHeaderSize))
+	}
+	n := binary.LittleEndian.Uint32(data[1:])
+	num := binary.LittleEndian.Uint32(data[29:])
+	if n == 0 {
+		return errors.New("Number of centroids must be at least 1.")
+	} else if n > maxCentroids {
+		return errors.New(fmt.Sprintf("Bad number of centroids %v", n))
+	} else if num > n {
+		return errors.New(fmt.Sprintf("Sketch has %v centroids, more than its maximum of %v", num, n))
+	} else if want := binaryHeaderSize + 16*int(num); len(data) != want {
+		return errors.New(fmt.Sprintf("Sketch with %v centroids should be %v bytes, got %v",
+			num, want, len(data)))
+	}
+	x := Sketch{
+		min:   math.Float64frombits(binary.LittleEndian.Uint64(data[5:])),
+		max:   math.Float64frombits(binary.LittleEndian.Uint64(data[13:])),
+		count: math.Float64frombits(binary.LittleEndian.Uint64(data[21:])),
+		opts:  h.opts,
+	}
+	x.cs = x.allocate(int(n))[:num]
+	for i := range x.cs {
+		off := binaryHeaderSize + 16*i
+		x.cs[i].p = math.Float64frombits(binary.LittleEndian.Uint64(data[off:]))
+		x.cs[i].m = math.Float64frombits(binary.LittleEndian.Uint64(data[off+8:]))
+	}
+	if err := x.Validate(); err != nil {
+		return err
+	}
+	*h = x
+	return nil
+}
+
+// Reads version 1 of the serialization format, which was text-based and
+// didn't record the maximum number of centroids, so the resulting Sketch
+// has a maximum equal to the number of centroids it was serialized with.
+func (h *Sketch) unmarshalV1(data []byte) error {
+	b := bytes.NewBuffer(data)
+	var num, version int
+	// Read and verify the version number.
+	_, err := fmt.Fscanln(b, &version)
+	if err != nil {
+		return err
+	} else if version != 1 {
+		return errors.New(fmt.Sprintf("Unknown serialization version '%v'", version))
+	}
+	// Read the number of centroids.
+	_, err = fmt.Fscanln(b, &num)
+	if err != nil {
+		return err
+	} else if num < 1 || num > maxCentroids {
+		return errors.New(fmt.Sprintf("Bad number of centroids %v", num))
+	}
+	x := Sketch{opts: h.opts}
+	x.cs = x.allocate(num)
+	// Read all centroids.
+	for i := 0; i < num; i++ {
+		c := centroid{0.0, 0.0}
+		_, err := fmt.Fscanln(b, &c.p, &c.m)
+		if err != nil {
+			return err
+		}
+		x.cs = append(x.cs, c)
+		x.count += math.Abs(c.m)
+	}
+	// Read min and max.
+	_, err = fmt.Fscanln(b, &x.min, &x.max)
+	if err != nil {
+		return err
+	}
+	if err := x.Validate(); err != nil {
+		return err
+	}
+	*h = x
+	return nil
+}
+
+// Serialization for use with encoding/gob, so that Sketches can be stored in
+// gob-encoded structs. Uses the same format as MarshalBinary.
+func (h Sketch) GobEncode() ([]byte, error) {
+	return h.MarshalBinary()
+}
+
+// Deserialization for use with encoding/gob. Reads the format written by
+// MarshalBinary.
+func (h *Sketch) GobDecode(data []byte) error {
+	return h.UnmarshalBinary(data)
+}
+
+// Largest frame ReadFrom will accept, to avoid huge allocations when reading
+// corrupt data. This allows for Sketches with up to maxCentroids centroids.
+const maxFrameSize = binaryHeaderSize + 16*maxCentroids
+
+// Writes h to w as a single frame: the length of the binary serialization of
+// h as a little-endian uint32, followed by the serialization itself. Frames
+// can be written back to back to a single stream and read back one at a time
+// with ReadFrom. Returns the number of bytes written.
+func (h *Sketch) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	var prefix [4]byte
+	binary.LittleEndian.PutUint32(prefix[:], uint32(len(b)))
+	n, err := w.Write(prefix[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(b)
+	return int64(n + m), err
+}
+
+// Reads a single frame written by WriteTo from r into h, returning the number
+// of bytes read. Returns io.EOF if r has no more data, and some other error,
+// leaving h unchanged, if the frame is truncated or malformed.
+func (h *Sketch) ReadFrom(r io.Reader) (int64, error) {
+	var prefix [4]byte
+	n, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return int64(n), err
+	}
+	size := binary.LittleEndian.Uint32(prefix[:])
+	if size > maxFrameSize {
+		return int64(n), errors.New(fmt.Sprintf("Sketch frame of %v bytes is too large", size))
+	}
+	b := make([]byte, size)
+	m, err := io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return int64(n + m), err
+	}
+	return int64(n + m), h.UnmarshalBinary(b)
+}
+
+// Reads every frame written by WriteTo from r until EOF and merges them all
+// into a new Sketch with a maximum of centroids centroids, as MergeMany does,
+// for example to summarize a file of per-shard sketches in one call. Every
+// frame is read before merging, so this holds all of the sketches in memory
+// at once. Returns an error saying how many frames were read successfully if
+// a frame is truncated or malformed, and MergeMany's error if centroids is 0.
+// The frames may have any maximum numbers of centroids. An empty r gives an
+// empty Sketch.
+func MergeFrom(r io.Reader, centroids uint) (*Sketch, error) {
+	sketches := []*Sketch{}
+	for {
+		x := &Sketch{}
+		if _, err := x.ReadFrom(r); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New(fmt.Sprintf("Can't read Sketch after reading %v successfully: %v",
+				len(sketches), err))
+		}
+		sketches = append(sketches, x)
+	}
+	return MergeMany(sketches, centroids)
+}
+
+// JSON representation of a Sketch. Field names are kept short:
+//
+//	centroids: maximum number of centroids
+//	min, max:  minimum and maximum values added
+//	count:     total weight of all centroids
+//	points:    centroids sorted by value, each with a value (v), a weight (w)
+//	           and, for centroids that have never been merged and so
+//	           represent a single value exactly, "e": true.
+type jsonSketch struct {
+	Centroids int            `json:"centroids"`
+	Min       float64        `json:"min"`
+	Max       float64        `json:"max"`
+	Count     float64        `json:"count"`
+	Points    []jsonCentroid `json:"points"`
+}
+
+type jsonCentroid struct {
+	V float64 `json:"v"`
+	W float64 `json:"w"`
+	E bool    `json:"e,omitempty"`
+}
+
+// Serialization for use with encoding/json. The output is deterministic, with
+// centroids sorted by value.
+func (h Sketch) MarshalJSON() ([]byte, error) {
+	h.cs = h.compressed()
+	j := jsonSketch{h.capacity(), h.min, h.max, h.count, make([]jsonCentroid, len(h.cs))}
+	for i, c := range h.cs {
+		j.Points[i] = jsonCentroid{c.p, math.Abs(c.m), c.m > 0}
+	}
+	return json.Marshal(j)
+}
+
+// Deserialization for use with encoding/json. Returns an error and leaves h
+// unchanged if the input is malformed or doesn't describe a valid Sketch.
+func (h *Sketch) UnmarshalJSON(data []byte) error {
+	var j jsonSketch
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Centroids < 1 {
+		return errors.New("Number of centroids must be at least 1.")
+	} else if j.Centroids > maxCentroids {
+		return errors.New(fmt.Sprintf("Bad number of centroids %v", j.Centroids))
+	} else if len(j.Points) > j.Centroids {
+		return errors.New(fmt.Sprintf("Sketch has %v centroids, more than its maximum of %v",
+			len(j.Points), j.Centroids))
+	}
+	x := Sketch{count: j.Count, min: j.Min, max: j.Max, opts: h.opts}
+	x.cs = x.allocate(j.Centroids)[:len(j.Points)]
+	for i, c := range j.Points {
+		if !(c.W > 0) {
+			return errors.New(fmt.Sprintf("Centroid %v has non-positive weight %v", i, c.W))
+		} else if i > 0 && !(c.V >= j.Points[i-1].V) {
+			return errors.New(fmt.Sprintf("Centroid %v with value %v is out of order", i, c.V))
+		}
+		x.cs[i] = centroid{c.V, c.W}
+		if !c.E {
+			x.cs[i].m = -c.W
+		}
+	}
+	if err := x.Validate(); err != nil {
+		return err
+	}
+	*h = x
+	return nil
+}
+
+// Returns a stable, human-readable representation of h that Parse can read
+// back. The format is
+//
+//	{centroids=N count=C min=MIN max=MAX dropped=D [V:W V:W ...]}
+//
+// where N is the maximum number of centroids and each V:W is the value and
+// weight of a centroid, sorted by value. The weight of a centroid that has
+// been merged, and so only approximates the values it stands for, is written
+// with a "~" prefix, like 2:~9. Every number is written with the fewest digits
+// that parse back to exactly the same float64, so the output doesn't depend on
+// the platform and a parsed Sketch is identical to the original. min and max
+// are NaN for an empty sketch. Options like WithDecay aren't included, and a
+// Sketch holding extra centroids (see WithBufferFactor and WithExactBelow) is
+// written as if it had been compressed to its maximum number of centroids.
+func (h Sketch) String() string {
+	h.cs = h.compressed()
+	var b strings.Builder
+	fmt.Fprintf(&b, "{centroids=%v count=%v min=%v max=%v dropped=%v [",
+		h.capacity(), formatFloat(h.count), formatFloat(h.Min()), formatFloat(h.Max()),
+		formatFloat(h.dropped))
+	for i, c := range h.cs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(formatFloat(c.p))
+		b.WriteByte(':')
+		if c.m < 0 {
+			b.WriteByte('~')
+		}
+		b.WriteString(formatFloat(math.Abs(c.m)))
+	}
+	b.WriteString("]}")
+	return b.String()
+}
+
+// Serialization for use with encoding.TextMarshaler, for storing a small
+// sketch somewhere a person might read or edit it, like a config file. Writes
+// the same format as String.
+func (h Sketch) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// Deserialization for use with encoding.TextUnmarshaler. Reads the format
+// written by String, ignoring any whitespace around it. As in Parse, the
+// result is checked with Validate, so hand-edited text whose weights don't
+// add up to the count or whose values are outside of [min, max] is rejected.
+// Returns an error and leaves h unchanged if text is malformed.
+func (h *Sketch) UnmarshalText(text []byte) error {
+	x, err := Parse(strings.TrimSpace(string(text)))
+	if err != nil {
+		return err
+	}
+	n, cs := x.capacity(), x.cs
+	x.opts = h.opts
+	x.cs = append(x.allocate(n), cs...)
+	*h = *x
+	return nil
+}
+
+func formatFloat(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// Reads a Sketch from the format written by String, for example to replay a
+// sketch captured from a log in a test. Returns an error if s is malformed or
+// doesn't describe a valid Sketch according to Validate, for example if its
+// weights don't add up to its count. The Sketch has default options.
+func Parse(s string) (*Sketch, error) {
+	open := strings.IndexByte(s, '[')
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "]}") || open < 0 {
+		return nil, errors.New(fmt.Sprintf("Can't parse Sketch from '%v'", s))
+	}
+	fields := strings.Fields(s[1:open])
+	keys := []string{"centroids", "count", "min", "max", "dropped"}
+	if len(fields) != len(keys) {
+		return nil, errors.New(fmt.Sprintf("Want %v fields before centroids, got %v",
+			len(keys), len(fields)))
+	}
+	vals := make([]float64, len(keys))
+	for i, f := range fields {
+		v, ok := strings.CutPrefix(f, keys[i]+"=")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Want field '%v', got '%v'", keys[i], f))
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = x
+	}
+	n := vals[0]
+	if !(n >= 1 && n <= maxCentroids) || n != math.Trunc(n) {
+		return nil, errors.New(fmt.Sprintf("Bad number of centroids %v", n))
+	}
+	cs := strings.Fields(s[open+1 : len(s)-2])
+	if len(cs) > int(n) {
+		return nil, errors.New(fmt.Sprintf("Sketch has %v centroids, more than its maximum of %v",
+			len(cs), n))
+	}
+	h := New(uint(n))
+	h.count, h.dropped = vals[1], vals[4]
+	if len(cs) > 0 {
+		h.min, h.max = vals[2], vals[3]
+	}
+	for i, c := range cs {
+		v, w, ok := strings.Cut(c, ":")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Can't parse centroid '%v'", c))
+		}
+		merged := strings.HasPrefix(w, "~")
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		m, err := strconv.ParseFloat(strings.TrimPrefix(w, "~"), 64)
+		if err != nil {
+			return nil, err
+		}
+		if !(m > 0) {
+			return nil, errors.New(fmt.Sprintf("Centroid %v has non-positive weight %v", i, m))
+		} else if i > 0 && !(p >= h.cs[i-1].p) {
+			return nil, errors.New(fmt.Sprintf("Centroid %v with value %v is out of order", i, p))
+		}
+		if merged {
+			m = -m
+		}
+		h.cs = append(h.cs, centroid{p, m})
+	}
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,552 @@
+package histosketch
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	s := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Got error marshalling Sketch: %v", err)
+	}
+	u := &Sketch{}
+	if err := u.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Got error unmarshalling Sketch: %v", err)
+	}
+	if fmt.Sprintf("%v", *u) != fmt.Sprintf("%v", *s) {
+		t.Errorf("Want %v after unmarshalling, got %v", *s, *u)
+	}
+	if u.capacity() != s.capacity() {
+		t.Errorf("Want capacity %v after unmarshalling, got %v", s.capacity(), u.capacity())
+	}
+	for _, q := range []float64{0.0, 0.01, 0.25, 0.5, 0.75, 0.99, 1.0} {
+		if u.Quantile(q) != s.Quantile(q) {
+			t.Errorf("Want %v for Quantile(%v) after unmarshalling, got %v", s.Quantile(q), q, u.Quantile(q))
+		}
+	}
+}
+
+func TestMarshalBinaryPartial(t *testing.T) {
+	s := New(16)
+	s.Add(1.0)
+	s.Add(2.0)
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Got error marshalling Sketch: %v", err)
+	}
+	u := &Sketch{}
+	if err := u.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Got error unmarshalling Sketch: %v", err)
+	}
+	// The unmarshalled sketch should still be able to grow to 16 centroids.
+	for i := 3; i <= 16; i++ {
+		u.Add(float64(i))
+	}
+	if len(u.cs) != 16 {
+		t.Errorf("Want 16 centroids after unmarshalling and adding, got %v", len(u.cs))
+	}
+}
+
+func TestAppendBinary(t *testing.T) {
+	rand.Seed(0)
+	sketches := []*Sketch{New(16), New(4), NewWithOptions(WithCentroids(8), WithBufferFactor(2))}
+	for _, s := range sketches {
+		for i := 0; i < 1000; i++ {
+			s.Add(rand.NormFloat64())
+		}
+	}
+	b := []byte("prefix")
+	var ends []int
+	for _, s := range sketches {
+		var err error
+		if b, err = s.AppendBinary(b); err != nil {
+			t.Fatalf("Got error appending Sketch: %v", err)
+		}
+		ends = append(ends, len(b))
+	}
+	if !bytes.HasPrefix(b, []byte("prefix")) {
+		t.Errorf("Want AppendBinary to keep the existing contents of the buffer, got %q", b[:6])
+	}
+	start := len("prefix")
+	for i, s := range sketches {
+		want, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Got error marshalling Sketch: %v", err)
+		}
+		if got := b[start:ends[i]]; !bytes.Equal(got, want) {
+			t.Errorf("Want the same bytes from AppendBinary as from MarshalBinary for sketch %v, got %v and %v",
+				i, got, want)
+		}
+		u := &Sketch{}
+		if err := u.UnmarshalBinary(b[start:ends[i]]); err != nil {
+			t.Fatalf("Got error unmarshalling appended Sketch %v: %v", i, err)
+		}
+		if u.String() != s.String() {
+			t.Errorf("Want %v after unmarshalling appended Sketch %v, got %v", s, i, u)
+		}
+		start = ends[i]
+	}
+}
+
+// Compares the allocations of MarshalBinary with AppendBinary into a reused
+// buffer.
+func BenchmarkAppendBinary(b *testing.B) {
+	s := New(64)
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		s.Add(r.NormFloat64())
+	}
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.MarshalBinary()
+		}
+	})
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf, _ = s.AppendBinary(buf[:0])
+		}
+	})
+}
+
+func TestUnmarshalBinaryTruncated(t *testing.T) {
+	s := New(16)
+	for i := 0; i < 20; i++ {
+		s.Add(float64(i * i))
+	}
+	b, _ := s.MarshalBinary()
+	for i := 0; i < len(b); i++ {
+		u := New(4)
+		u.Add(3.0)
+		if err := u.UnmarshalBinary(b[:i]); err == nil {
+			t.Errorf("Expected error unmarshalling %v of %v bytes", i, len(b))
+		}
+		if u.Count() != 1.0 || u.capacity() != 4 {
+			t.Errorf("Want unchanged sketch after failed unmarshal, got %v", *u)
+		}
+	}
+	if err := (&Sketch{}).UnmarshalBinary(append(b, 0)); err == nil {
+		t.Error("Expected error unmarshalling with trailing bytes")
+	}
+	b[0] = 99
+	if err := (&Sketch{}).UnmarshalBinary(b); err == nil {
+		t.Error("Expected error unmarshalling unknown version")
+	}
+}
+
+func TestUnmarshalBinaryHugeCapacity(t *testing.T) {
+	// A header claiming 2^31-1 centroids with none present would allocate
+	// far more memory than any real Sketch uses.
+	data := make([]byte, binaryHeaderSize)
+	data[0] = binaryVersion
+	binary.LittleEndian.PutUint32(data[1:], 0x7fffffff)
+	u := New(4)
+	u.Add(3.0)
+	if err := u.UnmarshalBinary(data); err == nil {
+		t.Error("Expected error unmarshalling a Sketch with 2^31-1 centroids")
+	}
+	if u.Count() != 1.0 || u.capacity() != 4 {
+		t.Errorf("Want unchanged sketch after failed unmarshal, got %v", *u)
+	}
+}
+
+func TestUnmarshalBinaryInvalid(t *testing.T) {
+	s := New(4)
+	s.Add(1.0)
+	s.Add(2.0)
+	good, _ := s.MarshalBinary()
+	corrupt := func(off int, v float64) []byte {
+		b := append([]byte{}, good...)
+		binary.LittleEndian.PutUint64(b[off:], math.Float64bits(v))
+		return b
+	}
+	for name, data := range map[string][]byte{
+		"count 100":       corrupt(21, 100),
+		"count -2":        corrupt(21, -2),
+		"NaN count":       corrupt(21, math.NaN()),
+		"min > max":       corrupt(5, 3),
+		"NaN centroid":    corrupt(binaryHeaderSize, math.NaN()),
+		"NaN weight":      corrupt(binaryHeaderSize+8, math.NaN()),
+		"v1 truncated":    []byte("1\n3\n"),
+		"v1 0 centroids":  []byte("1\n0\n0 0\n"),
+		"v1 -1 centroids": []byte("1\n-1\n"),
+		"v1 2^31-1":       []byte("1\n2147483647\n"),
+		"v1 min > max":    []byte("1\n1\n1 1\n5 4\n"),
+	} {
+		u := New(8)
+		u.Add(5.0)
+		if err := u.UnmarshalBinary(data); err == nil {
+			t.Errorf("Expected error unmarshalling Sketch with %v, got %v", name, *u)
+		}
+		if u.Count() != 1.0 || u.capacity() != 8 {
+			t.Errorf("Want unchanged sketch after failed unmarshal of Sketch with %v, got %v", name, *u)
+		}
+	}
+}
+
+func TestUnmarshalBinaryVersion1(t *testing.T) {
+	u := &Sketch{}
+	if err := u.UnmarshalBinary([]byte("1\n3\n1 1\n2 -2\n4 1\n0.5 4\n")); err != nil {
+		t.Fatalf("Got error unmarshalling version 1 Sketch: %v", err)
+	}
+	want := "{centroids=3 count=4 min=0.5 max=4 dropped=0 [1:1 2:~2 4:1]}"
+	if fmt.Sprintf("%v", *u) != want {
+		t.Errorf("Want %v, got %v", want, *u)
+	}
+}
+
+func TestMarshalJSONRoundTrip(t *testing.T) {
+	s := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	s.Add(10.0)
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Got error marshalling Sketch: %v", err)
+	}
+	u := &Sketch{}
+	if err := json.Unmarshal(b, u); err != nil {
+		t.Fatalf("Got error unmarshalling Sketch: %v", err)
+	}
+	if fmt.Sprintf("%v", *u) != fmt.Sprintf("%v", *s) {
+		t.Errorf("Want %v after unmarshalling, got %v", *s, *u)
+	}
+	for _, q := range []float64{0.0, 0.01, 0.25, 0.5, 0.75, 0.99, 1.0} {
+		if u.Quantile(q) != s.Quantile(q) {
+			t.Errorf("Want %v for Quantile(%v) after unmarshalling, got %v", s.Quantile(q), q, u.Quantile(q))
+		}
+	}
+}
+
+func TestMarshalJSONRoundTripDuplicates(t *testing.T) {
+	s, err := NewFromSample([]float64{1, 7, 7, 8, 8, 9, 9}, 7)
+	if err != nil {
+		t.Fatalf("Got error from NewFromSample: %v", err)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Got error marshalling Sketch: %v", err)
+	}
+	u := &Sketch{}
+	if err := json.Unmarshal(b, u); err != nil {
+		t.Fatalf("Got error unmarshalling %s: %v", b, err)
+	}
+	if u.String() != s.String() {
+		t.Errorf("Want %v after unmarshalling, got %v", s, u)
+	}
+}
+
+func TestMarshalJSONShape(t *testing.T) {
+	s := New(4)
+	s.Add(2.0)
+	s.AddMany(1.0, 2)
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Got error marshalling Sketch: %v", err)
+	}
+	want := `{"centroids":4,"min":1,"max":2,"count":3,"points":[{"v":1,"w":2,"e":true},{"v":2,"w":1,"e":true}]}`
+	if string(b) != want {
+		t.Errorf("Want %v, got %v", want, string(b))
+	}
+}
+
+func TestUnmarshalJSONMalformed(t *testing.T) {
+	for _, data := range []string{
+		`{"centroids":4,"min":1,"max":2,"count":3,"points":[{"v":1,"w":2}`,
+		`{"centroids":0,"min":1,"max":2,"count":3,"points":[]}`,
+		`{"centroids":1,"min":1,"max":2,"count":3,"points":[{"v":1,"w":2},{"v":2,"w":1}]}`,
+		`{"centroids":4,"min":1,"max":2,"count":3,"points":[{"v":2,"w":2},{"v":1,"w":1}]}`,
+		`{"centroids":4,"min":1,"max":2,"count":3,"points":[{"v":1,"w":-2},{"v":2,"w":1}]}`,
+		`{"centroids":4000000000000,"min":1,"max":2,"count":3,"points":[]}`,
+		// min > max.
+		`{"centroids":4,"min":5,"max":1,"count":1,"points":[{"v":3,"w":1}]}`,
+		// Weights don't add up to the count.
+		`{"centroids":4,"min":1,"max":2,"count":100,"points":[{"v":1,"w":2},{"v":2,"w":1}]}`,
+		`[1, 2, 3]`,
+	} {
+		u := New(8)
+		u.Add(5.0)
+		if err := json.Unmarshal([]byte(data), u); err == nil {
+			t.Errorf("Expected error unmarshalling %v", data)
+		}
+		if u.Count() != 1.0 || u.capacity() != 8 {
+			t.Errorf("Want unchanged sketch after failed unmarshal of %v, got %v", data, *u)
+		}
+	}
+}
+
+func TestGobStruct(t *testing.T) {
+	type shard struct {
+		Name    string
+		Latency Sketch
+		Sizes   *Sketch
+	}
+	in := shard{"a", *New(8), New(32)}
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		in.Latency.Add(rand.ExpFloat64())
+		in.Sizes.Add(rand.NormFloat64())
+	}
+	var stream bytes.Buffer
+	if err := gob.NewEncoder(&stream).Encode(in); err != nil {
+		t.Fatalf("Got error encoding struct: %v", err)
+	}
+	var out shard
+	if err := gob.NewDecoder(&stream).Decode(&out); err != nil {
+		t.Fatalf("Got error decoding struct: %v", err)
+	}
+	if out.Name != in.Name {
+		t.Errorf("Want %v for Name after decoding, got %v", in.Name, out.Name)
+	}
+	for _, q := range []float64{0.0, 0.01, 0.25, 0.5, 0.75, 0.99, 1.0} {
+		if out.Latency.Quantile(q) != in.Latency.Quantile(q) {
+			t.Errorf("Want %v for Latency.Quantile(%v) after decoding, got %v",
+				in.Latency.Quantile(q), q, out.Latency.Quantile(q))
+		}
+		if out.Sizes.Quantile(q) != in.Sizes.Quantile(q) {
+			t.Errorf("Want %v for Sizes.Quantile(%v) after decoding, got %v",
+				in.Sizes.Quantile(q), q, out.Sizes.Quantile(q))
+		}
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	var stream bytes.Buffer
+	sketches := []*Sketch{}
+	offsets := []int64{}
+	written := int64(0)
+	rand.Seed(0)
+	for i := 0; i < 5; i++ {
+		s := New(uint(4 + i))
+		for j := 0; j < 100*i; j++ {
+			s.Add(rand.NormFloat64())
+		}
+		offsets = append(offsets, written)
+		n, err := s.WriteTo(&stream)
+		if err != nil {
+			t.Fatalf("Got error writing Sketch: %v", err)
+		}
+		written += n
+		sketches = append(sketches, s)
+	}
+	if written != int64(stream.Len()) {
+		t.Errorf("Want %v total bytes written, got %v", stream.Len(), written)
+	}
+	data := stream.Bytes()
+	read := int64(0)
+	r := bytes.NewReader(data)
+	for i, s := range sketches {
+		if read != offsets[i] {
+			t.Errorf("Want offset %v for Sketch %v, got %v", offsets[i], i, read)
+		}
+		u := &Sketch{}
+		n, err := u.ReadFrom(r)
+		if err != nil {
+			t.Fatalf("Got error reading Sketch %v: %v", i, err)
+		}
+		read += n
+		if fmt.Sprintf("%v", *u) != fmt.Sprintf("%v", *s) {
+			t.Errorf("Want %v after reading, got %v", *s, *u)
+		}
+	}
+	if _, err := (&Sketch{}).ReadFrom(r); err != io.EOF {
+		t.Errorf("Want io.EOF after reading all frames, got %v", err)
+	}
+
+	// Reading from a stream that only returns one byte at a time should
+	// still work.
+	u := &Sketch{}
+	if _, err := u.ReadFrom(&oneByteReader{bytes.NewReader(data[offsets[3]:])}); err != nil {
+		t.Errorf("Got error reading Sketch one byte at a time: %v", err)
+	} else if fmt.Sprintf("%v", *u) != fmt.Sprintf("%v", *sketches[3]) {
+		t.Errorf("Want %v after reading, got %v", *sketches[3], *u)
+	}
+
+	for _, i := range []int64{1, 3, 10, offsets[1] - 1} {
+		if _, err := (&Sketch{}).ReadFrom(bytes.NewReader(data[:i])); err != io.ErrUnexpectedEOF {
+			t.Errorf("Want io.ErrUnexpectedEOF reading %v bytes, got %v", i, err)
+		}
+	}
+
+	// A frame small enough to get past maxFrameSize can still claim a huge
+	// maximum number of centroids.
+	var frame bytes.Buffer
+	New(4).WriteTo(&frame)
+	binary.LittleEndian.PutUint32(frame.Bytes()[5:], 0x7fffffff)
+	if _, err := (&Sketch{}).ReadFrom(&frame); err == nil || err == io.EOF {
+		t.Errorf("Want error reading a frame with 2^31-1 centroids, got %v", err)
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestStringParseRoundTrip(t *testing.T) {
+	s := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	s.Add(math.NaN())
+	for _, h := range []*Sketch{s, New(4)} {
+		u, err := Parse(h.String())
+		if err != nil {
+			t.Fatalf("Got error parsing %v: %v", h, err)
+		}
+		if u.String() != h.String() {
+			t.Errorf("Want %v after parsing, got %v", h, u)
+		}
+		if !u.Equal(h, 0) || u.capacity() != h.capacity() || u.Dropped() != h.Dropped() {
+			t.Errorf("Want parsed Sketch to be identical to %v, got %v", h, u)
+		}
+	}
+	if u, _ := Parse(New(4).String()); u.Count() != 0 || !math.IsNaN(u.Min()) {
+		t.Errorf("Want an empty Sketch after parsing an empty Sketch, got %v", u)
+	}
+}
+
+func TestParseBadInput(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"{centroids=4 count=1 min=1 max=1 dropped=0 1:1}",
+		"{centroids=4 count=1 min=1 max=1 [1:1]}",
+		"{count=1 centroids=4 min=1 max=1 dropped=0 [1:1]}",
+		"{centroids=0 count=0 min=NaN max=NaN dropped=0 []}",
+		"{centroids=1.5 count=0 min=NaN max=NaN dropped=0 []}",
+		"{centroids=1 count=2 min=1 max=2 dropped=0 [1:1 2:1]}",
+		"{centroids=4 count=2 min=1 max=2 dropped=0 [2:1 1:1]}",
+		"{centroids=4 count=1 min=1 max=1 dropped=0 [1:~0]}",
+		"{centroids=4 count=1 min=1 max=1 dropped=0 [1]}",
+		"{centroids=4 count=1 min=1 max=1 dropped=0 [1:x]}",
+		// min > max.
+		"{centroids=4 count=100 min=5 max=1 dropped=0 [3:1]}",
+		// Weights don't add up to the count.
+		"{centroids=4 count=100 min=1 max=3 dropped=0 [1:1 3:1]}",
+	} {
+		if h, err := Parse(s); err == nil {
+			t.Errorf("Expected error parsing '%v', got %v", s, h)
+		}
+	}
+}
+
+func TestMarshalTextRoundTrip(t *testing.T) {
+	s := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	var m encoding.TextMarshaler = s
+	text, err := m.MarshalText()
+	if err != nil {
+		t.Fatalf("Want no error from MarshalText, got %v", err)
+	}
+	var u encoding.TextUnmarshaler = NewWithOptions(WithDecay(0.5))
+	if err := u.UnmarshalText(text); err != nil {
+		t.Fatalf("Want no error from UnmarshalText, got %v", err)
+	}
+	x := u.(*Sketch)
+	if !x.Equal(s, 0) || x.opts.decay != 0.5 {
+		t.Errorf("Want %v with options kept after UnmarshalText, got %v", s, x)
+	}
+
+	// Hand-written text, with some extra whitespace.
+	text = []byte("\n  {centroids=4 count=4 min=1 max=4 dropped=0\n\t[1:1 2.5:~2 4:1]}\n")
+	if err := x.UnmarshalText(text); err != nil {
+		t.Fatalf("Want no error from UnmarshalText, got %v", err)
+	}
+	if want := "{centroids=4 count=4 min=1 max=4 dropped=0 [1:1 2.5:~2 4:1]}"; x.String() != want {
+		t.Errorf("Want %v after UnmarshalText, got %v", want, x)
+	}
+}
+
+func TestUnmarshalTextBadInput(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"{centroids=4 count=1 min=1 max=1 dropped=0 [1:x]}",
+		// Weights don't add up to the count.
+		"{centroids=4 count=5 min=1 max=4 dropped=0 [1:1 4:1]}",
+		// A value outside of [min, max].
+		"{centroids=4 count=2 min=1 max=4 dropped=0 [1:1 5:1]}",
+	} {
+		s := New(4)
+		s.Add(7.0)
+		want := s.String()
+		if err := s.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("Expected error from UnmarshalText('%v'), got %v", text, s)
+		}
+		if s.String() != want {
+			t.Errorf("Want %v unchanged after bad UnmarshalText, got %v", want, s)
+		}
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	var stream bytes.Buffer
+	want := New(16)
+	rand.Seed(0)
+	for i := 0; i < 4; i++ {
+		s := New(16)
+		for j := 0; j < 1000; j++ {
+			v := rand.NormFloat64() + float64(i)
+			s.Add(v)
+			want.Add(v)
+		}
+		if _, err := s.WriteTo(&stream); err != nil {
+			t.Fatalf("Got error writing Sketch: %v", err)
+		}
+	}
+	data := stream.Bytes()
+	h, err := MergeFrom(bytes.NewReader(data), 16)
+	if err != nil {
+		t.Fatalf("Got error from MergeFrom: %v", err)
+	}
+	if h.Count() != 4000 || h.Min() != want.Min() || h.Max() != want.Max() {
+		t.Errorf("Want Count, Min, Max = 4000, %v, %v, got %v, %v, %v",
+			want.Min(), want.Max(), h.Count(), h.Min(), h.Max())
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9} {
+		if got, w := h.Quantile(q), want.Quantile(q); math.Abs(got-w) > 0.1 {
+			t.Errorf("Want Quantile(%v) near %v, got %v", q, w, got)
+		}
+	}
+
+	if h, err := MergeFrom(bytes.NewReader(nil), 8); err != nil || h.Count() != 0 {
+		t.Errorf("Want empty Sketch from empty reader, got %v (error %v)", h, err)
+	}
+	_, err = MergeFrom(bytes.NewReader(data[:len(data)-1]), 16)
+	if err == nil || !strings.Contains(err.Error(), "after reading 3 successfully") {
+		t.Errorf("Want error after reading 3 frames, got %v", err)
+	}
+	New(8).WriteTo(&stream)
+	if h, err := MergeFrom(bytes.NewReader(stream.Bytes()), 16); err != nil || h.Count() != want.Count() {
+		t.Errorf("Want Count %v merging sketches with different numbers of centroids, got %v (error %v)",
+			want.Count(), h, err)
+	}
+}
@@ -0,0 +1,49 @@
+package histosketch
+
+// Number is a constraint that permits any integer or floating point type.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Add a single value of any numeric type to h. The value is converted to a
+// float64, so integers with magnitude above 2^53 are rounded.
+func AddValue[T Number](h *Sketch, v T) {
+	h.Add(float64(v))
+}
+
+// Add all of the values in vs, of any numeric type, to h. The values are
+// converted to float64s once and then added with AddBatch, so integers with
+// magnitude above 2^53 are rounded.
+func AddSlice[T Number](h *Sketch, vs []T) {
+	fs := make([]float64, len(vs))
+	for i, v := range vs {
+		fs[i] = float64(v)
+	}
+	h.AddBatch(fs)
+}
+
+// Histogram is the API that Sketch offers for adding, merging and querying
+// values, so that generic code can work with a Sketch or any other histogram
+// with the same methods, such as an exact histogram used as a baseline. H is
+// the type of histogram that Merge accepts, which is normally the
+// implementation itself, so code generic over histograms is written as
+//
+//	func f[H Histogram[H]](a, b H) { ... }
+//
+// For an empty histogram, Count returns 0 and Sum, Min, Max and Quantile
+// return NaN. Quantile panics for p outside of [0.0, 1.0], and Merge
+// returns an error, leaving the receiver unchanged, if the two histograms
+// can't be merged.
+type Histogram[H any] interface {
+	Add(value float64)
+	Quantile(p float64) float64
+	Sum(p float64) float64
+	Min() float64
+	Max() float64
+	Count() float64
+	Merge(x H) error
+}
+
+var _ Histogram[*Sketch] = (*Sketch)(nil)
@@ -0,0 +1,105 @@
+package histosketch
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+type celsius float32
+
+func TestAddValue(t *testing.T) {
+	s, x := New(8), New(8)
+	AddValue(s, int64(3))
+	AddValue(s, uint8(200))
+	AddValue(s, float32(0.5))
+	AddValue(s, celsius(-2.5))
+	for _, v := range []float64{3.0, 200.0, 0.5, -2.5} {
+		x.Add(v)
+	}
+	if !s.Equal(x, 0) {
+		t.Errorf("Want AddValue to match Add, got %v, want %v", *s, *x)
+	}
+}
+
+func TestAddSlice(t *testing.T) {
+	s, x := New(8), New(8)
+	AddSlice(s, []int64{1, 5, 5, -7})
+	AddSlice(s, []float32{0.25, 1e3})
+	AddSlice(s, []int{})
+	for _, v := range []float64{1.0, 5.0, 5.0, -7.0, 0.25, 1e3} {
+		x.Add(v)
+	}
+	if !s.Equal(x, 0) {
+		t.Errorf("Want AddSlice to match Add, got %v, want %v", *s, *x)
+	}
+}
+
+// An exact histogram, to check that code written against Histogram works with
+// other implementations as well as Sketch.
+type exactHistogram struct {
+	vs []float64
+}
+
+func (e *exactHistogram) Add(value float64) {
+	i := sort.SearchFloat64s(e.vs, value)
+	e.vs = append(e.vs, 0)
+	copy(e.vs[i+1:], e.vs[i:])
+	e.vs[i] = value
+}
+
+func (e *exactHistogram) Quantile(p float64) float64 {
+	if len(e.vs) == 0 {
+		return math.NaN()
+	}
+	return e.vs[int(math.Min(p*float64(len(e.vs)), float64(len(e.vs)-1)))]
+}
+
+func (e *exactHistogram) Sum(p float64) float64 {
+	if len(e.vs) == 0 {
+		return math.NaN()
+	}
+	return float64(sort.Search(len(e.vs), func(i int) bool { return e.vs[i] > p }))
+}
+
+func (e *exactHistogram) Min() float64   { return e.Quantile(0.0) }
+func (e *exactHistogram) Max() float64   { return e.Quantile(1.0) }
+func (e *exactHistogram) Count() float64 { return float64(len(e.vs)) }
+
+func (e *exactHistogram) Merge(x *exactHistogram) error {
+	for _, v := range x.vs {
+		e.Add(v)
+	}
+	return nil
+}
+
+// Splits vs between two new histograms, merges them and returns the median.
+func mergedMedian[H Histogram[H]](a, b H, vs []float64) float64 {
+	for i, v := range vs {
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	if err := a.Merge(b); err != nil {
+		return math.NaN()
+	}
+	return a.Quantile(0.5)
+}
+
+func TestHistogram(t *testing.T) {
+	vs := []float64{}
+	for i := 1; i <= 101; i++ {
+		vs = append(vs, float64(i))
+	}
+	if got := mergedMedian(&exactHistogram{}, &exactHistogram{}, vs); got != 51.0 {
+		t.Errorf("Want 51 for median of exact histogram, got %v", got)
+	}
+	if got := mergedMedian(New(16), New(16), vs); math.Abs(got-51.0) > 1.0 {
+		t.Errorf("Want median of Sketch within 1 of 51, got %v", got)
+	}
+	if got := mergedMedian(New(16), New(8), vs); math.Abs(got-51.0) > 1.0 {
+		t.Errorf("Want median of Sketches with different capacities within 1 of 51, got %v", got)
+	}
+}
@@ -18,6 +18,25 @@
 //
 //   graphs --dist=exponential --centroids=8 --samples=50000 --bootstrap=1000
 //
+// To write an SVG file instead of piping to gnuplot, use the `format` flag:
+//
+//   graphs --dist=normal --centroids=8 --format=svg --output=/tmp/plot.svg
+//
+// To compare the error of several sketch sizes on the same graph, pass a
+// comma-separated list of centroid counts:
+//
+//   graphs --dist=normal --centroids=4,8,16,32 | gnuplot
+//
+// To print the max and mean absolute quantile error and the KS statistic of
+// each sketch to stderr, for scripting parameter sweeps, add `--stats`:
+//
+//   graphs --dist=normal --centroids=8,16 --stats > /dev/null
+//
+// For heavy-tailed data, a logarithmic x-axis makes the tail of a sum plot
+// easier to see:
+//
+//   graphs --dist=exponential --centroids=8 --plot=sum --logx | gnuplot
+//
 // Run with "--help" flag for more information.
 
 package main
@@ -27,9 +46,11 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -87,29 +108,129 @@ func lineCount(filename string) int {
 	return count
 }
 
-func plotComparison(s1 statFn, s2 statFn, begin float64, end float64, step float64) {
-	f, _ := os.Create("/tmp/plot.dat")
-	defer f.Close()
+// Evaluates actual and each of ests at each of xs, returning
+// (x, actual(x), ests[0](x), ests[1](x), ...) for each point.
+func comparison(ests []statFn, actual statFn, xs []float64) [][]float64 {
+	points := [][]float64{}
+	for _, x := range xs {
+		p := []float64{x, actual(x)}
+		for _, s := range ests {
+			p = append(p, s(x))
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// Returns the points from begin to end in increments of step, always ending
+// with end itself.
+func linearSteps(begin float64, end float64, step float64) []float64 {
+	xs := []float64{}
 	k := begin
 	for ; k <= end; k += step {
-		f.WriteString(fmt.Sprintf("%v %v %v\n", k, s1(k), s2(k)))
+		xs = append(xs, k)
 	}
 	if k - end < step {
-		f.WriteString(fmt.Sprintf("%v %v %v\n", end, s1(end), s2(end)))
+		xs = append(xs, end)
+	}
+	return xs
+}
+
+// Returns n+1 logarithmically spaced points from begin to end, which must both
+// be positive.
+func logSteps(begin float64, end float64, n int) []float64 {
+	xs := []float64{}
+	r := math.Log(end / begin)
+	for i := 0; i < n; i++ {
+		xs = append(xs, begin * math.Exp(r * float64(i) / float64(n)))
+	}
+	return append(xs, end)
+}
+
+func plotComparison(points [][]float64) {
+	f, _ := os.Create("/tmp/plot.dat")
+	defer f.Close()
+	for _, p := range points {
+		f.WriteString(strings.Trim(fmt.Sprint(p), "[]") + "\n")
+	}
+}
+
+// Parses a comma-separated list of centroid counts, like "4,8,16".
+func parseCentroids(s string) ([]int, error) {
+	ns := []int{}
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Bad centroid count: '%v'", f)
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// Returns a human-readable size of the memory used by a sketch with n
+// centroids.
+func footprint(n int) string {
+	ssb := histosketch.New(uint(n)).SizeBytes()
+	if ssb > 1024 * 1024 {
+		return fmt.Sprintf("%.1f MB", float64(ssb) / 1024.0 / 1024.0)
+	}
+	return fmt.Sprintf("%.1f KB", float64(ssb) / 1024.0)
+}
+
+// Number of evenly spaced quantiles in [0, 1] that printStats compares.
+const statsGrid = 1001
+
+// Prints the maximum and mean absolute difference between the quantiles of h,
+// a sketch with n centroids, and exact, along with the KS statistic between
+// them, to stderr as a single line of key=value pairs.
+func printStats(h *histosketch.Sketch, n int, exact *histosketch.Sketch) {
+	maxErr, sumErr := 0.0, 0.0
+	for i := 0; i < statsGrid; i++ {
+		q := float64(i) / (statsGrid - 1)
+		e := math.Abs(h.Quantile(q) - exact.Quantile(q))
+		maxErr = math.Max(maxErr, e)
+		sumErr += e
 	}
+	fmt.Fprintf(os.Stderr, "centroids=%v max_quantile_error=%g mean_quantile_error=%g ks=%g\n",
+		n, maxErr, sumErr / statsGrid, histosketch.KSStatistic(h, exact))
+}
+
+// Colors for each sketch's error curve, in the order the sketches are given
+// on the command line.
+var colors = []string{"#E7298A", "#1B9E77", "#D95F02", "#7570B3", "#66A61E", "#E6AB02", "#A6761D", "#666666"}
+
+// A sketch's error curve on a plot.
+type series struct {
+	label string
+	color string
 }
 
 func main() {
 	dist := flag.String("dist", "uniform", "Distribution to use: 'uniform', 'normal', 'exponential'")
 	plot := flag.String("plot", "quantile", "Type of plot: 'quantile' or 'sum'")
 	samples := flag.Int("samples", 10000, "Number of samples to add to histogram. Also, size of the exact histogram.")
-	centroids := flag.Int("centroids", 10, "Number of centroids in the sketch")
+	centroids := flag.String("centroids", "10", "Number of centroids in the sketch, or a comma-separated list like '4,8,16' to compare several sketches")
 	step := flag.Float64("step", 0.01, "Step size of the resulting plot")
 	seed := flag.Int64("seed", 0, "Seed for random number generator (0 to use current time).")
 	datafile := flag.String("datafile", "", "File containing one floating point value per line (overrides dist setting).")
 	bootstrap := flag.Int("bootstrap", 0, "Bootstrap the sketch with an optimal centroid decomposition from this many of the samples")
+	format := flag.String("format", "gnuplot", "Output format: 'gnuplot' to print gnuplot commands that plot to /tmp/plot.png, or 'svg' to write an SVG file")
+	output := flag.String("output", "/tmp/plot.svg", "Path to write the plot to with --format=svg")
+	logx := flag.Bool("logx", false, "Use a logarithmic x-axis, with plot points spaced logarithmically between the min and max value. Only for --plot=sum.")
+	stats := flag.Bool("stats", false, "Print the max and mean absolute quantile error and the KS statistic of each sketch to stderr")
 	flag.Parse()
 
+	if *format != "gnuplot" && *format != "svg" {
+		fmt.Printf("Unknown format: %v\n", *format)
+		return
+	}
+	ns, err := parseCentroids(*centroids)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	ss := *seed
 	if *seed == 0 && *datafile == "" {
 		ss = time.Now().UnixNano()
@@ -117,7 +238,10 @@ func main() {
 	}
 	rand.Seed(ss)
 
-	h1 := histosketch.New(uint(*centroids))
+	h1s := make([]*histosketch.Sketch, len(ns))
+	for i, n := range ns {
+		h1s[i] = histosketch.New(uint(n))
+	}
 	h2 := histosketch.New(uint(*samples))
 
 	var reader chan float64
@@ -146,47 +270,94 @@ func main() {
 	}
 
 	if *bootstrap > 0 {
-		h1 = histosketch.NewFromSample(sample, *centroids)
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("# H: %v\n", h1))
+		for i, n := range ns {
+			// NewFromSample sorts its sample, so give each sketch its own copy.
+			h1s[i], err = histosketch.NewFromSample(append([]float64{}, sample...), n)
+			if err != nil {
+				panic(fmt.Sprintf("Error bootstrapping sketch: %v", err))
+			}
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("# H: %v\n", h1s[i]))
+		}
 	}
 
 	for x := range reader {
-		h1.Add(x)
+		for _, h1 := range h1s {
+			h1.Add(x)
+		}
 		h2.Add(x)
 	}
 
-	var s1, s2 statFn
+	var s1s []statFn
+	var s2 statFn
 	var begin, end float64
 	if *plot == "quantile" {
-		s1, s2 = h1.Quantile, h2.Quantile
+		for _, h1 := range h1s {
+			s1s = append(s1s, h1.QuantileFunc())
+		}
+		s2 = h2.QuantileFunc()
 		begin, end = 0.0, 1.0
 	} else if *plot == "sum" {
-		s1, s2 = h1.Sum, h2.Sum
-		begin, end = h1.Min(), h1.Max()
+		for _, h1 := range h1s {
+			s1s = append(s1s, h1.SumFunc())
+		}
+		s2 = h2.SumFunc()
+		begin, end = h2.Min(), h2.Max()
 	} else {
 		fmt.Printf("Unknown plot type: %v\n", *plot)
 		return
 	}
 
-	plotComparison(s1, s2, begin, end, *step)
+	xs := linearSteps(begin, end, *step)
+	if *logx {
+		if *plot != "sum" {
+			fmt.Println("--logx only works with --plot=sum")
+			return
+		} else if !(begin > 0) {
+			fmt.Printf("Can't use --logx with non-positive min value %v\n", begin)
+			return
+		}
+		// Use as many points as a linear plot would have.
+		xs = logSteps(begin, end, len(xs) - 1)
+	}
+	points := comparison(s1s, s2, xs)
+	if *stats {
+		for i, h1 := range h1s {
+			printStats(h1, ns[i], h2)
+		}
+	}
 
-	ssb := int(*centroids) * 256 + 192
-	sd := ""
-	if ssb > 1024 * 1024 {
-		sd = fmt.Sprintf("%.1f MB", float64(ssb) / 1024.0 / 1024.0)
-	} else {
-		sd = fmt.Sprintf("%.1f KB", float64(ssb) / 1024.0)
+	title := fmt.Sprintf("%v distribution, %v samples", *dist, *samples)
+	if *datafile != "" {
+		title = *datafile
+	}
+	subtitle := fmt.Sprintf("sketch with %v centroids (~%v)", ns[0], footprint(ns[0]))
+	ss1 := []series{{"Sketch error", colors[0]}}
+	if len(ns) > 1 {
+		subtitle = fmt.Sprintf("sketches with %v centroids", *centroids)
+		ss1 = make([]series, len(ns))
+		for i, n := range ns {
+			ss1[i] = series{fmt.Sprintf("%v centroids (~%v)", n, footprint(n)), colors[i % len(colors)]}
+		}
 	}
 
+	if *format == "svg" {
+		f, err := os.Create(*output)
+		if err != nil {
+			panic(fmt.Sprintf("Error creating file: %v", err))
+		}
+		defer f.Close()
+		writeSVG(f, points, ss1, []string{title, subtitle}, *plot, *logx)
+		return
+	}
+
+	plotComparison(points)
 	fmt.Println("set term png")
 	fmt.Println("set output '/tmp/plot.png'")
-	if *datafile == "" {
-		fmt.Printf("set title \"%v distribution, %v samples\\n", *dist, *samples)
-	} else {
-		fmt.Printf("set title \"%v\\n", *datafile)
-	}
-	fmt.Printf("sketch with %v centroids (~%v)\"\n", *centroids, sd)
+	fmt.Printf("set title \"%v\\n%v\"\n", title, subtitle)
 	fmt.Println("set xlabel \"x\"")
+	if *logx {
+		fmt.Println("set logscale x")
+	}
 	fmt.Printf("set ylabel \"%v(x)\"\n", *plot)
 
 	// Next six lines make the graph axes and grid lines look nice. Stolen from Hagen Wierstorf
@@ -194,7 +365,7 @@ func main() {
 	fmt.Println("set style line 101 lc rgb '#808080' lt 1 lw 1")
 	fmt.Println("set border 3 front ls 101")
 	fmt.Println("set tics nomirror out scale 0.75")
-	fmt.Println("set format '%g'")
+	fmt.Printf("set format '%%g'\n")
 	fmt.Println("set style line 102 lc rgb '#d6d7d9' lt 0 lw 1")
 	fmt.Println("set grid back ls 102")
 
@@ -204,6 +375,8 @@ func main() {
 		fmt.Println("set key bottom right")
 	}
 	fmt.Printf("plot ")
-	fmt.Printf("'/tmp/plot.dat' using 1:2:3 title \"Sketch error\" with filledcurves lc rgb \"#E7298A\", ")
-	fmt.Printf("'/tmp/plot.dat' using 1:3 title \"Actual\" with lines lc rgb \"blue\"\n")
+	for i, sr := range ss1 {
+		fmt.Printf("'/tmp/plot.dat' using 1:%v:2 title \"%v\" with filledcurves lc rgb \"%v\", ", i + 3, sr.label, sr.color)
+	}
+	fmt.Printf("'/tmp/plot.dat' using 1:2 title \"Actual\" with lines lc rgb \"blue\"\n")
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	svgWidth  = 640
+	svgHeight = 480
+	// Margins around the plot area, leaving room for the title and axes.
+	svgLeft   = 70
+	svgRight  = 20
+	svgTop    = 60
+	svgBottom = 50
+)
+
+// Returns about n evenly spaced "nice" tick values (multiples of 1, 2 or 5
+// times a power of 10) covering [lo, hi].
+func ticks(lo, hi float64, n int) []float64 {
+	if !(hi > lo) {
+		return []float64{lo}
+	}
+	raw := (hi - lo) / float64(n)
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	step := mag
+	for _, m := range []float64{2, 5, 10} {
+		if step >= raw {
+			break
+		}
+		step = m * mag
+	}
+	ts := []float64{}
+	for t := math.Ceil(lo/step) * step; t <= hi+step*1e-9; t += step {
+		// Avoid printing things like 0.30000000000000004.
+		ts = append(ts, math.Round(t/step)*step)
+	}
+	return ts
+}
+
+// Returns the powers of 10 in [lo, hi], or the ticks returned by ticks if
+// there are fewer than two of them. lo must be positive.
+func logTicks(lo, hi float64) []float64 {
+	ts := []float64{}
+	for e := math.Ceil(math.Log10(lo)); e <= math.Floor(math.Log10(hi)); e++ {
+		ts = append(ts, math.Pow(10, e))
+	}
+	if len(ts) < 2 {
+		return ticks(lo, hi, 8)
+	}
+	return ts
+}
+
+// Writes a self-contained SVG plot of points to w, in the same style as the
+// gnuplot output: each sketch's estimated curve (columns 2 and up) is drawn as
+// a filled region against the actual curve (column 1), so the area of the
+// region shows the error of the sketch. ss gives the legend label and color
+// of each sketch, in column order. If logx is true, the x-axis is
+// logarithmic and all x values must be positive.
+func writeSVG(w io.Writer, points [][]float64, ss []series, title []string, plot string, logx bool) {
+	xlo, xhi := points[0][0], points[len(points)-1][0]
+	ylo, yhi := math.Inf(1), math.Inf(-1)
+	for _, p := range points {
+		for _, y := range p[1:] {
+			ylo = math.Min(ylo, y)
+			yhi = math.Max(yhi, y)
+		}
+	}
+	if !(yhi > ylo) {
+		ylo, yhi = ylo-1, yhi+1
+	}
+	if !(xhi > xlo) {
+		xlo, xhi = xlo-1, xhi+1
+	}
+	pw := float64(svgWidth - svgLeft - svgRight)
+	ph := float64(svgHeight - svgTop - svgBottom)
+	sx := func(x float64) float64 { return svgLeft + (x-xlo)/(xhi-xlo)*pw }
+	xticks := ticks(xlo, xhi, 8)
+	if logx {
+		sx = func(x float64) float64 {
+			return svgLeft + math.Log(x/xlo)/math.Log(xhi/xlo)*pw
+		}
+		xticks = logTicks(xlo, xhi)
+	}
+	sy := func(y float64) float64 { return svgTop + (yhi-y)/(yhi-ylo)*ph }
+	path := func(col int) []string {
+		ps := make([]string, len(points))
+		for i, p := range points {
+			ps[i] = fmt.Sprintf("%.2f,%.2f", sx(p[0]), sy(p[col]))
+		}
+		return ps
+	}
+
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%v\" height=\"%v\" "+
+		"font-family=\"sans-serif\" font-size=\"12\">\n", svgWidth, svgHeight)
+	fmt.Fprintf(w, "<rect width=\"100%%\" height=\"100%%\" fill=\"white\"/>\n")
+	for i, line := range title {
+		fmt.Fprintf(w, "<text x=\"%v\" y=\"%v\" text-anchor=\"middle\" font-size=\"14\">%v</text>\n",
+			svgWidth/2, 20+18*i, html.EscapeString(line))
+	}
+
+	// Grid lines and tick labels.
+	for _, t := range xticks {
+		fmt.Fprintf(w, "<line x1=\"%.2f\" y1=\"%v\" x2=\"%.2f\" y2=\"%v\" stroke=\"#d6d7d9\" stroke-dasharray=\"2,2\"/>\n",
+			sx(t), svgTop, sx(t), svgHeight-svgBottom)
+		fmt.Fprintf(w, "<text x=\"%.2f\" y=\"%v\" text-anchor=\"middle\">%g</text>\n",
+			sx(t), svgHeight-svgBottom+16, t)
+	}
+	for _, t := range ticks(ylo, yhi, 6) {
+		fmt.Fprintf(w, "<line x1=\"%v\" y1=\"%.2f\" x2=\"%v\" y2=\"%.2f\" stroke=\"#d6d7d9\" stroke-dasharray=\"2,2\"/>\n",
+			svgLeft, sy(t), svgWidth-svgRight, sy(t))
+		fmt.Fprintf(w, "<text x=\"%v\" y=\"%.2f\" text-anchor=\"end\" dominant-baseline=\"middle\">%g</text>\n",
+			svgLeft-6, sy(t), t)
+	}
+	fmt.Fprintf(w, "<path d=\"M%v,%v V%v H%v\" fill=\"none\" stroke=\"#808080\"/>\n",
+		svgLeft, svgTop, svgHeight-svgBottom, svgWidth-svgRight)
+	fmt.Fprintf(w, "<text x=\"%v\" y=\"%v\" text-anchor=\"middle\">x</text>\n",
+		svgLeft+int(pw)/2, svgHeight-12)
+	fmt.Fprintf(w, "<text transform=\"translate(16,%v) rotate(-90)\" text-anchor=\"middle\">%v(x)</text>\n",
+		svgTop+int(ph)/2, html.EscapeString(plot))
+
+	// The error region between each estimated curve and the actual curve, in
+	// order so that later sketches are drawn on top, then the actual curve.
+	actual := path(1)
+	for i, j := 0, len(actual)-1; i < j; i, j = i+1, j-1 {
+		actual[i], actual[j] = actual[j], actual[i]
+	}
+	for i, s := range ss {
+		fmt.Fprintf(w, "<polygon points=\"%v %v\" fill=\"%v\"/>\n",
+			strings.Join(path(i+2), " "), strings.Join(actual, " "), s.color)
+	}
+	fmt.Fprintf(w, "<polyline points=\"%v\" fill=\"none\" stroke=\"blue\" stroke-width=\"1.5\"/>\n",
+		strings.Join(path(1), " "))
+
+	// Legend, placed where it's least likely to cover the curves.
+	lx, ly := svgLeft+10, svgTop+10
+	if plot != "quantile" {
+		lx, ly = svgWidth-svgRight-170, svgHeight-svgBottom-30-20*len(ss)
+	}
+	for i, s := range ss {
+		fmt.Fprintf(w, "<rect x=\"%v\" y=\"%v\" width=\"20\" height=\"10\" fill=\"%v\"/>\n",
+			lx, ly+20*i, s.color)
+		fmt.Fprintf(w, "<text x=\"%v\" y=\"%v\">%v</text>\n", lx+26, ly+20*i+10, html.EscapeString(s.label))
+	}
+	ay := ly + 20*len(ss)
+	fmt.Fprintf(w, "<line x1=\"%v\" y1=\"%v\" x2=\"%v\" y2=\"%v\" stroke=\"blue\" stroke-width=\"1.5\"/>\n",
+		lx, ay+5, lx+20, ay+5)
+	fmt.Fprintf(w, "<text x=\"%v\" y=\"%v\">Actual</text>\n", lx+26, ay+10)
+	fmt.Fprintln(w, "</svg>")
+}
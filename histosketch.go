@@ -18,20 +18,43 @@
 //     2011 (http://journal.r-project.org/archive/2011-2/RJournal_2011-2_Wang+Song.pdf)
 //
 //   * Storing the min and max value for better estimation of extreme
-//     quantiles.
+//     quantiles. They anchor the interpolation in the tails: the first and
+//     last centroids are interpolated towards the exact min and max rather
+//     than extrapolated from their means. Reserving the first and last
+//     centroids for singleton extremes, as t-digest does, doesn't improve on
+//     this and costs two centroids that could go elsewhere: with 16
+//     centroids, it makes p1 and p99 estimates slightly worse on
+//     exponential, normal, uniform and log-normal data.
 //
 //   * Returning exact values for Sum and Quantile when they're known (before
 //     any centroid merging happens).
 //
 //   * Improvements in handling some boundary conditions.
+//
+// Nothing in a Sketch is random: adding the same values, in the same order, to
+// two Sketches created with the same options always produces identical
+// Sketches, down to the bytes written by MarshalBinary, so there's no seed to
+// set. This holds across platforms too, so golden files of encoded sketches
+// can be shared between machines: compression always merges the pair of
+// centroids with the smallest gap, breaking ties in favor of the leftmost
+// pair, and the arithmetic that merges centroids is written so that the
+// compiler can't fuse it into multiply-add instructions, which only some
+// platforms have. Time-based decay (see WithHalfLife) only depends on the
+// timestamps passed to AddTimestamped, never on the clock, but its decay
+// factors come from math.Exp2, which may differ in the last bit between
+// platforms. The one exception is a ShardedSketch, which spreads values over
+// its shards depending on how concurrent Adds interleave.
 package histosketch
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"sort"
+	"sync"
+	"time"
+	"unsafe"
 )
 
 // Following the Ben-Haim and Tom-Tov paper, each centroid is represented by its
@@ -45,40 +68,423 @@ type centroid struct {
 
 func (c *centroid) Merge(d centroid) {
 	s := math.Abs(c.m) + math.Abs(d.m)
-	c.p = (c.p*math.Abs(c.m) + d.p*math.Abs(d.m)) / s
-	c.m = -s
+	// The explicit conversions round each product before it's added, which
+	// keeps the compiler from fusing them into a multiply-add on platforms
+	// that have one, so that merging gives the same result everywhere.
+	p := (float64(c.p*math.Abs(c.m)) + float64(d.p*math.Abs(d.m))) / s
+	if math.IsInf(p, 0) {
+		// The weighted sum overflowed, so weight each value before adding.
+		p = float64(c.p*(math.Abs(c.m)/s)) + float64(d.p*(math.Abs(d.m)/s))
+	}
+	c.p, c.m = p, -s
 }
 
+// A Sketch summarizes a stream of values with a fixed number of centroids.
+// Every query that returns a single estimate returns NaN on a Sketch that no
+// values have been added to, with the exception of Count, which returns 0.
 type Sketch struct {
-	cs    []centroid
-	count float64
-	min float64
-	max float64
+	cs      []centroid
+	count   float64
+	comp    float64 // Rounding error not yet folded into count, see addCount.
+	min     float64
+	max     float64
+	dropped float64
+	last    time.Time // Latest timestamp given to AddTimestamped.
+	watches []*watch  // Quantiles being watched, see WatchQuantile.
+	probe   *probe    // Sample of raw values, see WithAccuracyProbe.
+	opts    options
+	shared  bool // Whether cs may be shared with a Fork.
 }
 
-// Create a new Sketch with a maximum of n centroids.
+// Create a new Sketch with a maximum of n centroids. This is the same as
+// NewWithOptions(WithCentroids(n)).
 func New(n uint) *Sketch {
-	if n == 0 {
-		panic("Number of centroids must be at least 1.")
+	return NewWithOptions(WithCentroids(n))
+}
+
+// The largest number of centroids CentroidsForError recommends.
+const maxRecommendedCentroids = 1 << 24
+
+// The largest maximum number of centroids a Sketch can have. Every
+// serialization can describe a Sketch this large, and decoding rejects
+// anything larger instead of allocating memory for it.
+const maxCentroids = 1 << 24
+
+// Returns a recommended maximum number of centroids for a Sketch whose
+// quantile estimates should be within maxQuantileError of the true quantile,
+// measured in rank: with maxQuantileError = 0.01, Quantile(0.5) should fall
+// somewhere between the true 49th and 51st percentiles. There are no
+// theoretical bounds on the error of the sketch, so this is a heuristic based
+// on experiments with uniformly distributed data, where the worst rank error
+// over all quantiles is about 0.16 divided by the number of centroids. Skewed
+// or multimodal data may need more centroids. Panics unless maxQuantileError
+// is positive.
+func CentroidsForError(maxQuantileError float64) uint {
+	if !(maxQuantileError > 0) {
+		panic(fmt.Sprintf("bad argument, maxQuantileError must be positive, got %v", maxQuantileError))
+	}
+	n := math.Ceil(0.2 / maxQuantileError)
+	if n > maxRecommendedCentroids {
+		return maxRecommendedCentroids
+	}
+	return uint(n)
+}
+
+// Returns a deep copy of h. Changes to the copy never affect h, and vice versa.
+func (h Sketch) Clone() *Sketch {
+	c := h
+	c.cs = make([]centroid, len(h.cs), cap(h.cs))
+	copy(c.cs, h.cs)
+	c.shared = false
+	c.watches = nil
+	c.probe = h.probe.clone()
+	return &c
+}
+
+// Returns a copy of h that shares h's centroids until either h or the copy is
+// changed, at which point the one being changed copies the centroids first.
+// This makes forking cheap when most forks are only read, or are changed only
+// much later. After a fork, h and each of its forks behave like independent
+// Sketches: changing one never affects the others, and one goroutine can
+// change a fork while another reads or changes h. Each first change after a
+// fork costs as much as a Clone, even for the last Sketch still using the
+// shared centroids, since a Sketch can't tell whether its forks are still
+// around. Fork itself marks h as shared, so it counts as a change to h for
+// locking purposes. SizeBytes counts the shared centroids in full for each
+// Sketch.
+func (h *Sketch) Fork() *Sketch {
+	h.shared = true
+	f := *h
+	f.watches = nil
+	f.probe = h.probe.clone()
+	return &f
+}
+
+// Gives h its own copy of its centroids if they may be shared with a Fork.
+// Every method that changes the centroids in place calls this first.
+func (h *Sketch) own() {
+	if h.shared {
+		cs := make([]centroid, len(h.cs), cap(h.cs))
+		copy(cs, h.cs)
+		h.cs, h.shared = cs, false
+	}
+}
+
+// Returns the number of bytes of memory h uses: the Sketch struct itself plus
+// the full capacity of its centroid slice, which is allocated up front, so
+// the size doesn't change as values are added. The reservoir kept by
+// WithAccuracyProbe is counted once the first value has been sampled. This
+// doesn't count the pointer, if any, that refers to h.
+func (h Sketch) SizeBytes() int {
+	n := int(unsafe.Sizeof(h)) + cap(h.cs)*int(unsafe.Sizeof(centroid{}))
+	if h.probe != nil {
+		n += int(unsafe.Sizeof(*h.probe)) + cap(h.probe.vs)*8
+	}
+	return n
+}
+
+// Removes all values from h, leaving it in the same state as a Sketch freshly
+// created with the same number of centroids and options. The memory used for
+// the centroids is retained for reuse.
+func (h *Sketch) Reset() {
+	if h.shared {
+		h.cs, h.shared = make([]centroid, 0, cap(h.cs)), false
+	}
+	h.cs = h.cs[:0]
+	h.count, h.comp = 0, 0
+	if h.probe != nil {
+		h.probe.vs, h.probe.total = h.probe.vs[:0], 0
+	}
+	h.min = math.MaxFloat64
+	h.max = -math.MaxFloat64
+	h.dropped = 0
+	h.last = time.Time{}
+}
+
+// Reports whether h and x are structurally identical up to a tolerance: they
+// must have the same maximum number of centroids, the same centroids with
+// values and weights that agree within tol, and Min, Max and Count that
+// agree within tol. This is a comparison of the internal representation, not
+// of the distributions: two Sketches built from the same values in different
+// orders may estimate almost the same quantiles but not be Equal.
+func (h Sketch) Equal(x *Sketch, tol float64) bool {
+	near := func(a, b float64) bool { return math.Abs(a-b) <= tol }
+	if h.capacity() != x.capacity() || len(h.cs) != len(x.cs) {
+		return false
+	}
+	if !near(h.count, x.count) || !near(h.min, x.min) || !near(h.max, x.max) {
+		return false
+	}
+	for i, c := range h.cs {
+		d := x.cs[i]
+		if (c.m > 0) != (d.m > 0) || !near(c.p, d.p) || !near(c.m, d.m) {
+			return false
+		}
 	}
-	return &Sketch{make([]centroid, 0, n+1), 0, math.MaxFloat64, -math.MaxFloat64}
+	return true
 }
 
-// Total number of values added to the Histogram.
+// Relative tolerance Validate allows between Count and the total weight of
+// the centroids, which can drift apart through rounding as values are added
+// and merged.
+const validateTolerance = 1e-9
+
+// Checks h's internal invariants, returning an error describing the first one
+// that doesn't hold: there are at most the maximum number of centroids, they're
+// sorted by value, every weight is positive and finite, the weights add up to
+// Count and every centroid value is in [Min, Max]. A Sketch built only through
+// this package's API always passes, so an error means h was corrupted, for
+// example by concurrent use without locking. Takes time linear in the number
+// of centroids.
+func (h Sketch) Validate() error {
+	if len(h.cs) > h.capacity()+h.opts.extra {
+		return errors.New(fmt.Sprintf("Sketch has %v centroids, more than its maximum of %v",
+			len(h.cs), h.capacity()+h.opts.extra))
+	}
+	if len(h.cs) == 0 {
+		if h.count != 0 {
+			return errors.New(fmt.Sprintf("Sketch with no centroids has count %v", h.count))
+		}
+		return nil
+	}
+	if !(h.min <= h.max) {
+		return errors.New(fmt.Sprintf("Sketch has min %v > max %v", h.min, h.max))
+	}
+	total := 0.0
+	for i, c := range h.cs {
+		w := math.Abs(c.m)
+		if !(w > 0) || math.IsInf(w, 0) {
+			return errors.New(fmt.Sprintf("Centroid %v has weight %v", i, w))
+		} else if i > 0 && !(c.p >= h.cs[i-1].p) {
+			return errors.New(fmt.Sprintf("Centroid %v with value %v is out of order", i, c.p))
+		} else if !(c.p >= h.min && c.p <= h.max) {
+			return errors.New(fmt.Sprintf("Centroid %v with value %v is outside [%v, %v]",
+				i, c.p, h.min, h.max))
+		}
+		total += w
+	}
+	if !(math.Abs(total-h.count) <= validateTolerance*math.Max(total, h.count)) {
+		return errors.New(fmt.Sprintf("Centroid weights add up to %v, but count is %v", total, h.count))
+	}
+	return nil
+}
+
+// Total weight of the NaN and infinite values that were skipped instead of
+// being added to the Histogram. For unweighted values added with Add, this is
+// just the number of values skipped. Dropped values aren't included in Count.
+// Merge adds the dropped weights of both sketches. The dropped weight is
+// included in String, but not in the binary or JSON serializations.
+func (h Sketch) Dropped() float64 {
+	return h.dropped
+}
+
+// Total number of values added to the Histogram. This is the summed weight of
+// all centroids, maintained as a running total so the call is O(1). The total
+// is kept with compensated summation, so it stays accurate even after billions
+// of small weights.
 func (h Sketch) Count() float64 {
 	return h.count
 }
 
-// Maximum value added to the Histogram.
+// Adds w to the running count with Neumaier's compensated summation, so that
+// rounding error doesn't build up in Count over billions of small weights.
+// count is always the closest float64 to the compensated sum, and comp holds
+// what's left over, which is folded in as later additions make it matter.
+func (h *Sketch) addCount(w float64) {
+	t, c := neumaier(h.count, h.comp, w)
+	h.count = t + c
+	h.comp = c - (h.count - t)
+}
+
+// Returns sum + x along with the rounding error of that addition added to
+// comp, following Neumaier's variant of Kahan summation. The compensated sum
+// is the returned sum plus the returned comp.
+func neumaier(sum, comp, x float64) (float64, float64) {
+	t := sum + x
+	if math.Abs(sum) >= math.Abs(x) {
+		return t, comp + ((sum - t) + x)
+	}
+	return t, comp + ((x - t) + sum)
+}
+
+// Maximum value added to the Histogram, or NaN if no values have been added.
+// This is tracked exactly: merging sketches takes the larger of their
+// maximums, and Decay and Scale leave it unchanged.
 func (h Sketch) Max() float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
 	return h.max
 }
 
-// Minimum value added to the Histogram.
+// Minimum value added to the Histogram, or NaN if no values have been added.
+// This is tracked exactly: merging sketches takes the smaller of their
+// minimums, and Decay and Scale leave it unchanged.
 func (h Sketch) Min() float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
 	return h.min
 }
 
+// Mean of all values added to the Histogram, or NaN if no values have been
+// added. Merging centroids preserves the weighted sum of their values, so this
+// is exact up to floating point error. Takes time on the order of the number
+// of centroids.
+func (h Sketch) Mean() float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	s, comp := 0.0, 0.0
+	for _, c := range h.cs {
+		s, comp = neumaier(s, comp, float64(c.p*math.Abs(c.m)))
+	}
+	return (s + comp) / h.count
+}
+
+// Estimate of the mean of the values between the lo and hi quantiles of the
+// Histogram, ignoring the mass below lo and above hi. For example,
+// TrimmedMean(0.05, 0.95) drops the bottom and top 5% of values. Each
+// centroid is treated as a point mass covering a range of ranks, and
+// centroids that straddle lo or hi only contribute the part of their weight
+// inside the range. Returns NaN unless 0 <= lo < hi <= 1, or if no values have
+// been added. Takes time on the order of the number of centroids.
+func (h Sketch) TrimmedMean(lo, hi float64) float64 {
+	if len(h.cs) == 0 || !(0 <= lo && lo < hi && hi <= 1) {
+		return math.NaN()
+	}
+	a, b := lo*h.count, hi*h.count
+	sum, w, s := 0.0, 0.0, 0.0
+	for _, c := range h.cs {
+		m := math.Abs(c.m)
+		if o := math.Min(s+m, b) - math.Max(s, a); o > 0 {
+			sum += c.p * o
+			w += o
+		}
+		s += m
+		if s >= b {
+			break
+		}
+	}
+	if w == 0 {
+		return math.NaN()
+	}
+	return sum / w
+}
+
+// Estimate of the (population) variance of all values added to the Histogram,
+// or NaN if no values have been added. Each centroid is treated as a point
+// mass at its mean value, so any spread of the values within a merged centroid
+// is lost. This means the estimate is biased low, and the bias grows as the
+// number of centroids shrinks relative to the spread of the data: with a
+// single centroid, the estimate is always 0. Takes time on the order of the
+// number of centroids.
+func (h Sketch) Variance() float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	u := h.Mean()
+	s := 0.0
+	for _, c := range h.cs {
+		s += (c.p - u) * (c.p - u) * math.Abs(c.m)
+	}
+	return s / h.count
+}
+
+// Estimate of the standard deviation of all values added to the Histogram.
+// This is the square root of Variance() and shares its bias.
+func (h Sketch) StdDev() float64 {
+	return math.Sqrt(h.Variance())
+}
+
+// A Centroid is the exported view of a single centroid in a Sketch: the mean
+// Value of the points it represents and their total Weight.
+type Centroid struct {
+	Value  float64
+	Weight float64
+}
+
+// Returns a copy of the centroids in h, sorted by value. The returned slice is
+// newly allocated on each call, so mutating it doesn't affect h.
+func (h Sketch) Centroids() []Centroid {
+	cs := make([]Centroid, len(h.cs))
+	for i, c := range h.cs {
+		cs[i] = Centroid{c.p, math.Abs(c.m)}
+	}
+	return cs
+}
+
+// Returns the k centroids around the qth quantile, sorted by value, to show
+// which centroids an estimate like Quantile(0.99) is made from. Starting from
+// the two centroids on either side of Quantile(q), the centroids are picked
+// outward one at a time, taking whichever of the next centroid below and the
+// next centroid above has a value closer to Quantile(q), so unless q is near
+// 0 or 1 the result straddles the estimate. q is clamped to [0.0, 1.0], and if
+// k is at least the number of centroids, all of them are returned. Returns an
+// empty slice if no values have been added or q is NaN. Panics if k is
+// negative.
+func (h Sketch) CentroidsAround(q float64, k int) []Centroid {
+	if k < 0 {
+		panic(fmt.Sprintf("bad argument, number of centroids must be non-negative, got %v", k))
+	}
+	h.cs = h.compacted()
+	if len(h.cs) == 0 || math.IsNaN(q) {
+		return []Centroid{}
+	}
+	q = math.Min(math.Max(q, 0.0), 1.0)
+	v := h.Quantile(q)
+	// The quantile is between h.cs[lo-1] and h.cs[hi], and the centroids
+	// picked so far are h.cs[lo:hi].
+	lo, _ := h.quantileIndex(q * h.count)
+	hi := lo
+	for hi-lo < k && hi-lo < len(h.cs) {
+		if hi == len(h.cs) || (lo > 0 && v-h.cs[lo-1].p <= h.cs[hi].p-v) {
+			lo--
+		} else {
+			hi++
+		}
+	}
+	cs := make([]Centroid, hi-lo)
+	for i, c := range h.cs[lo:hi] {
+		cs[i] = Centroid{c.p, math.Abs(c.m)}
+	}
+	return cs
+}
+
+// Calls fn with the value and weight of each centroid in h, in ascending order
+// of value, stopping early if fn returns false. Unlike Centroids, this doesn't
+// allocate. fn must not modify h.
+func (h Sketch) ForEachCentroid(fn func(value, weight float64) bool) {
+	for _, c := range h.cs {
+		if !fn(c.p, math.Abs(c.m)) {
+			return
+		}
+	}
+}
+
+// Returns the index of the first centroid with value >= x, or the number of
+// centroids if there isn't one. This is where Add inserts x.
+func (h Sketch) search(x float64) int {
+	return sort.Search(len(h.cs), func(i int) bool { return h.cs[i].p >= x })
+}
+
+// Returns the value and weight of the centroid closest to x, along with its
+// index in the order of Centroids. If x is exactly halfway between two
+// centroids, returns the lower one. This finds centroids with the same search
+// Add uses to place a value, so it's mostly useful for debugging, but it can
+// also help with custom merge heuristics built on Centroids. Returns NaN, NaN
+// and -1 if no values have been added or x is NaN.
+func (h Sketch) NearestCentroid(x float64) (value, weight float64, index int) {
+	if len(h.cs) == 0 || math.IsNaN(x) {
+		return math.NaN(), math.NaN(), -1
+	}
+	k := h.search(x)
+	if k == len(h.cs) || (k > 0 && x-h.cs[k-1].p <= h.cs[k].p-x) {
+		k--
+	}
+	return h.cs[k].p, math.Abs(h.cs[k].m), k
+}
+
 // Add a single value to the Histogram.
 func (h *Sketch) Add(value float64) {
 	h.AddMany(value, 1)
@@ -86,59 +492,737 @@ func (h *Sketch) Add(value float64) {
 
 // Add count values to the Histgram. Equivalent to calling Add(value) count times.
 func (h *Sketch) AddMany(value float64, count int64) {
+	h.AddWeighted(value, float64(count))
+}
+
+// Add n copies of a value to the Histogram. Equivalent to calling Add(value) n
+// times, but only costs a single insertion. Adding 0 copies does nothing.
+func (h *Sketch) AddN(value float64, n uint64) {
+	h.AddWeighted(value, float64(n))
+}
+
+// Add a value with the given weight to the Histogram, as if it had been added
+// weight times. The weight doesn't need to be a whole number. Panics if the
+// weight is negative, infinite or NaN. Adding a value with weight 0 does
+// nothing. NaN and infinite values are skipped rather than added, since they
+// have no place in the ordering of the centroids; their weight is counted by
+// Dropped instead.
+// A value equal to the value of an existing centroid just adds its weight to
+// that centroid, so a stream of repeated values only ever uses one centroid
+// per distinct value, leaving the rest of the budget for the others.
+func (h *Sketch) AddWeighted(value float64, weight float64) {
+	if !(weight >= 0) || math.IsInf(weight, 0) {
+		panic(fmt.Sprintf("bad argument, weight must be non-negative and finite, got %v", weight))
+	}
+	if weight == 0 {
+		return
+	}
+	if h.skip(value, weight) {
+		return
+	}
+	value = h.opts.bound(value)
+	if h.opts.decay != 0 {
+		h.Scale(h.opts.decay)
+	}
+	h.sample(value, weight)
 	if value < h.min {
 		h.min = value
 	}
 	if value > h.max {
 		h.max = value
 	}
+	h.own()
 
-	// Find the index k in the sorted list of centroids where (value, count) belongs.
-	k := sort.Search(len(h.cs), func(i int) bool { return h.cs[i].p >= value })
+	// Find the index k in the sorted list of centroids where (value, weight) belongs.
+	k := h.search(value)
 	if k < len(h.cs) && h.cs[k].p == value {
 		// There's an exact match for the value. Just merge the counts and return.
-		h.cs[k].m += math.Copysign(1.0, h.cs[k].m) * float64(count)
-		h.count += float64(count)
+		h.cs[k].m += math.Copysign(1.0, h.cs[k].m) * weight
+		h.addCount(weight)
+		h.fit()
+		h.notify()
 		return
 	}
 
 	// Move everything starting at index k up one slot in the array, insert the
 	// new centroid and update the total sum of all centroid counts.
 	h.cs = append(h.cs, centroid{0, 0})
-	for i := len(h.cs) - 1; i > k; i-- {
-		h.cs[i] = h.cs[i-1]
+	copy(h.cs[k+1:], h.cs[k:])
+	h.cs[k] = centroid{value, weight}
+	h.addCount(weight)
+	h.fit()
+	h.notify()
+}
+
+// Below this many centroids, or this many values in a batch, a linear scan
+// per Add is cheaper than the heap-based compression AddBatch uses. Run
+// BenchmarkAddBatchCrossover to see where the two cross.
+const (
+	batchMinCapacity = 256
+	batchMinValues   = 64
+)
+
+// Add all of the given values to the Histogram. This has the same effect on
+// Count, Min and Max as calling Add on each value, but for large sketches the
+// values are sorted and merged in with the existing centroids a chunk at a
+// time, compressing once per chunk instead of once per value. The centroids
+// that result may differ slightly from those that calling Add on each value
+// would produce. Batching only pays off for large sketches and batches of
+// more than a few dozen values: sketches with fewer than 256 centroids and
+// batches of fewer than 64 values just call Add on each value, since that's
+// already faster, as do sketches created with WithDecay, so that each value
+// is decayed in turn. values is not modified.
+func (h *Sketch) AddBatch(values []float64) {
+	if len(values) == 0 {
+		return
 	}
-	h.cs[k] = centroid{value, float64(count)}
-	h.count += float64(count)
-	if len(h.cs) < cap(h.cs) {
-		// No need to merge any centroids, we're not at capacity yet.
+	n := h.capacity()
+	if n < batchMinCapacity || len(values) < batchMinValues || h.opts.decay != 0 {
+		for _, v := range values {
+			h.Add(v)
+		}
 		return
 	}
+	h.mergeBatch(values)
+}
 
-	// Find the index mi such that |h.cs[mi].p - h.cs[mi+1].p| is minimized.
+// Sorts values and merges them in with the centroids a chunk at a time. See
+// AddBatch.
+func (h *Sketch) mergeBatch(values []float64) {
+	n := h.capacity()
+	sorted := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !h.skip(v, 1) {
+			sorted = append(sorted, h.opts.bound(v))
+			h.sample(sorted[len(sorted)-1], 1)
+		}
+	}
+	if len(sorted) == 0 {
+		return
+	}
+	h.own()
+	sort.Float64s(sorted)
+	// Merging in the whole batch at once would leave compression with a
+	// single heap of k+len(values) centroids. Instead, merge in chunks of
+	// about k values, interleaving evenly-spaced values of the sorted batch
+	// so that each chunk looks like a sample of the whole batch.
+	chunks := (len(sorted) + n - 1) / n
+	batch := make([]centroid, 0, n)
+	for c := 0; c < chunks; c++ {
+		batch = batch[:0]
+		for i := c; i < len(sorted); i += chunks {
+			v := sorted[i]
+			if len(batch) > 0 && batch[len(batch)-1].p == v {
+				batch[len(batch)-1].m += 1
+			} else {
+				batch = append(batch, centroid{v, 1})
+			}
+		}
+		cs := compress(mergeCentroids(h.cs, batch), h.capacity(), h.opts.merge)
+		h.cs = append(h.cs[:0], cs...)
+	}
+	h.addCount(float64(len(sorted)))
+	if sorted[0] < h.min {
+		h.min = sorted[0]
+	}
+	if sorted[len(sorted)-1] > h.max {
+		h.max = sorted[len(sorted)-1]
+	}
+	h.notify()
+}
+
+// Multiply the weight of every centroid, and so Count, by factor, which must
+// be in (0.0, 1.0]. Calling Decay periodically makes the weight of old values
+// decay exponentially relative to the weight of new ones, so that quantiles
+// reflect mostly recent data. Decay doesn't remove any centroids, so Min and
+// Max are unchanged and still reflect values represented in the sketch. After
+// heavy decay, centroids can be left with tiny weights that contribute almost
+// nothing to estimates; those centroids are good candidates for pruning.
+// Panics if factor is outside of (0.0, 1.0].
+func (h *Sketch) Decay(factor float64) {
+	if !(factor > 0 && factor <= 1) {
+		panic(fmt.Sprintf("bad argument, decay factor must be in (0.0, 1.0], got %v", factor))
+	}
+	h.Scale(factor)
+}
+
+// Add a single value observed at time t. If h was created with WithHalfLife,
+// the weight of every value already in h is first decayed by half for every
+// half-life between t and the latest timestamp h has seen, so the sketch
+// tracks an exponentially weighted moving distribution. Timestamps that go
+// backwards, as can happen with values from several sources, are treated as
+// if no time had passed: nothing decays, and the value is added at full weight.
+// The first timestamp starts the clock without decaying anything. Without
+// WithHalfLife, this is just Add. Timestamps aren't serialized, so a decoded
+// Sketch starts the clock over.
+func (h *Sketch) AddTimestamped(value float64, t time.Time) {
+	h.AddWeightedTimestamped(value, 1.0, t)
+}
+
+// Add a value with the given weight observed at time t, for example a count
+// of values rolled up over the minute starting at t. Existing values decay
+// first exactly as in AddTimestamped, and then the value is added at its full
+// weight as in AddWeighted. Time still passes for a weight of 0: values
+// already in h decay, even though nothing is added. Panics before anything
+// decays if the weight is negative, infinite or NaN.
+func (h *Sketch) AddWeightedTimestamped(value, weight float64, t time.Time) {
+	if !(weight >= 0) || math.IsInf(weight, 0) {
+		panic(fmt.Sprintf("bad argument, weight must be non-negative and finite, got %v", weight))
+	}
+	h.decayTo(t)
+	h.AddWeighted(value, weight)
+}
+
+// Decays h for the time elapsed between its latest timestamp and t, if h has
+// a half-life, and moves its latest timestamp up to t.
+func (h *Sketch) decayTo(t time.Time) {
+	if h.opts.halfLife == 0 {
+		return
+	}
+	if !h.last.IsZero() && t.After(h.last) {
+		f := math.Exp2(-float64(t.Sub(h.last)) / float64(h.opts.halfLife))
+		dropped := h.dropped
+		// f underflows to 0 after about a thousand half-lives, and Scale(0)
+		// resets h, but the dropped weight and timestamp are still worth
+		// keeping.
+		h.Scale(f)
+		h.dropped = dropped
+	}
+	if h.last.IsZero() || t.After(h.last) {
+		h.last = t
+	}
+}
+
+// Multiply the weight of every centroid, and so Count, by k, which must be
+// non-negative and finite. Since all weights are scaled by the same amount,
+// quantiles and CDF estimates are unchanged. Together with Merge, this can be
+// used to build weighted mixtures of sketches: scaling A by 0.7 and B by 0.3
+// and then merging them gives a sketch of 0.7*A + 0.3*B. Scale(0) removes all
+// values from h, just like Reset.
+func (h *Sketch) Scale(k float64) {
+	if !(k >= 0) || math.IsInf(k, 0) {
+		panic(fmt.Sprintf("bad argument, scale factor must be non-negative and finite, got %v", k))
+	}
+	if k == 0 {
+		h.Reset()
+		return
+	}
+	h.own()
+	for i := range h.cs {
+		h.cs[i].m *= k
+	}
+	h.count *= k
+	h.comp *= k
+	if h.probe != nil {
+		h.probe.total *= k
+	}
+}
+
+// Removes every centroid with weight less than minWeight, which keeps
+// centroids whose weight has decayed to almost nothing from taking up space
+// that newer values could use. The weight of the removed centroids is simply
+// dropped, not moved to their neighbors, so Count goes down by that much. If
+// the lowest centroids are removed, Min becomes the value of the new lowest
+// centroid if it's exact, or otherwise the value of the removed centroid just
+// below it, since a merged centroid may stand for values below its own value.
+// Max is updated the same way. If every centroid is removed, h is left empty.
+// Panics if minWeight is negative or NaN.
+func (h *Sketch) Prune(minWeight float64) {
+	if !(minWeight >= 0) {
+		panic(fmt.Sprintf("bad argument, minimum weight must be non-negative, got %v", minWeight))
+	}
+	h.own()
+	lo, hi := -1, -1
+	for i, c := range h.cs {
+		if math.Abs(c.m) >= minWeight {
+			if lo < 0 {
+				lo = i
+			}
+			hi = i
+		}
+	}
+	if lo < 0 {
+		h.cs, h.count, h.comp = h.cs[:0], 0.0, 0.0
+		h.min, h.max = math.MaxFloat64, -math.MaxFloat64
+		h.shrinkProbe()
+		return
+	}
+	if lo > 0 {
+		h.min = h.cs[lo].p
+		if h.cs[lo].m < 0 {
+			h.min = h.cs[lo-1].p
+		}
+	}
+	if hi < len(h.cs)-1 {
+		h.max = h.cs[hi].p
+		if h.cs[hi].m < 0 {
+			h.max = h.cs[hi+1].p
+		}
+	}
+	kept := h.cs[:0]
+	for _, c := range h.cs {
+		if math.Abs(c.m) >= minWeight {
+			kept = append(kept, c)
+		} else {
+			h.addCount(-math.Abs(c.m))
+		}
+	}
+	h.cs = kept
+	h.shrinkProbe()
+}
+
+// Merges the two adjacent centroids in cs whose values are closest together,
+// as measured by metric, returning the resulting slice, which is one centroid
+// shorter.
+func mergeClosest(cs []centroid, metric MergeMetric) []centroid {
+	// Find the index mi such that the gap between cs[mi] and cs[mi+1] is
+	// minimized.
 	mi := 0
 	md := math.MaxFloat64
-	for i := 0; i < len(h.cs)-1; i++ {
-		d := h.cs[i+1].p - h.cs[i].p
+	for i := 0; i < len(cs)-1; i++ {
+		d := metric.gap(cs[i].p, cs[i+1].p)
 		if d < md {
 			mi, md = i, d
 		}
 	}
 
-	// Merge h.cs[mi] and h.cs[mi+1], move every centroid after h.cs[mi+1]
+	// Merge cs[mi] and cs[mi+1], move every centroid after cs[mi+1]
 	// down one slot in the array to fill the freed space.
-	h.cs[mi].Merge(h.cs[mi+1])
-	for i := mi + 1; i < len(h.cs)-1; i++ {
-		h.cs[i] = h.cs[i+1]
+	cs[mi].Merge(cs[mi+1])
+	copy(cs[mi+1:], cs[mi+2:])
+	return cs[:len(cs)-1]
+}
+
+// Repeatedly merges the two adjacent centroids in cs whose values are closest
+// together, as measured by metric, until at most n centroids remain. This
+// gives the same result as calling mergeClosest until len(cs) <= n, but keeps
+// the gaps between adjacent centroids in a heap, so it takes time on the order
+// of len(cs)*log(len(cs)) instead of len(cs)*(len(cs)-n). cs is modified in
+// place and the compressed centroids are returned in a prefix of it.
+func compress(cs []centroid, n int, metric MergeMetric) []centroid {
+	if len(cs) <= n {
+		return cs
+	}
+	// cs is treated as a doubly-linked list so that merged centroids can be
+	// unlinked in constant time. version[i] changes whenever cs[i] is merged,
+	// which invalidates any gaps involving i that are still in the heap.
+	sc := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(sc)
+	if cap(sc.links) < 3*len(cs) {
+		sc.links = make([]int, 3*len(cs))
+	}
+	links := sc.links[:3*len(cs)]
+	prev, next, version := links[:len(cs)], links[len(cs):2*len(cs)], links[2*len(cs):]
+	for i := range version {
+		version[i] = 0
+	}
+	gh := sc.gaps[:0]
+	defer func() { sc.gaps = gh[:0] }()
+	for i := range cs {
+		prev[i], next[i] = i-1, i+1
+		if i+1 < len(cs) {
+			gh = append(gh, gap{metric.gap(cs[i].p, cs[i+1].p), i, i + 1, 0, 0})
+		}
+	}
+	gh.init()
+	for remaining := len(cs); remaining > n; {
+		g := gh.pop()
+		if next[g.i] != g.j || version[g.i] != g.vi || version[g.j] != g.vj {
+			// Stale gap, one of the endpoints has been merged since.
+			continue
+		}
+		remaining--
+		cs[g.i].Merge(cs[g.j])
+		version[g.i]++
+		version[g.j] = -1
+		next[g.i] = next[g.j]
+		if next[g.i] < len(cs) {
+			prev[next[g.i]] = g.i
+			k := next[g.i]
+			gh.push(gap{metric.gap(cs[g.i].p, cs[k].p), g.i, k, version[g.i], version[k]})
+		}
+		if k := prev[g.i]; k >= 0 {
+			gh.push(gap{metric.gap(cs[k].p, cs[g.i].p), k, g.i, version[k], version[g.i]})
+		}
+	}
+	j := 0
+	for i := 0; i < len(cs); i = next[i] {
+		cs[j] = cs[i]
+		j++
+	}
+	return cs[:j]
+}
+
+// Scratch space for compress and MergeInto, kept in scratchPool so that
+// repeated merges don't allocate it over and over.
+type scratch struct {
+	cs    []centroid
+	links []int
+	gaps  gapHeap
+}
+
+var scratchPool = sync.Pool{New: func() any { return new(scratch) }}
+
+// The distance d between adjacent centroids i and j, along with the versions
+// of i and j at the time the distance was computed.
+type gap struct {
+	d      float64
+	i, j   int
+	vi, vj int
+}
+
+// A min-heap of gaps, breaking ties in favor of the leftmost gap to match the
+// behavior of mergeClosest. This is just container/heap specialized to gaps,
+// which avoids boxing each gap in an interface on every push and pop.
+type gapHeap []gap
+
+func (g gapHeap) less(a, b int) bool {
+	return g[a].d < g[b].d || (g[a].d == g[b].d && g[a].i < g[b].i)
+}
+
+func (g gapHeap) init() {
+	for i := len(g)/2 - 1; i >= 0; i-- {
+		g.down(i)
+	}
+}
+
+func (g *gapHeap) push(x gap) {
+	*g = append(*g, x)
+	h := *g
+	for i := len(h) - 1; i > 0; {
+		p := (i - 1) / 2
+		if !h.less(i, p) {
+			break
+		}
+		h[i], h[p] = h[p], h[i]
+		i = p
+	}
+}
+
+func (g *gapHeap) pop() gap {
+	h := *g
+	x := h[0]
+	h[0] = h[len(h)-1]
+	*g = h[:len(h)-1]
+	g.down(0)
+	return x
+}
+
+func (g gapHeap) down(i int) {
+	for {
+		c := 2*i + 1
+		if c >= len(g) {
+			return
+		}
+		if c+1 < len(g) && g.less(c+1, c) {
+			c++
+		}
+		if !g.less(c, i) {
+			return
+		}
+		g[i], g[c] = g[c], g[i]
+		i = c
 	}
-	h.cs = h.cs[:len(h.cs)-1]
 }
 
-// Merges two Sketches together.
-func (h *Sketch) Merge(x Sketch) {
+// Maximum number of centroids the Sketch will keep.
+func (h Sketch) capacity() int {
+	return cap(h.cs) - 1 - h.opts.extra
+}
+
+// Returns h's centroids compressed down to its maximum number of centroids.
+// These are just h.cs unless WithBufferFactor or WithExactBelow lets h hold
+// more, in which case a compressed copy with the same capacity is returned and
+// h is unchanged.
+func (h Sketch) compressed() []centroid {
+	if len(h.cs) <= h.capacity() {
+		return h.cs
+	}
+	cs := make([]centroid, len(h.cs), cap(h.cs))
+	copy(cs, h.cs)
+	return compress(cs, h.capacity(), h.opts.merge)
+}
+
+// Returns the centroids that estimates should be made from: h's centroids if
+// they're all exact because of WithExactBelow, or otherwise compressed().
+func (h Sketch) compacted() []centroid {
+	if h.exact() {
+		return h.cs
+	}
+	return h.compressed()
+}
+
+// Reports whether h can hold as many centroids as WithExactBelow allows,
+// because it hasn't been given too many values yet.
+func (h Sketch) exact() bool {
+	n := h.opts.exactBelow
+	return n > 0 && h.count <= float64(n) && len(h.cs) <= n
+}
+
+// Returns the most centroids h can hold before it has to compress them.
+func (h Sketch) limit() int {
+	if h.exact() {
+		return h.opts.exactBelow
+	} else if h.opts.buffer > 1 {
+		return h.opts.slots(h.capacity())
+	}
+	return h.capacity()
+}
+
+// Compresses h's centroids down to its maximum number of centroids if it's
+// holding more than it can.
+func (h *Sketch) fit() {
+	if len(h.cs) <= h.limit() {
+		return
+	}
+	if h.opts.extra > 0 {
+		// More than one centroid too many: a full buffer, or values that
+		// were kept exactly until now.
+		h.cs = compress(h.cs, h.capacity(), h.opts.merge)
+		return
+	}
+	h.cs = mergeClosest(h.cs, h.opts.merge)
+}
+
+// Changes the maximum number of centroids h keeps to n, in place. Growing
+// only raises the limit, leaving the centroids as they are: detail that was
+// lost when centroids were merged can't be recovered, so a grown sketch only
+// gets more accurate as new values are added. Shrinking compresses the
+// centroids down to n right away, which loses detail just as if h had been
+// created with n centroids, though not necessarily with the same centroids.
+// Count, Min and Max are unchanged either way. Panics if n is 0 or more than
+// 2^24.
+func (h *Sketch) Resize(n uint) {
+	if n == 0 {
+		panic("bad argument, number of centroids must be at least 1")
+	} else if n > maxCentroids {
+		panic(fmt.Sprintf("bad argument, number of centroids must be at most %v, got %v", maxCentroids, n))
+	}
+	cs := h.cs
+	h.cs, h.shared = h.allocate(int(n)), false
+	if len(cs) > h.opts.slots(int(n)) {
+		cs = compress(append([]centroid{}, cs...), int(n), h.opts.merge)
+	}
+	h.cs = append(h.cs, cs...)
+	h.fit()
+}
+
+// Merges the Sketch x into h. All of x's centroids are added to h as weighted
+// points and the result is compressed down to h's maximum number of centroids.
+// x is unchanged. x may have any maximum number of centroids, but merging a
+// coarser x can't add resolution: each of x's centroids keeps all of its
+// weight at a single point, so estimates near it are no better than x's own,
+// and can be worse than h's where x's heavy centroids sit among h's lighter
+// ones. The returned error is always nil, and is there so that Sketch
+// satisfies Histogram.
+func (h *Sketch) Merge(x *Sketch) error {
+	cs := compress(mergeCentroids(h.cs, x.cs), h.capacity(), h.opts.merge)
+	h.own()
+	h.cs = append(h.cs[:0], cs...)
+	h.addCount(x.count)
+	h.addCount(x.comp)
+	h.dropped += x.dropped
+	if x.min < h.min {
+		h.min = x.min
+	}
+	if x.max > h.max {
+		h.max = x.max
+	}
+	return nil
+}
+
+// Adds all of x's values to h with their weights multiplied by weight, which
+// must be non-negative and finite, and compresses the result down to h's
+// maximum number of centroids. Count goes up by weight * x.Count(). This is
+// the same as merging a copy of x scaled by weight, without making the copy,
+// so folding a new batch into a long-lived sketch with a learning rate r is
+// h.Scale(1-r) followed by h.AddSketch(batch, r). As with Merge, x may have
+// any maximum number of centroids. x is unchanged, and adding an empty x or
+// using a weight of 0 leaves h unchanged.
+func (h *Sketch) AddSketch(x *Sketch, weight float64) {
+	if !(weight >= 0) || math.IsInf(weight, 0) {
+		panic(fmt.Sprintf("bad argument, weight must be non-negative and finite, got %v", weight))
+	}
+	if weight == 0 || len(x.cs) == 0 {
+		return
+	}
+	scaled := make([]centroid, len(x.cs))
+	for i, c := range x.cs {
+		scaled[i] = centroid{c.p, c.m * weight}
+	}
+	cs := compress(mergeCentroids(h.cs, scaled), h.capacity(), h.opts.merge)
+	h.own()
+	h.cs = append(h.cs[:0], cs...)
+	h.addCount(weight * x.count)
+	h.addCount(weight * x.comp)
+	h.dropped += weight * x.dropped
+	if x.min < h.min {
+		h.min = x.min
+	}
+	if x.max > h.max {
+		h.max = x.max
+	}
+}
+
+// Removes x's values from h, undoing an earlier Merge of x into h, for example
+// to drop the oldest window from a sum of sliding windows. This is only
+// approximate: once values have been merged into centroids, h doesn't know
+// exactly where x's values went, so each of x's centroids is taken out of the
+// centroids of h on either side of it, split between them by distance, and
+// any weight one side doesn't have is taken from the other. Centroids left
+// with no weight are removed and Min and Max are updated like Prune does, but
+// the shapes of the remaining centroids aren't, so estimates near where x's
+// values were can be off by more than the usual error, especially after
+// subtracting most of h's weight. Subtracting x from a sketch where all of x's
+// values are still exact removes them exactly. No centroid's weight ever goes
+// below zero: if h doesn't have enough weight around one of x's centroids,
+// the rest of it is ignored, all of the weight that could be removed still is,
+// and an error says how much was ignored. As with Merge, x may have any
+// maximum number of centroids.
+func (h *Sketch) Subtract(x *Sketch) error {
+	h.own()
+	before := make([]float64, len(h.cs))
+	for i, c := range h.cs {
+		before[i] = math.Abs(c.m)
+	}
+	// Takes up to w from centroid i, returning the weight it didn't have.
+	take := func(i int, w float64) float64 {
+		if i < 0 || i >= len(h.cs) {
+			return w
+		}
+		t := math.Min(w, math.Abs(h.cs[i].m))
+		h.cs[i].m -= math.Copysign(t, h.cs[i].m)
+		h.addCount(-t)
+		return w - t
+	}
+	// Takes w from centroids i < j, preferring the one closer to p.
+	split := func(i, j int, p, w float64) float64 {
+		if i < 0 || j >= len(h.cs) {
+			return take(j, take(i, w))
+		}
+		wi := w * (1 - unlerp(h.cs[i].p, h.cs[j].p, p))
+		r := take(i, wi)
+		r = take(j, w-wi+r)
+		return take(i, r)
+	}
+	missing := 0.0
 	for _, c := range x.cs {
-		h.AddMany(c.p, int64(math.Abs(c.m)))
+		w := math.Abs(c.m)
+		k := h.search(c.p)
+		if k < len(h.cs) && h.cs[k].p == c.p {
+			missing += split(k-1, k+1, c.p, take(k, w))
+		} else {
+			missing += split(k-1, k, c.p, w)
+		}
+	}
+	// Rounding can leave a sliver of a centroid that should be empty.
+	for i, c := range h.cs {
+		if w := math.Abs(c.m); w <= validateTolerance*before[i] {
+			h.cs[i].m = 0
+			h.addCount(-w)
+		}
+	}
+	if h.count < 0 {
+		h.count, h.comp = 0, 0
+	}
+	h.dropped = math.Max(h.dropped-x.dropped, 0)
+	h.Prune(math.SmallestNonzeroFloat64)
+	if missing > validateTolerance*x.count {
+		return errors.New(fmt.Sprintf("Sketch only had %v of the weight %v being subtracted, the rest was ignored",
+			x.count-missing, x.count))
+	}
+	return nil
+}
+
+// Merges all of the given Sketches into a new Sketch with a maximum of
+// centroids centroids. The centroids of all of the inputs are pooled and then
+// compressed once instead of once per input, as would happen when merging the
+// inputs one at a time. The inputs may have any maximum numbers of centroids,
+// but as with Merge, inputs coarser than the result don't get any finer by
+// being merged. Returns an error if centroids is 0 or more than 2^24, or if
+// any of the inputs is nil.
+func MergeMany(sketches []*Sketch, centroids uint) (*Sketch, error) {
+	if centroids == 0 {
+		return nil, errors.New("Number of centroids must be at least 1.")
+	} else if centroids > maxCentroids {
+		return nil, errors.New(fmt.Sprintf("Bad number of centroids %v", centroids))
+	}
+	h := New(centroids)
+	if len(sketches) == 0 {
+		return h, nil
+	}
+	var cs []centroid
+	for i, x := range sketches {
+		if x == nil {
+			return nil, errors.New(fmt.Sprintf("Sketch %v is nil", i))
+		}
+		cs = mergeCentroids(cs, x.cs)
+		h.addCount(x.count)
+		h.addCount(x.comp)
+		h.dropped += x.dropped
+		if x.min < h.min {
+			h.min = x.min
+		}
+		if x.max > h.max {
+			h.max = x.max
+		}
+	}
+	h.cs = append(h.cs, compress(cs, h.capacity(), h.opts.merge)...)
+	return h, nil
+}
+
+// Replaces the contents of dst with the result of merging a and b, as if dst
+// had been Reset and then had a and b merged into it, but without the
+// intermediate copy. dst keeps its options and reuses its own storage for the
+// merged centroids, and the scratch space for compressing them is pooled, so
+// an aggregation loop that reuses one dst doesn't allocate once it's warmed
+// up, unlike Clone followed by Merge. dst may be the same sketch as a or
+// b. As with Merge, a and b may have any maximum number of centroids and are
+// compressed down to dst's, and the returned error is always nil.
+func MergeInto(dst, a, b *Sketch) error {
+	sc := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(sc)
+	sc.cs = compress(appendMerged(sc.cs[:0], a.cs, b.cs), dst.capacity(), dst.opts.merge)
+	counts := [...]float64{a.count, a.comp, b.count, b.comp}
+	dropped := a.dropped + b.dropped
+	min, max := math.Min(a.min, b.min), math.Max(a.max, b.max)
+	dst.Reset()
+	dst.cs = append(dst.cs, sc.cs...)
+	for _, c := range counts {
+		dst.addCount(c)
+	}
+	dst.dropped, dst.min, dst.max = dropped, min, max
+	return nil
+}
+
+// Merges two sorted lists of centroids into a single sorted list. Centroids
+// with the same value are combined, and the result is only marked as exact if
+// both of the combined centroids were exact.
+func mergeCentroids(a, b []centroid) []centroid {
+	return appendMerged(make([]centroid, 0, len(a)+len(b)), a, b)
+}
+
+// Appends the result of mergeCentroids(a, b) to cs.
+func appendMerged(cs, a, b []centroid) []centroid {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if j == len(b) || (i < len(a) && a[i].p < b[j].p) {
+			cs = append(cs, a[i])
+			i++
+		} else if i == len(a) || b[j].p < a[i].p {
+			cs = append(cs, b[j])
+			j++
+		} else {
+			m := math.Abs(a[i].m) + math.Abs(b[j].m)
+			if a[i].m < 0 || b[j].m < 0 {
+				m = -m
+			}
+			cs = append(cs, centroid{a[i].p, m})
+			i++
+			j++
+		}
 	}
+	return cs
 }
 
 // Gets the (i-1)-st and ith centroids. If i is 0, fake out the (i-1)-st with
@@ -155,8 +1239,15 @@ func (h Sketch) getcentroids(i int) (x, y centroid) {
 	return
 }
 
-// Returns an estimate of the number of values <= p in the histogram.
+// Returns an estimate of the number of values <= p in the histogram, or NaN if
+// no values have been added. Sum is non-decreasing in p, 0 for p < Min() and
+// exactly Count() for p >= Max(). Sum(Min()) is 0 unless some values are
+// known to be exactly Min(), in which case it's the number of them.
 func (h Sketch) Sum(p float64) float64 {
+	h.cs = h.compacted()
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
 	if p >= h.max {
 		return h.count
 	} else if p < h.min {
@@ -168,30 +1259,497 @@ func (h Sketch) Sum(p float64) float64 {
 		s += math.Abs(h.cs[i].m)
 	}
 	ci, cj := h.getcentroids(k)
-	if ci.m > 0 && (cj.m > 0 || ci.p == p) {
-		return s + ci.m
+	return math.Min(math.Max(interpolateSum(ci, cj, s, p), 0.0), h.count)
+}
+
+// Returns an estimate of the sum of the values <= x in the histogram, the
+// first-moment analog of Sum: where Sum counts the values up to x, PartialSum
+// adds them up. This is the building block for partial and conditional
+// expectations. For example, the mean of the values up to x is
+// PartialSum(x) / Sum(x), and the expected value of min(v, x) is
+// (PartialSum(x) + x * (Count() - Sum(x))) / Count(). As in TrimmedMean, each
+// centroid is treated as a point mass at its value: the lowest Sum(x) of the
+// weight is added up at the values of the centroids it belongs to, or at x for
+// a centroid whose value is above x. PartialSum(Max()) is Mean() * Count(),
+// up to floating point error. Returns NaN if no values have been added.
+func (h Sketch) PartialSum(x float64) float64 {
+	h.cs = h.compacted()
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	n := h.Sum(x)
+	s := 0.0
+	for _, c := range h.cs {
+		if n <= 0 {
+			break
+		}
+		w := math.Min(math.Abs(c.m), n)
+		s += w * math.Min(c.p, x)
+		n -= w
+	}
+	return s
+}
+
+// Returns an estimate of the number of values v in the histogram with
+// a <= v < b, or 0 if a >= b. CountBetween(Min(), Max()) is Count() less any
+// values known to be exactly Max(). Returns NaN if no values have been added.
+func (h Sketch) CountBetween(a, b float64) float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	if a >= b {
+		return 0.0
+	}
+	return math.Max(h.sumBelow(b)-h.sumBelow(a), 0.0)
+}
+
+// Returns an estimate of the number of values < p in the histogram. This is
+// the same as Sum(p) unless there's an exact centroid at p, in which case its
+// weight isn't included.
+func (h Sketch) sumBelow(p float64) float64 {
+	h.cs = h.compacted()
+	if p > h.max {
+		return h.count
+	} else if p <= h.min {
+		return 0.0
+	}
+	s := h.Sum(p)
+	k := sort.Search(len(h.cs), func(i int) bool { return h.cs[i].p >= p })
+	if k < len(h.cs) && h.cs[k].p == p && h.cs[k].m > 0 {
+		s -= h.cs[k].m
+	}
+	return s
+}
+
+// Returns an estimate of the fraction of values <= x in the histogram, in
+// [0.0, 1.0], or NaN if no values have been added. This is Sum(x)/Count(), so
+// it's 0.0 for x below Min() and 1.0 for x at or above Max().
+func (h Sketch) CDF(x float64) float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	return math.Min(math.Max(h.Sum(x)/h.count, 0.0), 1.0)
+}
+
+// Returns an estimate of the fractional rank of x in the histogram: the
+// fraction of values that are <= x. This is the same as CDF(x) and, up to
+// interpolation error, the inverse of Quantile.
+func (h Sketch) Rank(x float64) float64 {
+	return h.CDF(x)
+}
+
+// Returns CDF(x) for each x in xs, in the same order as xs. The estimates are
+// computed with a single walk over the centroids, so this is cheaper than
+// calling CDF once for each value in xs.
+func (h Sketch) CDFs(xs []float64) []float64 {
+	h.cs = h.compacted()
+	result := make([]float64, len(xs))
+	if len(h.cs) == 0 {
+		for j := range result {
+			result[j] = math.NaN()
+		}
+		return result
+	}
+	order := make([]int, len(xs))
+	for j := range order {
+		order[j] = j
+	}
+	sort.Slice(order, func(a, b int) bool { return xs[order[a]] < xs[order[b]] })
+
+	// Same computation as Sum, but the index k of the first centroid > x and
+	// the total weight s of all centroids before k-1 are carried over
+	// between successive (sorted) values of x.
+	k := 0
+	s := 0.0
+	for _, j := range order {
+		x := xs[j]
+		if x >= h.max {
+			result[j] = 1.0
+			continue
+		} else if x < h.min {
+			result[j] = 0.0
+			continue
+		}
+		for ; k < len(h.cs) && h.cs[k].p <= x; k++ {
+			if k > 0 {
+				s += math.Abs(h.cs[k-1].m)
+			}
+		}
+		ci, cj := h.getcentroids(k)
+		result[j] = math.Min(math.Max(interpolateSum(ci, cj, s, x)/h.count, 0.0), 1.0)
+	}
+	return result
+}
+
+// Returns the estimated number of values <= p, where p falls between centroids
+// ci and cj and s is the total weight of all centroids before ci.
+func interpolateSum(ci, cj centroid, s, p float64) float64 {
+	mi, mj := math.Abs(ci.m), math.Abs(cj.m)
+	// All of the values in an exact centroid are at its value, so none of
+	// them are spread over the gap between the centroids: an exact ci counts
+	// in full, and an exact cj not at all, since p < cj.p. Leaving them out
+	// of the trapezoid keeps the sum from dropping just past an exact ci.
+	if ci.m > 0 {
+		s, mi = s+mi, 0.0
+	}
+	if cj.m > 0 {
+		mj = 0.0
+	}
+	if mi == 0.0 && mj == 0.0 {
+		return s
+	}
+	z := unlerp(ci.p, cj.p, p)
+	mb := mi + (mj-mi)*z
+	return s + mi/2.0 + (mi+mb)*z/2.0
+}
+
+// Returns a + (b-a)*z for a <= b and z in [0, 1]. If b-a overflows, as it can
+// for values near opposite ends of the float64 range, the result is computed
+// without it.
+func lerp(a, b, z float64) float64 {
+	if d := b - a; !math.IsInf(d, 0) {
+		return a + d*z
+	}
+	return math.Min(a*(1-z)+b*z, b)
+}
+
+// Returns (x-a)/(b-a) for a <= x <= b, the inverse of lerp, computed without
+// overflowing when b-a does.
+func unlerp(a, b, x float64) float64 {
+	if d := b - a; !math.IsInf(d, 0) {
+		return (x - a) / d
+	}
+	return (x/2 - a/2) / (b/2 - a/2)
+}
+
+// Returns an estimate of the density of values at x, in values per unit.
+// Between two neighboring merged centroids, Sum is interpolated with a
+// trapezoid, and the density is its derivative: the height of the trapezoid
+// at x divided by the gap between the centroids. This is a crude,
+// histogram-style estimate: it's piecewise linear between centroids, values
+// known exactly are spread over the neighboring gaps instead of showing up as
+// spikes (unlike in Sum, which jumps at them), and it's 0 outside of
+// [Min(), Max()]. Integrating it over
+// [Min(), Max()] gives Count(). Returns NaN if no values have been added.
+func (h Sketch) Density(x float64) float64 {
+	h.cs = h.compacted()
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	if x < h.min || x > h.max {
+		return 0.0
+	}
+	k := sort.Search(len(h.cs), func(i int) bool { return h.cs[i].p > x })
+	ci, cj := h.getcentroids(k)
+	if cj.p <= ci.p {
+		return 0.0
 	}
 	mi, mj := math.Abs(ci.m), math.Abs(cj.m)
-	mb := mi + (mj-mi)*(p-ci.p)/(cj.p-ci.p)
-	return s + mi/2.0 + (mi+mb)*(p-ci.p)/2.0/(cj.p-ci.p)
+	return (mi + (mj-mi)*(x-ci.p)/(cj.p-ci.p)) / (cj.p - ci.p)
+}
+
+// Returns a rough estimate of the mode of the histogram: the value of the
+// centroid with the most weight per unit width, where the width of a centroid
+// is half the distance between its neighbors (or Min and Max, for the first
+// and last centroids). Ties are broken in favor of the smallest value. Since
+// it only ever returns a centroid value, the estimate can't be any more
+// precise than the spacing of the centroids around the mode, and a narrow
+// peak can be hidden entirely if it's merged into a wider centroid. Returns
+// NaN if no values have been added.
+func (h Sketch) Mode() float64 {
+	h.cs = h.compacted()
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	best, bd := 0, -1.0
+	for i, c := range h.cs {
+		lo, hi := h.min, h.max
+		if i > 0 {
+			lo = h.cs[i-1].p
+		}
+		if i < len(h.cs)-1 {
+			hi = h.cs[i+1].p
+		}
+		w := (hi - lo) / 2.0
+		if w <= 0 {
+			return c.p
+		}
+		if d := math.Abs(c.m) / w; d > bd {
+			best, bd = i, d
+		}
+	}
+	return h.cs[best].p
+}
+
+// Returns a coarse estimate of the number of distinct values in the
+// histogram: the effective number of centroids, exp(H), where H is the
+// entropy of the distribution of weight over the centroids. It's 1 for a
+// stream of a single repeated value, and equals the number of distinct values
+// when there are few enough for each to have its own centroid and they're
+// all equally common. Weight concentrated in a few centroids pulls it down, so
+// a stream that's nearly constant apart from a few stray values also comes out
+// near 1. It can never be more than the number of centroids, so for varied
+// data it only says that there are at least about that many distinct values:
+// a sketch can't tell a million distinct values from a thousand values
+// repeated a thousand times each. Returns NaN if no values have been added.
+func (h Sketch) DistinctEstimate() float64 {
+	h.cs = h.compacted()
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	total := 0.0
+	for _, c := range h.cs {
+		total += math.Abs(c.m)
+	}
+	e := 0.0
+	for _, c := range h.cs {
+		if p := math.Abs(c.m) / total; p > 0 {
+			e -= p * math.Log(p)
+		}
+	}
+	return math.Exp(e)
+}
+
+// Reports whether the histogram looks like it has at least two modes: whether
+// there's a dip in its density between two peaks, with the density at the
+// bottom of the dip at most 1 - threshold times the smaller of the two peaks.
+// For example, IsBimodal(0.5) reports whether the density drops by at least
+// half between two peaks, which flags a latency distribution that has split
+// into fast and slow populations. threshold must be in (0.0, 1.0).
+//
+// The density is estimated at each centroid as in Mode, from its weight and
+// the width of the gap around it, and then smoothed: the density at each
+// centroid is the total weight over the total width of the centroids within
+// len/16 + 1 of it, where len is the number of centroids, so each estimate
+// covers about an eighth of the sketch. Without smoothing, the uneven weights
+// that merging leaves behind, and the sparse centroids in long tails, look
+// like many small peaks. With it, unimodal distributions like the normal,
+// exponential and log-normal have dips of less than 0.15 or so, while an
+// even mixture of two well-separated normals has a dip of 0.5 or more with 32
+// centroids or more. Smaller sketches, and modes holding only a few percent
+// of the values, smooth out more, so a lower threshold may be needed there.
+// Returns false if there are fewer than 3 centroids. Panics if threshold is
+// outside of (0.0, 1.0).
+func (h Sketch) IsBimodal(threshold float64) bool {
+	if !(threshold > 0 && threshold < 1) {
+		panic(fmt.Sprintf("bad argument, threshold must be in (0.0, 1.0), got %v", threshold))
+	}
+	h.cs = h.compacted()
+	n := len(h.cs)
+	if n < 3 {
+		return false
+	}
+	k := n/16 + 1
+	ds := make([]float64, n)
+	for i := range ds {
+		w, m := 0.0, 0.0
+		for j := i - k; j <= i+k; j++ {
+			if j < 0 || j >= n {
+				continue
+			}
+			lo, hi := h.min, h.max
+			if j > 0 {
+				lo = h.cs[j-1].p
+			}
+			if j < n-1 {
+				hi = h.cs[j+1].p
+			}
+			w += (hi - lo) / 2.0
+			m += math.Abs(h.cs[j].m)
+		}
+		ds[i] = m / w
+	}
+	// There's a deep enough dip at i if the highest peaks on either side are
+	// both high enough above it. right[i] is the highest peak at or after i.
+	right := make([]float64, n)
+	right[n-1] = ds[n-1]
+	for i := n - 2; i >= 0; i-- {
+		right[i] = math.Max(ds[i], right[i+1])
+	}
+	left := 0.0
+	for i, d := range ds {
+		left = math.Max(left, d)
+		if d <= (1-threshold)*math.Min(left, right[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Bin is a fixed-width bucket of a histogram: an estimate of the Count of
+// values v with Lo < v <= Hi.
+type Bin struct {
+	Lo    float64
+	Hi    float64
+	Count float64
+}
+
+// Divides [Min(), Max()] into n equal-width bins and estimates the number of
+// values in each from Sum. Unlike centroids, which are placed adaptively, the
+// bins are evenly spaced, which is what classic bar charts expect. The first
+// bin starts exactly at Min() and also includes values equal to Min(), and the
+// last bin ends exactly at Max(), so the bin counts always add up to Count().
+// Returns nil if no values have been added. Panics if n is less than 1.
+func (h Sketch) Bins(n int) []Bin {
+	if n < 1 {
+		panic(fmt.Sprintf("bad argument, number of bins must be at least 1, got %v", n))
+	}
+	if len(h.cs) == 0 {
+		return nil
+	}
+	bins := make([]Bin, n)
+	lo, below := h.min, 0.0
+	for i := range bins {
+		hi := h.min + (h.max-h.min)*float64(i+1)/float64(n)
+		if i == n-1 {
+			hi = h.max
+		}
+		s := h.Sum(hi)
+		bins[i] = Bin{lo, hi, s - below}
+		lo, below = hi, s
+	}
+	return bins
+}
+
+// Create a new Sketch with a maximum of centroids centroids from a fixed-width
+// histogram, like the output of Bins or bucketed counts from another metrics
+// system. Each bin's Count is added as a single weighted value at the
+// midpoint of the bin, so every value is moved by up to half the width of its
+// bin and quantile estimates can be off by as much as half the width of the
+// widest bin, on top of the usual error of the sketch. Bins with an infinite
+// bound, like a Prometheus +Inf bucket, have no midpoint, so their weight is
+// placed at their finite bound instead. A bin with no finite bound at all,
+// like (-Inf, +Inf), says nothing about where its values are, so its Count is
+// added to Dropped rather than to the sketch, just as if its values had been
+// skipped. Min and Max are taken from the outermost finite bounds of the
+// non-empty bins. Panics if any bin has a NaN bound, Lo > Hi or a negative,
+// infinite or NaN Count.
+func FromBins(bins []Bin, centroids uint) *Sketch {
+	h := New(centroids)
+	lo, hi := math.MaxFloat64, -math.MaxFloat64
+	for _, b := range bins {
+		if math.IsNaN(b.Lo) || math.IsNaN(b.Hi) {
+			panic(fmt.Sprintf("bad argument, bin has NaN bound [%v, %v]", b.Lo, b.Hi))
+		} else if b.Lo > b.Hi {
+			panic(fmt.Sprintf("bad argument, bin has Lo %v > Hi %v", b.Lo, b.Hi))
+		} else if !(b.Count >= 0) || math.IsInf(b.Count, 0) {
+			panic(fmt.Sprintf("bad argument, bin count must be non-negative and finite, got %v", b.Count))
+		}
+		if b.Count == 0 {
+			continue
+		}
+		// Halving each bound first keeps the midpoint of a bin as wide as
+		// [-MaxFloat64, MaxFloat64] from overflowing.
+		v := b.Lo/2 + b.Hi/2
+		if math.IsInf(b.Lo, 0) && math.IsInf(b.Hi, 0) {
+			h.dropped += b.Count
+			continue
+		} else if math.IsInf(b.Lo, -1) {
+			v = b.Hi
+		} else if math.IsInf(b.Hi, 1) {
+			v = b.Lo
+		}
+		h.AddWeighted(v, b.Count)
+		if !math.IsInf(b.Lo, 0) && b.Lo < lo {
+			lo = b.Lo
+		}
+		if !math.IsInf(b.Hi, 0) && b.Hi > hi {
+			hi = b.Hi
+		}
+	}
+	h.min = math.Min(h.min, lo)
+	h.max = math.Max(h.max, hi)
+	return h
+}
+
+// Returns a random value drawn from the distribution that h estimates, using
+// rng as the source of randomness, for example to feed a Monte Carlo
+// simulation. The value is Quantile(u) for u uniform in [0.0, 1.0), so
+// samples follow the sketch's piecewise estimate of the quantile function,
+// not the true distribution: values known exactly are drawn exactly, but the
+// values in merged centroids are spread smoothly over the gaps between
+// centroids, so any shape finer than the spacing of the centroids is lost.
+// Returns NaN if no values have been added.
+func (h Sketch) Sample(rng *rand.Rand) float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	return h.Quantile(rng.Float64())
+}
+
+// Returns n random values drawn as in Sample. This is cheaper than calling
+// Sample n times, since all of the values are found with one call to
+// Quantiles.
+func (h Sketch) SampleN(rng *rand.Rand, n int) []float64 {
+	us := make([]float64, n)
+	for i := range us {
+		us[i] = rng.Float64()
+	}
+	return h.Quantiles(us)
 }
 
 // Returns an estimate of the pth quantile of the histogram for 0.0 <= p <= 1.0
 // pth quantile is defined as the smallest data point d such that p*total elements are
-// less than or equal to d.
+// less than or equal to d. Returns NaN if no values have been added. How the
+// estimate is made depends on the Sketch's QuantileMethod, Linear by default.
+// The estimate is always clamped to [Min(), Max()], so it never reports a
+// value past the observed extremes.
 func (h Sketch) Quantile(p float64) float64 {
+	h.cs = h.compacted()
 	if p < 0.0 || p > 1.0 {
 		panic("bad argument, Quantile(x) only defined for real x in [0.0, 1.0]")
 	}
-	if h.count < 1 {
-		panic("Need at least one data point to estimate Quantile")
+	if len(h.cs) == 0 {
+		return math.NaN()
 	}
 	t := p * float64(h.count)
+	if h.opts.quantile == NearestRank {
+		i, _ := h.nearestRank(t, 0, 0.0)
+		return h.rankValue(p, i)
+	}
+
+	i, s := h.quantileIndex(t)
+	ci, cj := h.getcentroids(i)
+	return h.clamp(interpolate(ci, cj, t-s))
+}
+
+// Returns x clamped to [h.min, h.max].
+func (h Sketch) clamp(x float64) float64 {
+	return math.Min(math.Max(x, h.min), h.max)
+}
 
-	// Find the last two consecutive centroids ci, cj such that the sum of
-	// all of the centroid weights up to and including ci plus half of cj's
-	// weight is at most t. This means that the pth quantile is somewhere
-	// between ci and cj.
+// Returns an estimate of the qth quantile of just the values in [lo, hi], for
+// 0.0 <= q <= 1.0, like the median of the latencies under 500ms. The values
+// below lo and between lo and hi are counted as in CountBetween, except that
+// values known to be exactly hi are included in the window, and the
+// estimate is Quantile of the rank q of the way through the window, clamped to
+// [lo, hi]. Where a merged centroid spans lo or hi, the sketch can't tell
+// exactly how many of its values are inside the window, so like CountBetween
+// the count is interpolated, and estimates for q near 0 or 1 are the least
+// accurate, especially for narrow windows with only a few centroids inside.
+// Returns NaN if no values have been added, lo > hi, or no values are
+// estimated to be in [lo, hi].
+func (h Sketch) ConditionalQuantile(q, lo, hi float64) float64 {
+	if q < 0.0 || q > 1.0 {
+		panic("bad argument, ConditionalQuantile(q, lo, hi) only defined for real q in [0.0, 1.0]")
+	}
+	if len(h.cs) == 0 || !(lo <= hi) {
+		return math.NaN()
+	}
+	below := h.sumBelow(lo)
+	w := h.Sum(hi) - below
+	if !(w > 0) {
+		return math.NaN()
+	}
+	p := math.Min(math.Max((below+q*w)/h.count, 0.0), 1.0)
+	return math.Min(math.Max(h.Quantile(p), lo), hi)
+}
+
+// Finds the last two consecutive centroids ci, cj such that the sum of all of
+// the centroid weights up to and including ci plus half of cj's weight is at
+// most t. This means that the quantile with rank t is somewhere between ci and
+// cj. Returns the index of cj, as understood by getcentroids, and that sum.
+func (h Sketch) quantileIndex(t float64) (int, float64) {
 	s := 0.0
 	i := 0
 	pv := 0.0
@@ -203,81 +1761,232 @@ func (h Sketch) Quantile(p float64) float64 {
 		s += v + pv
 		pv = v
 	}
+	return i, s
+}
+
+// Returns Quantile(p) along with a rough bound on how far it might be from
+// the true pth quantile. Values known exactly don't add any uncertainty, but a
+// merged centroid stands for values that may lie anywhere out to its
+// neighboring centroids, so the bound grows with the spread of the centroids
+// around the estimate. If both centroids around the estimate are exact, the
+// bound is 0. This is a heuristic, not a statistical confidence interval: it
+// doesn't hold with any particular probability, and the true quantile may lie
+// outside of it for adversarial data. Returns NaN for both if no values have
+// been added.
+func (h Sketch) QuantileWithError(p float64) (value, errEstimate float64) {
+	h.cs = h.compacted()
+	value = h.Quantile(p)
+	if len(h.cs) == 0 {
+		return value, math.NaN()
+	}
+	i, _ := h.quantileIndex(p * h.count)
 	ci, cj := h.getcentroids(i)
+	if ci.m > 0 && cj.m > 0 {
+		return value, 0.0
+	}
+	lo, hi := ci.p, cj.p
+	if ci.m < 0 {
+		prev, _ := h.getcentroids(i - 1)
+		lo = prev.p
+	}
+	if cj.m < 0 {
+		_, next := h.getcentroids(i + 1)
+		hi = next.p
+	}
+	return value, math.Max(value-lo, hi-value)
+}
 
+// Starting from centroid i, with cum the total weight of the centroids before
+// i, finds the first centroid at which the cumulative weight reaches t. Returns
+// that centroid's index and the total weight of the centroids before it.
+func (h Sketch) nearestRank(t float64, i int, cum float64) (int, float64) {
+	for ; i < len(h.cs)-1; i++ {
+		w := math.Abs(h.cs[i].m)
+		if cum+w >= t {
+			break
+		}
+		cum += w
+	}
+	return i, cum
+}
+
+// Returns the NearestRank estimate of the pth quantile, given the index i of
+// the centroid returned by nearestRank.
+func (h Sketch) rankValue(p float64, i int) float64 {
+	if p == 0.0 {
+		return h.min
+	} else if p == 1.0 {
+		return h.max
+	}
+	return h.clamp(h.cs[i].p)
+}
+
+// Returns estimates of the quantiles qs of the histogram, in the same order as
+// qs, or all NaNs if no values have been added. Unlike Quantile, values in qs
+// outside of [0.0, 1.0] don't panic: they're clamped to 0.0 and 1.0, and NaNs
+// in qs give NaN estimates without affecting the other estimates. The
+// quantiles are computed with a single walk over the centroids, so this is
+// cheaper than calling Quantile once for each value in qs.
+func (h Sketch) Quantiles(qs []float64) []float64 {
+	h.cs = h.compacted()
+	result := make([]float64, len(qs))
+	if len(h.cs) == 0 {
+		for j := range result {
+			result[j] = math.NaN()
+		}
+		return result
+	}
+	order := make([]int, 0, len(qs))
+	sorted := true
+	for j, q := range qs {
+		if math.IsNaN(q) {
+			result[j] = math.NaN()
+			continue
+		}
+		if len(order) > 0 && q < qs[order[len(order)-1]] {
+			sorted = false
+		}
+		order = append(order, j)
+	}
+	// Exporters usually ask for quantiles in increasing order already, and
+	// sort.Slice costs more than the walk itself for a handful of quantiles.
+	if !sorted {
+		sort.Slice(order, func(a, b int) bool { return qs[order[a]] < qs[order[b]] })
+	}
+
+	// Same walk as Quantile, but the state is carried over between
+	// successive (sorted) quantiles instead of starting over each time.
+	s := 0.0
+	i := 0
+	pv := 0.0
+	if h.opts.quantile == NearestRank {
+		cum := 0.0
+		for _, j := range order {
+			q := math.Min(math.Max(qs[j], 0.0), 1.0)
+			i, cum = h.nearestRank(q*h.count, i, cum)
+			result[j] = h.rankValue(q, i)
+		}
+		return result
+	}
+	for _, j := range order {
+		t := math.Min(math.Max(qs[j], 0.0), 1.0) * h.count
+		for ; i < len(h.cs); i++ {
+			v := math.Abs(h.cs[i].m) / 2.0
+			if s+v+pv > t {
+				break
+			}
+			s += v + pv
+			pv = v
+		}
+		ci, cj := h.getcentroids(i)
+		result[j] = h.clamp(interpolate(ci, cj, t-s))
+	}
+	return result
+}
+
+// A Summary holds the statistics of a Histogram that exporters usually report
+// together. See Sketch.Summary.
+type Summary struct {
+	Count, Min, Max, Mean float64
+	// Estimates of the requested quantiles, in the order they were requested.
+	Quantiles []float64
+}
+
+// Returns the count, minimum, maximum, mean and estimates of the quantiles qs
+// of the histogram, or NaNs for everything but the count if no values have
+// been added. The result is the same as calling Count, Min, Max, Mean and
+// Quantiles(qs), but the centroids are compacted only once and all of the
+// quantiles are found in a single walk over them, so it's much cheaper than
+// calling Quantile once for each value in qs. As in Quantiles, values in qs
+// outside of [0.0, 1.0] are clamped, and NaNs give NaN estimates.
+func (h Sketch) Summary(qs []float64) Summary {
+	h.cs = h.compacted()
+	return Summary{
+		Count:     h.count,
+		Min:       h.Min(),
+		Max:       h.Max(),
+		Mean:      h.Mean(),
+		Quantiles: h.Quantiles(qs),
+	}
+}
+
+// Returns the point between centroids ci and cj where the cumulative weight
+// starting from ci reaches d, based on the trapezoid between the two centroids.
+func interpolate(ci, cj centroid, d float64) float64 {
 	// If the two centroids are exact, return the smaller centroid value.
 	if ci.m > 0 && cj.m > 0 {
 		return cj.p
 	}
 
-	// Otherwise, solve for u such that t-s = (ci.m + mu)/2 * (u-ci.p)/(cj.p - ci.p),
-	// where mu = ci.m + (u-ci.p)*(cj.m - ci.m)/(cj.p - ci.p). You can solve for such
-	// a u using the quadratic equation so long as ci.m != cj.m, in which case the
-	// solution is a little bit simpler. See Algorithm 4 and its description in the
-	// original paper.
-	d := t - s
+	// Otherwise, solve for u such that d = (ci.m + mu)/2 * (u-ci.p)/(cj.p - ci.p),
+	// where mu = ci.m + (u-ci.p)*(cj.m - ci.m)/(cj.p - ci.p). See Algorithm 4 and
+	// its description in the original paper. Writing z = (u-ci.p)/(cj.p - ci.p),
+	// this is the quadratic a*z^2 + 2*ci.m*z - 2*d = 0 with a = cj.m - ci.m. We use
+	// the form of the root that avoids cancellation, z = 2d/(ci.m + sqrt(ci.m^2 +
+	// 2ad)), which also covers a == 0. Every operation in it is monotonic in d, so
+	// the result never decreases as d increases, and clamping z to [0, 1] (and the
+	// discriminant to 0) keeps rounding error from pushing u outside of [ci.p, cj.p]
+	// and out of order with the neighboring segments.
 	cim := math.Abs(ci.m)
 	cjm := math.Abs(cj.m)
 	a := cjm - cim
-	if a == 0 {
-		return ci.p + (cj.p-ci.p)*(d/cim)
-	}
-	b := 2.0 * cim
-	c := -2.0 * d
-	z := (-b + math.Sqrt(b*b-4*a*c)) / (2 * a)
-	return ci.p + (cj.p-ci.p)*z
-}
-
-// Serialization for use with gob/encoding. See tests for an example.
-func (h Sketch) MarshalBinary() ([]byte, error) {
-	var b bytes.Buffer
-	// Version number, hardcoded to 1 for now.
-	fmt.Fprintln(&b, 1)
-	// Number of centroids.
-	fmt.Fprintln(&b, len(h.cs))
-	// centroids (value + count for each).
-	for _, c := range h.cs {
-		fmt.Fprintln(&b, c.p, c.m)
-	}
-	// Min and max observed values.
-	fmt.Fprintln(&b, h.min, h.max)
-	return b.Bytes(), nil
-}
-
-// Deserialization for use with gob/encoding. See tests for an example.
-func (h *Sketch) UnmarshalBinary(data []byte) error {
-	b := bytes.NewBuffer(data)
-	var num, version int
-	// Read and verify the version number.
-	_, err := fmt.Fscanln(b, &version)
-	if err != nil {
-		return err
-	} else if version != 1 {
-		return errors.New(fmt.Sprintf("Unknown serialization version '%v'", version))
-	}
-	// Read the number of centroids.
-	_, err = fmt.Fscanln(b, &num)
-	if err != nil {
-		return err
-	}
-	h.cs = make([]centroid, 0, num+1)
-	// Read all centroids.
-	h.count = 0.0
-	for i := 0; i < num; i++ {
-		c := centroid{0.0, 0.0}
-		_, err := fmt.Fscanln(b, &c.p, &c.m)
-		if err != nil {
-			return err
-		}
-		h.cs = append(h.cs, c)
-		h.count += c.m
-	}
-	// Read min and max.
-	_, err = fmt.Fscanln(b, &h.min, &h.max)
-	if err != nil {
-		return err
+	if d <= 0 {
+		return ci.p
 	}
-	return nil
+	den := cim + math.Sqrt(math.Max(cim*cim+2*a*d, 0))
+	if den == 0 {
+		return ci.p
+	}
+	z := math.Min(2*d/den, 1)
+	return lerp(ci.p, cj.p, z)
+}
+
+// Returns an estimate of the median of the histogram, or NaN if no values have
+// been added. Equivalent to Quantile(0.5) otherwise.
+func (h Sketch) Median() float64 {
+	if len(h.cs) == 0 {
+		return math.NaN()
+	}
+	return h.Quantile(0.5)
+}
+
+// Returns an estimate of the pth percentile of the histogram, for p in
+// [0.0, 100.0]: Percentile(95) is Quantile(0.95). Unlike Quantile, values of p
+// outside of [0.0, 100.0] don't panic: they're clamped to 0.0 and 100.0.
+// Returns NaN if p is NaN or no values have been added.
+func (h Sketch) Percentile(p float64) float64 {
+	if len(h.cs) == 0 || math.IsNaN(p) {
+		return math.NaN()
+	}
+	return h.Quantile(math.Min(math.Max(p, 0.0), 100.0) / 100.0)
+}
+
+// Returns the optimal decomposition of sample into at most centroids centroids,
+// sorted by value: the same centroids that NewFromSample starts a Sketch with,
+// for summarizing a batch of data in one shot without building a Sketch. A
+// centroid's weight is the number of values in sample closest to it. Like
+// NewFromSample, this takes time on the order of len(sample)^2 * centroids and
+// space on the order of len(sample) * centroids, so it's only practical for
+// samples of up to a few thousand values; for anything bigger, adding the
+// values to a Sketch is far faster, if less accurate. Unlike NewFromSample,
+// sample isn't modified. Returns an empty slice if sample is empty. Panics if
+// centroids is less than 1 or sample contains NaN or infinite values.
+func OptimalDecomposition(sample []float64, centroids int) []Centroid {
+	if centroids < 1 {
+		panic(fmt.Sprintf("bad argument, number of centroids must be at least 1, got %v", centroids))
+	}
+	for _, x := range sample {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			panic(fmt.Sprintf("bad argument, sample contains non-finite value %v", x))
+		}
+	}
+	if len(sample) == 0 {
+		return []Centroid{}
+	}
+	sorted := make([]float64, len(sample))
+	copy(sorted, sample)
+	h, _ := NewFromSample(sorted, centroids)
+	return h.Centroids()
 }
 
 // Use dynamic programming to figure out the optimal decomposition of the given
@@ -292,28 +2001,35 @@ func (h *Sketch) UnmarshalBinary(data []byte) error {
 // Where D[i,m] is the optimal decomposition of the first i values in the sample
 // into m centroids and d(x_1, ..., x_n) is the sum of squared distances of x_1
 // through x_n to their mean.
-func NewFromSample(sample []float64, n int) *Sketch {
-	sort.Float64s(sample)
+//
+// Filling in the table takes time on the order of len(sample)^2 * n and space
+// on the order of len(sample) * n: bootstrapping with 1,000 values and 32
+// centroids takes about 32 million steps and 32,000 table entries. sample is
+// sorted in place. Returns an error if n is less than 1 or more than 2^24, if
+// sample is empty, or if sample contains any NaN or infinite values.
+func NewFromSample(sample []float64, n int) (*Sketch, error) {
 	if n < 1 {
-		panic("Number of centroids must be at least 1")
-	} else if n > len(sample) {
+		return nil, errors.New("Number of centroids must be at least 1.")
+	} else if n > maxCentroids {
+		return nil, errors.New(fmt.Sprintf("Bad number of centroids %v", n))
+	} else if len(sample) == 0 {
+		return nil, errors.New("Can't create a Sketch from an empty sample")
+	}
+	for i, x := range sample {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, errors.New(fmt.Sprintf("Sample value %v is %v", i, x))
+		}
+	}
+	sort.Float64s(sample)
+	if n > len(sample) {
 		// Why are you using the NewFromSample method if want more
 		// centroids than the samples you have? Oh well, we'll do the
 		// right thing anyway.
-		centroids := make([]centroid, 0, n+1)
-		for i, x := range sample {
-			if i > 0 && sample[i] == sample[i-1] {
-				centroids[len(centroids)-1].m += 1
-			} else {
-				centroids = append(centroids, centroid{x, 1})
-			}
+		h := New(uint(n))
+		for _, x := range sample {
+			h.Add(x)
 		}
-		for _, c := range centroids {
-			if c.m > 1 {
-				c.m = -c.m
-			}
-		}
-		return &Sketch{centroids, float64(len(sample)), sample[0], sample[len(sample)-1]}
+		return h, nil
 	}
 	// Initialize tables used for dynamic programming.
 	// d[i][j] == Minimum sum of squared distances to centroid for a
@@ -363,7 +2079,7 @@ func NewFromSample(sample []float64, n int) *Sketch {
 	}
 
 	// Create the centroid decomposition by backtracking through the b matrix.
-	h := &Sketch{make([]centroid, n, n+1), float64(len(sample)), sample[0], sample[len(sample)-1]}
+	h := &Sketch{cs: make([]centroid, n, n+1), count: float64(len(sample)), min: sample[0], max: sample[len(sample)-1]}
 	centroid := n-1
 	i := len(sample)-1;
 	for centroid >= 0 {
@@ -388,5 +2104,5 @@ func NewFromSample(sample []float64, n int) *Sketch {
 		}
 		centroid -= 1
 	}
-	return h
+	return h, nil
 }
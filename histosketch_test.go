@@ -2,11 +2,18 @@ package histosketch
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"math"
 	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func TestSortedAdd(t *testing.T) {
@@ -23,7 +30,7 @@ func TestSortedAdd(t *testing.T) {
 	s.AddMany(2.0, 5)
 	s.Add(2.0)
 	actual := fmt.Sprintf("%v", *s)
-	expected := "{[{1 1} {2 9} {90 1} {92 27} {99 1} {100 1} {101 2} {102 1}] 43 1 102}"
+	expected := "{centroids=32 count=43 min=1 max=102 dropped=0 [1:1 2:9 90:1 92:27 99:1 100:1 101:2 102:1]}"
 	if actual != expected {
 		t.Errorf("Want %v, got %v", expected, actual)
 	}
@@ -55,6 +62,1522 @@ func TestMinAndMax(t *testing.T) {
 	}
 }
 
+func TestCount(t *testing.T) {
+	s := New(4)
+	for i := 0; i < 100; i++ {
+		s.Add(float64(i % 17))
+	}
+	s.AddMany(3.5, 20)
+	if s.Count() != 120.0 {
+		t.Errorf("Want 120 for Count, got %v", s.Count())
+	}
+	if s.Sum(s.Max()) != s.Count() {
+		t.Errorf("Want Sum(Max()) == Count(), got %v and %v", s.Sum(s.Max()), s.Count())
+	}
+	o, err := NewFromSample([]float64{1.0, 2.0, 2.0, 3.0, 8.0, 9.0, 9.5}, 4)
+	if err != nil {
+		t.Fatalf("Got error from NewFromSample: %v", err)
+	}
+	if o.Count() != 7.0 {
+		t.Errorf("Want 7 for Count after NewFromSample, got %v", o.Count())
+	}
+	if err := s.Merge(o); err != nil {
+		t.Errorf("Got error merging sketches: %v", err)
+	}
+	if s.Count() != 127.0 {
+		t.Errorf("Want 127 for Count after Merge, got %v", s.Count())
+	}
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Errorf("Got error marshalling Sketch: %v", err)
+	}
+	u := &Sketch{}
+	if err := u.UnmarshalBinary(b); err != nil {
+		t.Errorf("Got error unmarshalling Sketch: %v", err)
+	}
+	if u.Count() != s.Count() {
+		t.Errorf("Want %v for Count after unmarshalling, got %v", s.Count(), u.Count())
+	}
+}
+
+func TestMean(t *testing.T) {
+	s := New(8)
+	if !math.IsNaN(s.Mean()) {
+		t.Errorf("Want NaN for Mean of empty sketch, got %v", s.Mean())
+	}
+	rand.Seed(0)
+	sum := 0.0
+	for i := 0; i < 10000; i++ {
+		r := rand.ExpFloat64()
+		sum += r
+		s.Add(r)
+	}
+	want := sum / 10000
+	if e := math.Abs(s.Mean()-want) / want; e > 1e-9 {
+		t.Errorf("Want %v for Mean, got %v", want, s.Mean())
+	}
+}
+
+func TestVariance(t *testing.T) {
+	s := New(16)
+	if !math.IsNaN(s.Variance()) {
+		t.Errorf("Want NaN for Variance of empty sketch, got %v", s.Variance())
+	}
+	s.AddMany(3.0, 10)
+	if s.Variance() != 0.0 || s.StdDev() != 0.0 {
+		t.Errorf("Want 0 for Variance and StdDev of a single value, got %v and %v",
+			s.Variance(), s.StdDev())
+	}
+	for seed := 0; seed < 10; seed++ {
+		s := New(16)
+		rand.Seed(int64(seed))
+		for i := 0; i < 10000; i++ {
+			s.Add(2.0 * rand.NormFloat64())
+		}
+		if e := math.Abs(s.Variance()-4.0) / 4.0; e >= 0.1 {
+			t.Errorf("Got error %v for Variance (got %v, want ~4.0 with seed = %v)",
+				e, s.Variance(), seed)
+		}
+		if s.StdDev() != math.Sqrt(s.Variance()) {
+			t.Errorf("Want StdDev == sqrt(Variance), got %v and %v", s.StdDev(), s.Variance())
+		}
+	}
+}
+
+func TestAddWeighted(t *testing.T) {
+	s := New(4)
+	s.AddWeighted(1.0, 0.5)
+	s.AddWeighted(2.0, 2.5)
+	s.AddWeighted(2.0, 1.0)
+	s.AddWeighted(10.0, 0.0)
+	actual := fmt.Sprintf("%v", *s)
+	expected := "{centroids=4 count=4 min=1 max=2 dropped=0 [1:0.5 2:3.5]}"
+	if actual != expected {
+		t.Errorf("Want %v, got %v", expected, actual)
+	}
+
+	// Weighted adds should be equivalent to repeated adds.
+	w, x := New(8), New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		r := float64(rand.Intn(50))
+		n := rand.Intn(5)
+		w.AddWeighted(r, float64(n))
+		for j := 0; j < n; j++ {
+			x.Add(r)
+		}
+	}
+	if len(w.cs) != len(x.cs) || w.Count() != x.Count() {
+		t.Fatalf("Want %v after weighted adds, got %v", *x, *w)
+	}
+	for i := range w.cs {
+		if math.Abs(w.cs[i].p-x.cs[i].p) > 1e-9 || w.cs[i].m != x.cs[i].m {
+			t.Errorf("Want %v after weighted adds, got %v", *x, *w)
+		}
+	}
+}
+
+func TestAddN(t *testing.T) {
+	s, x := New(8), New(8)
+	for i := uint64(0); i < 100; i++ {
+		s.AddN(float64(i%13), i)
+		for j := uint64(0); j < i; j++ {
+			x.Add(float64(i % 13))
+		}
+	}
+	if s.Count() != 4950.0 {
+		t.Errorf("Want 4950 for Count after AddN, got %v", s.Count())
+	}
+	for _, q := range []float64{0.0, 0.1, 0.5, 0.9, 1.0} {
+		if math.Abs(s.Quantile(q)-x.Quantile(q)) > 1e-9 {
+			t.Errorf("Want %v for Quantile(%v) after AddN, got %v", x.Quantile(q), q, s.Quantile(q))
+		}
+	}
+	s.AddN(1000.0, 0)
+	if s.Count() != 4950.0 || s.Max() != 12.0 {
+		t.Errorf("Want AddN with n = 0 to be a no-op, got %v", *s)
+	}
+}
+
+func TestAddBatch(t *testing.T) {
+	for _, n := range []uint{32, 512} {
+		s, x := New(n), New(n)
+		rand.Seed(0)
+		batch := []float64{}
+		for i := 0; i < 10000; i++ {
+			r := math.Round(rand.NormFloat64()*1000) / 100
+			batch = append(batch, r)
+			x.Add(r)
+			if len(batch) == 1000 {
+				s.AddBatch(batch)
+				batch = batch[:0]
+			}
+		}
+		s.AddBatch(batch)
+		s.AddBatch(nil)
+		if s.Count() != x.Count() || s.Min() != x.Min() || s.Max() != x.Max() {
+			t.Errorf("Want Count, Min, Max = %v, %v, %v after AddBatch, got %v, %v, %v",
+				x.Count(), x.Min(), x.Max(), s.Count(), s.Min(), s.Max())
+		}
+		if len(s.cs) > int(n) {
+			t.Errorf("Want at most %v centroids after AddBatch, got %v", n, len(s.cs))
+		}
+		for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+			if e := math.Abs(x.CDF(s.Quantile(q)) - q); e >= 0.02 {
+				t.Errorf("Got rank error %v between AddBatch and Add for Quantile(%v) (%v vs. %v)",
+					e, q, s.Quantile(q), x.Quantile(q))
+			}
+		}
+	}
+
+	// Small batches that fit without compression should be exact, whether
+	// they're added one at a time or merged.
+	e, m := New(256), New(256)
+	e.AddBatch([]float64{3.0, 1.0, 2.0, 3.0})
+	e.AddBatch([]float64{2.0})
+	m.mergeBatch([]float64{3.0, 1.0, 2.0, 3.0})
+	m.mergeBatch([]float64{2.0})
+	want := "{centroids=256 count=5 min=1 max=3 dropped=0 [1:1 2:2 3:2]}"
+	if fmt.Sprintf("%v", *e) != want || fmt.Sprintf("%v", *m) != want {
+		t.Errorf("Want %v after AddBatch, got %v and %v", want, *e, *m)
+	}
+}
+
+func TestCentroids(t *testing.T) {
+	s := New(3)
+	if cs := s.Centroids(); len(cs) != 0 {
+		t.Errorf("Want no centroids for an empty sketch, got %v", cs)
+	}
+	for _, x := range []float64{5.0, 1.0, 2.0, 5.0} {
+		s.Add(x)
+	}
+	s.Add(6.0)
+	want := []Centroid{{1.5, 2}, {5.0, 2}, {6.0, 1}}
+	cs := s.Centroids()
+	if !reflect.DeepEqual(cs, want) {
+		t.Errorf("Want Centroids() = %v, got %v", want, cs)
+	}
+	cs[0].Value, cs[0].Weight = 100.0, 100.0
+	if got := s.Centroids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Want Centroids() = %v after mutating a copy, got %v", want, got)
+	}
+}
+
+func TestForEachCentroid(t *testing.T) {
+	s := New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	got := []Centroid{}
+	s.ForEachCentroid(func(value, weight float64) bool {
+		got = append(got, Centroid{value, weight})
+		return true
+	})
+	if want := s.Centroids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Want ForEachCentroid to visit %v, got %v", want, got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1].Value >= got[i].Value {
+			t.Errorf("Want ascending values, got %v then %v", got[i-1].Value, got[i].Value)
+		}
+	}
+	calls := 0
+	s.ForEachCentroid(func(value, weight float64) bool {
+		calls++
+		return calls < 3
+	})
+	if calls != 3 {
+		t.Errorf("Want 3 calls before stopping early, got %v", calls)
+	}
+	if n := testing.AllocsPerRun(100, func() {
+		s.ForEachCentroid(func(value, weight float64) bool { return true })
+	}); n != 0 {
+		t.Errorf("Want no allocations from ForEachCentroid, got %v", n)
+	}
+}
+
+func TestCentroidsAround(t *testing.T) {
+	s := New(16)
+	if got := s.CentroidsAround(0.5, 2); len(got) != 0 {
+		t.Errorf("Want no centroids around median of empty sketch, got %v", got)
+	}
+	for i := 1; i <= 10; i++ {
+		s.Add(float64(i))
+	}
+	values := func(cs []Centroid) []float64 {
+		vs := []float64{}
+		for _, c := range cs {
+			vs = append(vs, c.Value)
+		}
+		return vs
+	}
+	for _, c := range []struct {
+		q    float64
+		k    int
+		want []float64
+	}{
+		{0.5, 0, []float64{}},
+		{0.5, 1, []float64{6}},
+		{0.5, 2, []float64{5, 6}},
+		{0.5, 3, []float64{5, 6, 7}},
+		{0.0, 2, []float64{1, 2}},
+		{-1.0, 2, []float64{1, 2}},
+		{1.0, 2, []float64{9, 10}},
+		{2.0, 3, []float64{8, 9, 10}},
+		{0.5, 100, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{math.NaN(), 2, []float64{}},
+	} {
+		if got := values(s.CentroidsAround(c.q, c.k)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Want CentroidsAround(%v, %v) = %v, got %v", c.q, c.k, c.want, got)
+		}
+	}
+
+	// With merged centroids, the result straddles the estimate.
+	s = New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	v := s.Quantile(0.9)
+	cs := s.CentroidsAround(0.9, 2)
+	if len(cs) != 2 || cs[0].Value > v || cs[1].Value < v {
+		t.Errorf("Want 2 centroids around %v, got %v", v, cs)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic on call to CentroidsAround(0.5, -1)")
+			}
+		}()
+		s.CentroidsAround(0.5, -1)
+	}()
+}
+
+func TestQuantileMonotonic(t *testing.T) {
+	for seed := 0; seed < 50; seed++ {
+		rand.Seed(int64(seed))
+		s := New(uint(1 + rand.Intn(20)))
+		for i := 0; i < 1+rand.Intn(500); i++ {
+			switch rand.Intn(4) {
+			case 0:
+				s.Add(rand.NormFloat64() * 1e6)
+			case 1:
+				s.Add(rand.ExpFloat64())
+			case 2:
+				s.Add(float64(rand.Intn(5)))
+			default:
+				s.AddWeighted(rand.Float64()*1e-9, rand.Float64()*100)
+			}
+		}
+		for i := 0; i < 2000; i++ {
+			p, q := rand.Float64(), rand.Float64()
+			if i%4 == 0 {
+				// Probe nearby pairs, where rounding is most likely to bite.
+				q = math.Min(1.0, p+rand.Float64()*1e-9)
+			}
+			if p > q {
+				p, q = q, p
+			}
+			if s.Quantile(p) > s.Quantile(q) {
+				t.Fatalf("Seed %v: want Quantile(%v) <= Quantile(%v), got %v > %v",
+					seed, p, q, s.Quantile(p), s.Quantile(q))
+			}
+		}
+		qs := make([]float64, 1001)
+		for i := range qs {
+			qs[i] = float64(i) / 1000.0
+		}
+		r := s.Quantiles(qs)
+		for i := 1; i < len(r); i++ {
+			if math.IsNaN(r[i]) || r[i-1] > r[i] {
+				t.Fatalf("Seed %v: want non-decreasing Quantiles, got %v then %v at q=%v",
+					seed, r[i-1], r[i], qs[i])
+			}
+		}
+	}
+}
+
+func TestEmptySketch(t *testing.T) {
+	full := New(4)
+	full.Add(1.0)
+	full.Reset()
+	for _, s := range []*Sketch{New(4), full} {
+		queries := map[string]float64{
+			"Quantile(0.0)":          s.Quantile(0.0),
+			"Quantile(0.5)":          s.Quantile(0.5),
+			"Quantile(1.0)":          s.Quantile(1.0),
+			"Sum(0.0)":               s.Sum(0.0),
+			"Min()":                  s.Min(),
+			"Max()":                  s.Max(),
+			"CountBetween(0.0, 1.0)": s.CountBetween(0.0, 1.0),
+			"CDF(0.0)":               s.CDF(0.0),
+			"Mean()":                 s.Mean(),
+			"Median()":               s.Median(),
+			"StdDev()":               s.StdDev(),
+		}
+		for name, got := range queries {
+			if !math.IsNaN(got) {
+				t.Errorf("Want NaN for %v of empty sketch, got %v", name, got)
+			}
+		}
+		if s.Count() != 0.0 {
+			t.Errorf("Want Count() = 0 for empty sketch, got %v", s.Count())
+		}
+	}
+}
+
+func TestAddNonFinite(t *testing.T) {
+	s, x := New(16), New(16)
+	rand.Seed(0)
+	bad := []float64{math.NaN(), math.Inf(1), math.Inf(-1)}
+	for i := 0; i < 1000; i++ {
+		r := rand.NormFloat64()
+		s.Add(r)
+		x.Add(r)
+		if i%10 == 0 {
+			s.Add(bad[i%3])
+		}
+	}
+	s.AddN(math.NaN(), 5)
+	s.AddWeighted(math.Inf(1), 0.5)
+	if s.Dropped() != 105.5 {
+		t.Errorf("Want 105.5 dropped, got %v", s.Dropped())
+	}
+	if !s.Equal(x, 0) {
+		t.Errorf("Want NaN and infinite values to leave the sketch unchanged, got %v, want %v", *s, *x)
+	}
+	for _, q := range []float64{0.0, 0.1, 0.5, 0.9, 1.0} {
+		if s.Quantile(q) != x.Quantile(q) {
+			t.Errorf("Want Quantile(%v) = %v, got %v", q, x.Quantile(q), s.Quantile(q))
+		}
+	}
+
+	for _, add := range []func(*Sketch, []float64){(*Sketch).AddBatch, (*Sketch).mergeBatch} {
+		b := New(512)
+		add(b, []float64{1.0, math.NaN(), 2.0, math.Inf(-1)})
+		if b.Dropped() != 2 || b.Count() != 2 || b.Min() != 1.0 || b.Max() != 2.0 {
+			t.Errorf("Want AddBatch to drop 2 values and keep [1, 2], got %v", *b)
+		}
+		add(b, []float64{math.NaN()})
+		if b.Dropped() != 3 || b.Count() != 2 {
+			t.Errorf("Want AddBatch of only NaN to just count it as dropped, got %v", *b)
+		}
+		if err := b.Merge(New(512)); err != nil || b.Dropped() != 3 {
+			t.Errorf("Want 3 dropped after Merge, got %v (err %v)", b.Dropped(), err)
+		}
+	}
+	s.Reset()
+	if s.Dropped() != 0 {
+		t.Errorf("Want 0 dropped after Reset, got %v", s.Dropped())
+	}
+}
+
+func TestDecay(t *testing.T) {
+	s := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.Float64())
+	}
+	q := s.Quantiles([]float64{0.1, 0.5, 0.9})
+	s.Decay(0.5)
+	if s.Count() != 500.0 || s.Min() >= 0.01 || s.Max() <= 0.99 {
+		t.Errorf("Want Count 500 and unchanged Min/Max after Decay(0.5), got %v, %v, %v",
+			s.Count(), s.Min(), s.Max())
+	}
+	if got := s.Quantiles([]float64{0.1, 0.5, 0.9}); !reflect.DeepEqual(got, q) {
+		t.Errorf("Want Decay to leave quantiles unchanged, got %v, want %v", got, q)
+	}
+
+	// After repeatedly decaying values in [0, 1] while adding values in
+	// [10, 11], the median should be in [10, 11].
+	for i := 0; i < 20; i++ {
+		s.Decay(0.5)
+		for j := 0; j < 100; j++ {
+			s.Add(10.0 + rand.Float64())
+		}
+	}
+	if m := s.Median(); m < 10.0 || m > 11.0 {
+		t.Errorf("Want median in [10, 11] after decay, got %v", m)
+	}
+	if s.Min() >= 0.01 {
+		t.Errorf("Want Min to still reflect decayed values, got %v", s.Min())
+	}
+
+	for _, f := range []float64{0.0, -0.5, 1.5, math.NaN()} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to Decay(%v)", f)
+				}
+			}()
+			s.Decay(f)
+		}()
+	}
+}
+
+func TestNearestCentroid(t *testing.T) {
+	h, _ := Parse("{centroids=4 count=8 min=0 max=9 dropped=0 [0:1 2:~3 5:~3 9:1]}")
+	for _, c := range []struct {
+		x, value, weight float64
+		index            int
+	}{
+		{-100, 0, 1, 0}, {0, 0, 1, 0}, {0.9, 0, 1, 0}, {1, 0, 1, 0}, {1.1, 2, 3, 1},
+		{3.5, 2, 3, 1}, {3.6, 5, 3, 2}, {5, 5, 3, 2}, {7, 5, 3, 2}, {7.5, 9, 1, 3},
+		{math.Inf(1), 9, 1, 3},
+	} {
+		v, w, i := h.NearestCentroid(c.x)
+		if v != c.value || w != c.weight || i != c.index {
+			t.Errorf("Want (%v, %v, %v) from NearestCentroid(%v), got (%v, %v, %v)",
+				c.value, c.weight, c.index, c.x, v, w, i)
+		}
+	}
+	for _, x := range []*Sketch{New(4), h} {
+		if v, w, i := x.NearestCentroid(math.NaN()); x == h && (!math.IsNaN(v) || !math.IsNaN(w) || i != -1) {
+			t.Errorf("Want (NaN, NaN, -1) from NearestCentroid(NaN), got (%v, %v, %v)", v, w, i)
+		}
+		if v, w, i := x.NearestCentroid(1.0); x != h && (!math.IsNaN(v) || !math.IsNaN(w) || i != -1) {
+			t.Errorf("Want (NaN, NaN, -1) from NearestCentroid on an empty Sketch, got (%v, %v, %v)", v, w, i)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	h := New(64)
+	rand.Seed(0)
+	for i := 0; i < 10000; i++ {
+		h.Add(rand.NormFloat64())
+		h.Decay(0.9995)
+	}
+	median, count := h.Median(), h.Count()
+	threshold := count / 64 / 10
+	pruned := 0.0
+	for _, c := range h.Centroids() {
+		if c.Weight < threshold {
+			pruned += c.Weight
+		}
+	}
+	h.Prune(threshold)
+	if pruned == 0 {
+		t.Fatalf("Want some centroids lighter than %v to prune, got none", threshold)
+	}
+	if math.Abs(h.Count()-(count-pruned)) > 1e-9 {
+		t.Errorf("Want Count %v after pruning, got %v", count-pruned, h.Count())
+	}
+	for _, c := range h.Centroids() {
+		if c.Weight < threshold {
+			t.Errorf("Want no centroids lighter than %v after pruning, got %v", threshold, c)
+		}
+	}
+	if e := math.Abs(h.Median() - median); e > 0.05 {
+		t.Errorf("Want Prune to barely move the median from %v, got %v", median, h.Median())
+	}
+	if err := h.Validate(); err != nil {
+		t.Errorf("Want a valid Sketch after pruning, got %v", err)
+	}
+
+	// Exact centroids at the ends become the new Min and Max, but merged ones
+	// keep the removed neighbor as a bound.
+	for _, c := range []struct{ s, want string }{
+		{"{centroids=4 count=10.02 min=-10 max=50 dropped=0 [-10:0.01 1:5 2:5 50:0.01]}",
+			"{centroids=4 count=10 min=1 max=2 dropped=0 [1:5 2:5]}"},
+		{"{centroids=4 count=10.02 min=-10 max=50 dropped=0 [-10:0.01 1:~5 2:~5 50:0.01]}",
+			"{centroids=4 count=10 min=-10 max=50 dropped=0 [1:~5 2:~5]}"},
+		{"{centroids=4 count=10.01 min=-10 max=2 dropped=0 [-10:0.01 1:~5 2:5]}",
+			"{centroids=4 count=10 min=-10 max=2 dropped=0 [1:~5 2:5]}"},
+	} {
+		h, _ := Parse(c.s)
+		h.Prune(1.0)
+		if h.String() != c.want {
+			t.Errorf("Want %v after pruning %v, got %v", c.want, c.s, h)
+		}
+	}
+
+	h.Prune(math.Inf(1))
+	if h.Count() != 0 || len(h.Centroids()) != 0 || !math.IsNaN(h.Min()) {
+		t.Errorf("Want an empty Sketch after pruning everything, got %v", h)
+	}
+	h.Add(3.0)
+	if h.Min() != 3.0 || h.Max() != 3.0 {
+		t.Errorf("Want Min and Max 3 after adding to a pruned Sketch, got %v, %v", h.Min(), h.Max())
+	}
+}
+
+func TestAddTimestamped(t *testing.T) {
+	hl := time.Minute
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewWithOptions(WithCentroids(16), WithHalfLife(hl))
+	for _, c := range []struct {
+		t     time.Time
+		count float64
+	}{
+		{t0, 1.0},
+		{t0.Add(hl), 1.5},
+		// Out of order, so nothing decays.
+		{t0, 2.5},
+		{t0.Add(2 * hl), 2.25},
+		{t0.Add(2 * hl), 3.25},
+	} {
+		h.AddTimestamped(1.0, c.t)
+		if math.Abs(h.Count()-c.count) > 1e-12 {
+			t.Errorf("Want Count %v after adding at %v, got %v", c.count, c.t, h.Count())
+		}
+	}
+	h.Add(math.NaN())
+	h.AddTimestamped(5.0, t0.Add(1e6*hl))
+	if h.Count() != 1.0 || h.Min() != 5.0 || h.Dropped() != 1.0 {
+		t.Errorf("Want only the latest value and the dropped NaN after a very long gap, got %v", h)
+	}
+
+	x := New(16)
+	x.AddTimestamped(1.0, t0)
+	x.AddTimestamped(1.0, t0.Add(hl))
+	if x.Count() != 2.0 {
+		t.Errorf("Want no decay without WithHalfLife, got Count %v", x.Count())
+	}
+
+	// The estimates should follow the distribution of recent values.
+	rand.Seed(0)
+	d := NewWithOptions(WithCentroids(32), WithHalfLife(time.Minute))
+	for i := 0; i < 2000; i++ {
+		x := rand.Float64()
+		if i >= 1000 {
+			x += 10.0
+		}
+		d.AddTimestamped(x, t0.Add(time.Duration(i)*time.Second))
+	}
+	if m := d.Median(); m < 10.0 || m > 11.0 {
+		t.Errorf("Want median of recent values in [10, 11], got %v", m)
+	}
+}
+
+func TestAddWeightedTimestamped(t *testing.T) {
+	hl := time.Minute
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewWithOptions(WithCentroids(16), WithHalfLife(hl))
+	for _, c := range []struct {
+		t      time.Time
+		weight float64
+		count  float64
+	}{
+		{t0, 4.0, 4.0},
+		{t0.Add(hl), 2.0, 4.0},
+		// Out of order, so nothing decays.
+		{t0, 1.0, 5.0},
+		// Nothing is added, but values still decay.
+		{t0.Add(2 * hl), 0.0, 2.5},
+		{t0.Add(3 * hl), 0.75, 2.0},
+	} {
+		h.AddWeightedTimestamped(1.0, c.weight, c.t)
+		if math.Abs(h.Count()-c.count) > 1e-12 {
+			t.Errorf("Want Count %v after adding weight %v at %v, got %v", c.count, c.weight, c.t, h.Count())
+		}
+	}
+	want := fmt.Sprintf("%v", *h)
+	for _, w := range []float64{-1.0, math.NaN(), math.Inf(1)} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to AddWeightedTimestamped with weight %v", w)
+				}
+			}()
+			h.AddWeightedTimestamped(1.0, w, t0.Add(10*hl))
+		}()
+	}
+	if got := fmt.Sprintf("%v", *h); got != want || !h.last.Equal(t0.Add(3*hl)) {
+		t.Errorf("Want %v unchanged after bad weights, got %v", want, got)
+	}
+}
+
+func TestScale(t *testing.T) {
+	a, b := New(32), New(32)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		a.Add(rand.Float64())
+		b.Add(10.0 + rand.Float64())
+	}
+	qs := []float64{0.0, 0.1, 0.25, 0.5, 0.75, 0.9, 1.0}
+	want := a.Quantiles(qs)
+	a.Scale(0.7)
+	if a.Count() != 700.0 {
+		t.Errorf("Want Count 700 after Scale(0.7), got %v", a.Count())
+	}
+	for i, got := range a.Quantiles(qs) {
+		if math.Abs(got-want[i]) > 1e-6 {
+			t.Errorf("Want Quantile(%v) = %v after Scale, got %v", qs[i], want[i], got)
+		}
+	}
+	b.Scale(0.3)
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Want no error merging scaled sketches, got %v", err)
+	}
+	// 70% of the mixture is in [0, 1] and 30% is in [10, 11].
+	if got := a.CDF(5.0); math.Abs(got-0.7) > 0.01 {
+		t.Errorf("Want CDF(5.0) = 0.7 for mixture, got %v", got)
+	}
+	a.Scale(0)
+	if a.Count() != 0 || !math.IsNaN(a.Quantile(0.5)) {
+		t.Errorf("Want Scale(0) to empty the sketch, got %v", *a)
+	}
+	for _, k := range []float64{-1.0, math.NaN(), math.Inf(1)} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to Scale(%v)", k)
+				}
+			}()
+			a.Scale(k)
+		}()
+	}
+}
+
+func TestAddSketch(t *testing.T) {
+	a, b := New(32), New(32)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		a.Add(rand.Float64())
+		b.Add(10.0 + rand.Float64())
+	}
+	want := a.Clone()
+	scaled := b.Clone()
+	scaled.Scale(0.3)
+	if err := want.Merge(scaled); err != nil {
+		t.Fatalf("Want no error merging scaled sketches, got %v", err)
+	}
+	bs := fmt.Sprintf("%v", *b)
+	a.AddSketch(b, 0.3)
+	if a.Count() != 1300.0 {
+		t.Errorf("Want Count 1300 after AddSketch(b, 0.3), got %v", a.Count())
+	}
+	if !a.Equal(want, 1e-9) {
+		t.Errorf("Want AddSketch to match Scale and Merge, got %v, want %v", *a, *want)
+	}
+	if got := fmt.Sprintf("%v", *b); got != bs {
+		t.Errorf("Want %v after AddSketch, got %v", bs, got)
+	}
+
+	// Sketches with a different maximum number of centroids can be added.
+	c := New(4)
+	c.AddSketch(a, 2.0)
+	if c.Count() != 2600.0 || len(c.Centroids()) != 4 || c.Min() != a.Min() || c.Max() != a.Max() {
+		t.Errorf("Want 4 centroids with Count 2600 after AddSketch(a, 2), got %v", *c)
+	}
+	cs := fmt.Sprintf("%v", *c)
+	c.AddSketch(a, 0.0)
+	c.AddSketch(New(8), 1.0)
+	if got := fmt.Sprintf("%v", *c); got != cs {
+		t.Errorf("Want %v after adding nothing, got %v", cs, got)
+	}
+	for _, w := range []float64{-1.0, math.NaN(), math.Inf(1)} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to AddSketch with weight %v", w)
+				}
+			}()
+			c.AddSketch(a, w)
+		}()
+	}
+}
+
+func TestDensity(t *testing.T) {
+	for name, dist := range map[string]func() float64{
+		"uniform":     rand.Float64,
+		"normal":      rand.NormFloat64,
+		"exponential": rand.ExpFloat64,
+	} {
+		rand.Seed(0)
+		s := New(16)
+		for i := 0; i < 10000; i++ {
+			s.Add(dist())
+		}
+		// Integrate with the midpoint rule.
+		total, steps := 0.0, 100000
+		w := (s.Max() - s.Min()) / float64(steps)
+		for i := 0; i < steps; i++ {
+			total += s.Density(s.Min()+(float64(i)+0.5)*w) * w
+		}
+		if e := math.Abs(total-s.Count()) / s.Count(); e > 0.001 {
+			t.Errorf("Want integral of %v Density over [Min, Max] near %v, got %v", name, s.Count(), total)
+		}
+		if s.Density(s.Min()-1.0) != 0.0 || s.Density(s.Max()+1.0) != 0.0 {
+			t.Errorf("Want 0 density outside [Min, Max] for %v, got %v and %v",
+				name, s.Density(s.Min()-1.0), s.Density(s.Max()+1.0))
+		}
+	}
+	// Uniform on [0, 1) should have density near Count() in the middle.
+	rand.Seed(0)
+	s := New(16)
+	for i := 0; i < 10000; i++ {
+		s.Add(rand.Float64())
+	}
+	if d := s.Density(0.5); math.Abs(d-10000.0)/10000.0 > 0.1 {
+		t.Errorf("Want Density(0.5) near 10000 for uniform values, got %v", d)
+	}
+	if !math.IsNaN(New(4).Density(0.0)) {
+		t.Errorf("Want NaN for Density of empty sketch, got %v", New(4).Density(0.0))
+	}
+}
+
+// Mean of the values in sorted between the lo and hi quantiles, where each
+// value covers one unit of rank and values on the boundaries are partially
+// included.
+func exactTrimmedMean(sorted []float64, lo, hi float64) float64 {
+	a, b := lo*float64(len(sorted)), hi*float64(len(sorted))
+	sum, w := 0.0, 0.0
+	for i, x := range sorted {
+		if o := math.Min(float64(i+1), b) - math.Max(float64(i), a); o > 0 {
+			sum += x * o
+			w += o
+		}
+	}
+	return sum / w
+}
+
+func TestTrimmedMean(t *testing.T) {
+	rand.Seed(0)
+	values := []float64{}
+	exact, s := New(100), New(32)
+	for i := 0; i < 100; i++ {
+		values = append(values, rand.ExpFloat64())
+		exact.Add(values[i])
+	}
+	for i := 100; i < 10000; i++ {
+		values = append(values, rand.ExpFloat64())
+	}
+	for _, x := range values {
+		s.Add(x)
+	}
+	first := append([]float64{}, values[:100]...)
+	sort.Float64s(first)
+	sort.Float64s(values)
+	for _, r := range [][2]float64{{0.0, 1.0}, {0.05, 0.95}, {0.1, 0.5}, {0.333, 0.667}, {0.9, 1.0}} {
+		want := exactTrimmedMean(first, r[0], r[1])
+		if got := exact.TrimmedMean(r[0], r[1]); math.Abs(got-want) > 1e-9 {
+			t.Errorf("Want exact TrimmedMean(%v, %v) = %v, got %v", r[0], r[1], want, got)
+		}
+		want = exactTrimmedMean(values, r[0], r[1])
+		if got := s.TrimmedMean(r[0], r[1]); math.Abs(got-want)/want > 0.1 {
+			t.Errorf("Want TrimmedMean(%v, %v) near %v, got %v", r[0], r[1], want, got)
+		}
+	}
+	if got, want := s.TrimmedMean(0.0, 1.0), s.Mean(); math.Abs(got-want) > 1e-9 {
+		t.Errorf("Want TrimmedMean(0, 1) = Mean() = %v, got %v", want, got)
+	}
+	for _, r := range [][2]float64{{0.5, 0.5}, {0.6, 0.4}, {-0.1, 0.5}, {0.5, 1.1}, {math.NaN(), 0.5}} {
+		if got := s.TrimmedMean(r[0], r[1]); !math.IsNaN(got) {
+			t.Errorf("Want NaN for TrimmedMean(%v, %v), got %v", r[0], r[1], got)
+		}
+	}
+	if got := New(4).TrimmedMean(0.1, 0.9); !math.IsNaN(got) {
+		t.Errorf("Want NaN for TrimmedMean of empty sketch, got %v", got)
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	minmax := func(s *Sketch) [2]float64 { return [2]float64{s.Min(), s.Max()} }
+	a, b, e := New(4), New(4), New(4)
+	for _, x := range []float64{5.0, -3.0, 7.5, 2.0, 1.0, 6.0} {
+		a.Add(x)
+	}
+	for _, x := range []float64{-10.0, 0.0, 3.0} {
+		b.Add(x)
+	}
+	if got := minmax(a); got != [2]float64{-3.0, 7.5} {
+		t.Errorf("Want Min, Max = -3, 7.5 after compressing, got %v", got)
+	}
+	m, err := MergeMany([]*Sketch{a, b, e}, 4)
+	if err != nil {
+		t.Fatalf("Got error from MergeMany: %v", err)
+	}
+	if got := minmax(m); got != [2]float64{-10.0, 7.5} {
+		t.Errorf("Want Min, Max = -10, 7.5 after MergeMany, got %v", got)
+	}
+	if err := e.Merge(e.Clone()); err != nil || !math.IsNaN(e.Min()) || !math.IsNaN(e.Max()) {
+		t.Errorf("Want NaN Min, Max after merging empty sketches, got %v (err %v)", minmax(e), err)
+	}
+	if err := a.Merge(e); err != nil || minmax(a) != [2]float64{-3.0, 7.5} {
+		t.Errorf("Want merging an empty sketch to leave Min, Max alone, got %v (err %v)", minmax(a), err)
+	}
+	if err := e.Merge(b); err != nil || minmax(e) != [2]float64{-10.0, 3.0} {
+		t.Errorf("Want Min, Max = -10, 3 after merging into empty sketch, got %v (err %v)", minmax(e), err)
+	}
+	if err := a.Merge(b); err != nil || minmax(a) != [2]float64{-10.0, 7.5} {
+		t.Errorf("Want Min, Max = -10, 7.5 after Merge, got %v (err %v)", minmax(a), err)
+	}
+	a.Decay(0.5)
+	a.Scale(3.0)
+	if got := minmax(a); got != [2]float64{-10.0, 7.5} {
+		t.Errorf("Want Decay and Scale to leave Min, Max alone, got %v", got)
+	}
+	a.Scale(0)
+	if !math.IsNaN(a.Min()) || !math.IsNaN(a.Max()) {
+		t.Errorf("Want NaN Min, Max after Scale(0), got %v", minmax(a))
+	}
+}
+
+func TestNegativeValues(t *testing.T) {
+	tests := []struct {
+		name string
+		gen  func() float64
+	}{
+		{"all negative", func() float64 { return -1000.0 - rand.ExpFloat64() }},
+		{"mixed sign", rand.NormFloat64},
+		{"skewed mixed sign", func() float64 {
+			if rand.Intn(3) == 0 {
+				return -5.0 * rand.ExpFloat64()
+			}
+			return rand.ExpFloat64()
+		}},
+	}
+	for _, test := range tests {
+		rand.Seed(0)
+		s, neg := New(64), New(64)
+		values := make([]float64, 10000)
+		for i := range values {
+			values[i] = test.gen()
+			s.Add(values[i])
+			neg.Add(-values[i])
+		}
+		sort.Float64s(values)
+		if err := s.Validate(); err != nil {
+			t.Errorf("Want valid sketch of %v values, got %v", test.name, err)
+		}
+		if s.Min() != values[0] || s.Max() != values[len(values)-1] {
+			t.Errorf("Want Min, Max = %v, %v for %v values, got %v, %v",
+				values[0], values[len(values)-1], test.name, s.Min(), s.Max())
+		}
+		for i := 0; i <= 100; i++ {
+			q := float64(i) / 100.0
+			got := s.Quantile(q)
+			if r := float64(sort.SearchFloat64s(values, got)) / float64(len(values)); math.Abs(r-q) > 0.05 {
+				t.Errorf("Want Quantile(%v) of %v values near exact rank %v, got %v with rank %v",
+					q, test.name, q, got, r)
+			}
+			x := values[int(q*float64(len(values)-1))]
+			want := float64(sort.SearchFloat64s(values, math.Nextafter(x, math.Inf(1))))
+			if got := s.Sum(x); math.Abs(got-want) > 0.05*float64(len(values)) {
+				t.Errorf("Want Sum(%v) of %v values near exact %v, got %v", x, test.name, want, got)
+			}
+			// Nothing should depend on the sign of the values, so negating
+			// them should mirror every estimate.
+			if got, want := neg.Quantile(1-q), -s.Quantile(q); math.Abs(got-want) > 1e-9*math.Max(1, math.Abs(want)) {
+				t.Errorf("Want Quantile(%v) of negated %v values to be %v, got %v", 1-q, test.name, want, got)
+			}
+		}
+	}
+}
+
+func TestMode(t *testing.T) {
+	rand.Seed(0)
+	s := New(32)
+	for i := 0; i < 10000; i++ {
+		if rand.Intn(10) < 3 {
+			s.Add(rand.NormFloat64())
+		} else {
+			s.Add(5.0 + rand.NormFloat64()*0.1)
+		}
+	}
+	if m := s.Mode(); math.Abs(m-5.0) > 0.1 {
+		t.Errorf("Want Mode near 5 for bimodal values, got %v", m)
+	}
+	u := New(16)
+	for i := 0; i < 1000; i++ {
+		u.Add(rand.Float64() * 100)
+	}
+	u.AddN(42.0, 200)
+	if m := u.Mode(); math.Abs(m-42.0) > 1.0 {
+		t.Errorf("Want Mode near 42 for a uniform sample with a spike at 42, got %v", m)
+	}
+	one := New(4)
+	one.AddN(7.0, 3)
+	if m := one.Mode(); m != 7.0 {
+		t.Errorf("Want Mode 7 for a single value, got %v", m)
+	}
+	if m := New(4).Mode(); !math.IsNaN(m) {
+		t.Errorf("Want NaN for Mode of empty sketch, got %v", m)
+	}
+}
+
+func TestDistinctEstimate(t *testing.T) {
+	if got := New(8).DistinctEstimate(); !math.IsNaN(got) {
+		t.Errorf("Want NaN for DistinctEstimate of empty sketch, got %v", got)
+	}
+	constant := New(32)
+	for i := 0; i < 10000; i++ {
+		constant.Add(3.0)
+	}
+	if got := constant.DistinctEstimate(); got != 1 {
+		t.Errorf("Want DistinctEstimate 1 for a constant stream, got %v", got)
+	}
+	few := New(32)
+	for i := 0; i < 10000; i++ {
+		few.Add(float64(i % 5))
+	}
+	if got := few.DistinctEstimate(); math.Abs(got-5) > 1e-9 {
+		t.Errorf("Want DistinctEstimate 5 for 5 equally common values, got %v", got)
+	}
+	rand.Seed(0)
+	uniform := New(32)
+	for i := 0; i < 10000; i++ {
+		uniform.Add(rand.Float64())
+	}
+	if got := uniform.DistinctEstimate(); got < 20 || got > 32 {
+		t.Errorf("Want DistinctEstimate between 20 and 32 for uniform values, got %v", got)
+	}
+	// A stray value barely moves the estimate for a nearly constant stream.
+	constant.Add(4.0)
+	if got := constant.DistinctEstimate(); got > 1.01 {
+		t.Errorf("Want DistinctEstimate near 1 for a nearly constant stream, got %v", got)
+	}
+}
+
+func TestIsBimodal(t *testing.T) {
+	tests := []struct {
+		name    string
+		gen     func() float64
+		bimodal bool
+	}{
+		{"normal", rand.NormFloat64, false},
+		{"exponential", rand.ExpFloat64, false},
+		{"uniform", rand.Float64, false},
+		{"log-normal", func() float64 { return math.Exp(rand.NormFloat64()) }, false},
+		{"even mixture", func() float64 {
+			if rand.Intn(2) == 0 {
+				return rand.NormFloat64()
+			}
+			return 6.0 + rand.NormFloat64()
+		}, true},
+		{"fast and slow latencies", func() float64 {
+			if rand.Intn(10) == 0 {
+				return 200.0 * math.Exp(0.2*rand.NormFloat64())
+			}
+			return 10.0 * math.Exp(0.2*rand.NormFloat64())
+		}, true},
+	}
+	for _, n := range []uint{32, 128} {
+		for _, test := range tests {
+			rand.Seed(0)
+			s := New(n)
+			for i := 0; i < 20000; i++ {
+				s.Add(test.gen())
+			}
+			if got := s.IsBimodal(0.5); got != test.bimodal {
+				t.Errorf("Want IsBimodal(0.5) = %v for %v values with %v centroids, got %v",
+					test.bimodal, test.name, n, got)
+			}
+		}
+	}
+	if New(8).IsBimodal(0.5) {
+		t.Errorf("Want IsBimodal false for an empty sketch, got true")
+	}
+	for _, threshold := range []float64{0, 1, math.NaN()} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to IsBimodal(%v)", threshold)
+				}
+			}()
+			New(8).IsBimodal(threshold)
+		}()
+	}
+}
+
+func TestQuantileWithError(t *testing.T) {
+	e := New(8)
+	for i := 1; i <= 5; i++ {
+		e.Add(float64(i))
+	}
+	for _, q := range []float64{0.0, 0.3, 0.5, 0.9, 1.0} {
+		if v, err := e.QuantileWithError(q); v != e.Quantile(q) || err != 0.0 {
+			t.Errorf("Want (%v, 0) from exact QuantileWithError(%v), got (%v, %v)", e.Quantile(q), q, v, err)
+		}
+	}
+	if v, err := New(8).QuantileWithError(0.5); !math.IsNaN(v) || !math.IsNaN(err) {
+		t.Errorf("Want (NaN, NaN) from QuantileWithError on an empty Sketch, got (%v, %v)", v, err)
+	}
+
+	rand.Seed(0)
+	prev := math.Inf(1)
+	for _, n := range []uint{8, 32, 128} {
+		h, xs := New(n), []float64{}
+		for i := 0; i < 10000; i++ {
+			x := rand.NormFloat64()
+			h.Add(x)
+			xs = append(xs, x)
+		}
+		sort.Float64s(xs)
+		total := 0.0
+		for i := 1; i < 100; i++ {
+			q := float64(i) / 100.0
+			v, err := h.QuantileWithError(q)
+			if actual := xs[int(q*float64(len(xs)))]; math.Abs(v-actual) > err {
+				t.Errorf("Want actual Quantile(%v) %v within %v of %v with %v centroids", q, actual, err, v, n)
+			}
+			total += err
+		}
+		if total >= prev {
+			t.Errorf("Want error estimates to shrink with more centroids, got total %v with %v centroids", total, n)
+		}
+		prev = total
+	}
+}
+
+func TestValidate(t *testing.T) {
+	rand.Seed(0)
+	a, b, d := New(16), New(16), NewWithOptions(WithCentroids(16), WithDecay(0.95))
+	for i := 0; i < 1000; i++ {
+		a.Add(rand.NormFloat64())
+		b.AddWeighted(rand.ExpFloat64(), rand.Float64())
+		d.Add(rand.Float64())
+	}
+	m, _ := MergeMany([]*Sketch{a, b}, 8)
+	batch := New(512)
+	batch.AddBatch([]float64{3.0, 1.0, 2.0, 2.0})
+	opt, _ := NewFromSample([]float64{1.0, 7.0, 7.0, 8.0, 8.0, 9.0, 9.0}, 7)
+	for name, h := range map[string]*Sketch{
+		"empty": New(4), "Add": a, "AddWeighted": b, "WithDecay": d, "MergeMany": m,
+		"AddBatch": batch, "NewFromSample": opt,
+	} {
+		if err := h.Validate(); err != nil {
+			t.Errorf("Want %v Sketch to be valid, got %v", name, err)
+		}
+	}
+
+	for name, corrupt := range map[string]func(h *Sketch){
+		"too many":     func(h *Sketch) { h.cs = h.cs[:cap(h.cs)] },
+		"out of order": func(h *Sketch) { h.cs[1], h.cs[2] = h.cs[2], h.cs[1] },
+		"zero weight":  func(h *Sketch) { h.cs[0].m = 0 },
+		"NaN weight":   func(h *Sketch) { h.cs[0].m = math.NaN() },
+		"bad count":    func(h *Sketch) { h.count += 1 },
+		"below min":    func(h *Sketch) { h.min = h.cs[0].p + 0.5 },
+		"above max":    func(h *Sketch) { h.max = h.cs[len(h.cs)-1].p - 0.5 },
+		"empty count":  func(h *Sketch) { h.cs = h.cs[:0] },
+	} {
+		h := a.Clone()
+		corrupt(h)
+		if err := h.Validate(); err == nil {
+			t.Errorf("Want error from Validate on Sketch with %v, got %v", name, h)
+		}
+	}
+}
+
+func TestCentroidsForError(t *testing.T) {
+	for _, e := range []float64{0.05, 0.02, 0.01} {
+		n := CentroidsForError(e)
+		for seed := 0; seed < 5; seed++ {
+			rand.Seed(int64(seed))
+			s := New(n)
+			values := make([]float64, 20000)
+			for i := range values {
+				values[i] = rand.Float64()
+				s.Add(values[i])
+			}
+			sort.Float64s(values)
+			for q := 0.01; q < 1.0; q += 0.01 {
+				r := float64(sort.SearchFloat64s(values, s.Quantile(q))) / float64(len(values))
+				if math.Abs(r-q) > e {
+					t.Errorf("Want rank error at most %v with %v centroids, got %v for q=%v (seed %v)",
+						e, n, math.Abs(r-q), q, seed)
+				}
+			}
+		}
+	}
+	if n := CentroidsForError(0.5); n != 1 {
+		t.Errorf("Want 1 centroid for error 0.5, got %v", n)
+	}
+	if n := CentroidsForError(1e-300); n != maxRecommendedCentroids {
+		t.Errorf("Want %v centroids for tiny error, got %v", maxRecommendedCentroids, n)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected panic on call to CentroidsForError(0)")
+		}
+	}()
+	CentroidsForError(0)
+}
+
+func TestBins(t *testing.T) {
+	rand.Seed(0)
+	s := New(32)
+	for i := 0; i < 10000; i++ {
+		s.Add(rand.Float64() * 10.0)
+	}
+	bins := s.Bins(10)
+	if len(bins) != 10 || bins[0].Lo != s.Min() || bins[9].Hi != s.Max() {
+		t.Fatalf("Want 10 bins covering [Min, Max], got %v", bins)
+	}
+	total := 0.0
+	for i, b := range bins {
+		total += b.Count
+		if i > 0 && b.Lo != bins[i-1].Hi {
+			t.Errorf("Want bin %v to start where bin %v ends, got %v and %v", i, i-1, b, bins[i-1])
+		}
+		if math.Abs(b.Count-1000.0) > 100.0 {
+			t.Errorf("Want about 1000 values in each bin of a uniform sample, got %v", b)
+		}
+	}
+	if math.Abs(total-s.Count()) > 1e-9 {
+		t.Errorf("Want bin counts to add up to %v, got %v", s.Count(), total)
+	}
+	one := New(4)
+	one.AddN(3.0, 5)
+	if got := one.Bins(2); got[0].Count+got[1].Count != 5.0 {
+		t.Errorf("Want bins of a single value to hold all 5 values, got %v", got)
+	}
+	if got := New(4).Bins(3); got != nil {
+		t.Errorf("Want nil Bins for empty sketch, got %v", got)
+	}
+}
+
+func TestFromBins(t *testing.T) {
+	rand.Seed(0)
+	s := New(64)
+	for i := 0; i < 10000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	bins := s.Bins(50)
+	f := FromBins(bins, 32)
+	if math.Abs(f.Count()-s.Count()) > 1e-6 || f.Min() != s.Min() || f.Max() != s.Max() {
+		t.Errorf("Want Count, Min, Max = %v, %v, %v from bins, got %v, %v, %v",
+			s.Count(), s.Min(), s.Max(), f.Count(), f.Min(), f.Max())
+	}
+	w := bins[0].Hi - bins[0].Lo
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		if e := math.Abs(f.Quantile(q) - s.Quantile(q)); e > w {
+			t.Errorf("Want Quantile(%v) from bins within a bin width (%v) of %v, got %v",
+				q, w, s.Quantile(q), f.Quantile(q))
+		}
+	}
+
+	// Prometheus-style buckets with open-ended ends.
+	p := FromBins([]Bin{
+		{math.Inf(-1), 0.0, 1.0},
+		{0.0, 1.0, 2.0},
+		{1.0, 2.0, 0.0},
+		{2.0, math.Inf(1), 1.0},
+	}, 8)
+	want := []Centroid{{0.0, 1.0}, {0.5, 2.0}, {2.0, 1.0}}
+	if got := p.Centroids(); !reflect.DeepEqual(got, want) || p.Min() != 0.0 || p.Max() != 2.0 {
+		t.Errorf("Want centroids %v in [0, 2], got %v in [%v, %v]", want, got, p.Min(), p.Max())
+	}
+	if e := FromBins(nil, 4); e.Count() != 0 || !math.IsNaN(e.Min()) {
+		t.Errorf("Want an empty sketch from no bins, got %v", *e)
+	}
+
+	// A bin as wide as the whole range of float64s still has a midpoint.
+	if w := FromBins([]Bin{{-math.MaxFloat64, math.MaxFloat64, 3.0}}, 4); w.Count() != 3.0 || w.Quantile(0.5) != 0.0 {
+		t.Errorf("Want 3 values at 0 from a bin spanning every float64, got %v", *w)
+	}
+	// A bin with no finite bound has nowhere to put its values.
+	u := FromBins([]Bin{{0.0, 1.0, 2.0}, {math.Inf(-1), math.Inf(1), 5.0}}, 4)
+	if u.Count() != 2.0 || u.Dropped() != 5.0 || u.Min() != 0.0 || u.Max() != 1.0 {
+		t.Errorf("Want Count 2, Dropped 5 in [0, 1] with an unbounded bin, got %v", *u)
+	}
+	for _, b := range []Bin{
+		{math.NaN(), 1.0, 1.0},
+		{0.0, math.NaN(), 1.0},
+		{1.0, 0.0, 1.0},
+		{0.0, 1.0, -1.0},
+		{0.0, 1.0, math.Inf(1)},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to FromBins with bin %v", b)
+				}
+			}()
+			FromBins([]Bin{b}, 4)
+		}()
+	}
+}
+
+func TestAddWeightedNegative(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected panic on call to AddWeighted with negative weight")
+		}
+	}()
+	New(4).AddWeighted(1.0, -1.0)
+}
+
+func TestAddWeightedInfinite(t *testing.T) {
+	h := New(4)
+	h.Add(1.0)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("Expected panic on call to AddWeighted with infinite weight")
+			}
+		}()
+		h.AddWeighted(2.0, math.Inf(1))
+	}()
+	if h.Count() != 1.0 || h.Validate() != nil {
+		t.Errorf("Want unchanged sketch after AddWeighted with infinite weight, got %v", h)
+	}
+}
+
+func TestSizeBytes(t *testing.T) {
+	if c := unsafe.Sizeof(centroid{}); c != 16 {
+		t.Errorf("Want 16-byte centroids, got %v", c)
+	}
+	for _, n := range []uint{1, 32, 1000} {
+		h := New(n)
+		want := int(unsafe.Sizeof(Sketch{})) + int(n+1)*16
+		if got := h.SizeBytes(); got != want {
+			t.Errorf("Want SizeBytes %v for an empty Sketch with %v centroids, got %v", want, n, got)
+		}
+		rand.Seed(0)
+		for i := 0; i < 10000; i++ {
+			h.Add(rand.NormFloat64())
+		}
+		if got := h.SizeBytes(); got != want {
+			t.Errorf("Want SizeBytes %v after adding values with %v centroids, got %v", want, n, got)
+		}
+	}
+
+	// Compare against what the runtime actually allocates, which can be a
+	// little more since allocations are rounded up to size classes.
+	const num = 1000
+	sketches := make([]*Sketch, num)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := range sketches {
+		sketches[i] = New(1000)
+	}
+	runtime.ReadMemStats(&after)
+	per := float64(after.TotalAlloc-before.TotalAlloc) / num
+	if size := float64(sketches[0].SizeBytes()); per < size || per > 1.1*size {
+		t.Errorf("Want about %v bytes allocated per Sketch, got %v", size, per)
+	}
+}
+
+func TestClone(t *testing.T) {
+	s := New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	want := fmt.Sprintf("%v", *s)
+	qs := s.Quantiles([]float64{0.01, 0.5, 0.99})
+	c := s.Clone()
+	if fmt.Sprintf("%v", *c) != want {
+		t.Errorf("Want %v for Clone, got %v", want, *c)
+	}
+	for i := 0; i < 1000; i++ {
+		c.Add(rand.NormFloat64() + 5.0)
+	}
+	if c.Count() != 2000.0 {
+		t.Errorf("Want 2000 for Count of Clone, got %v", c.Count())
+	}
+	if got := fmt.Sprintf("%v", *s); got != want {
+		t.Errorf("Want %v after adding to Clone, got %v", want, got)
+	}
+	for i, q := range s.Quantiles([]float64{0.01, 0.5, 0.99}) {
+		if q != qs[i] {
+			t.Errorf("Want unchanged quantiles after adding to Clone, got %v, want %v", q, qs[i])
+		}
+	}
+}
+
+func TestFork(t *testing.T) {
+	s := New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	want := fmt.Sprintf("%v", *s)
+	f := s.Fork()
+	if got := fmt.Sprintf("%v", *f); got != want {
+		t.Errorf("Want %v for Fork, got %v", want, got)
+	}
+	for i := 0; i < 1000; i++ {
+		f.Add(rand.NormFloat64() + 5.0)
+	}
+	if got := fmt.Sprintf("%v", *s); got != want {
+		t.Errorf("Want %v after adding to Fork, got %v", want, got)
+	}
+	if f.Count() != 2000.0 {
+		t.Errorf("Want 2000 for Count of Fork, got %v", f.Count())
+	}
+
+	// Changing the parent leaves a second fork alone.
+	g := s.Fork()
+	s.Scale(0.5)
+	s.Add(100.0)
+	if got := fmt.Sprintf("%v", *g); got != want {
+		t.Errorf("Want %v after changing parent of Fork, got %v", want, got)
+	}
+	s.Reset()
+	if got := fmt.Sprintf("%v", *g); got != want {
+		t.Errorf("Want %v after resetting parent of Fork, got %v", want, got)
+	}
+}
+
+func TestForkConcurrent(t *testing.T) {
+	s := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	want := fmt.Sprintf("%v", *s)
+	f := s.Fork()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			f.Add(float64(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if got := fmt.Sprintf("%v", *s); got != want {
+				t.Errorf("Want %v while adding to Fork, got %v", want, got)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// And the other way around: the fork is unaffected by writes to its parent.
+	want = fmt.Sprintf("%v", *f)
+	g := f.Fork()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			f.Add(-float64(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if got := fmt.Sprintf("%v", *g); got != want {
+				t.Errorf("Want %v while adding to parent of Fork, got %v", want, got)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestDeterministic(t *testing.T) {
+	build := func() []byte {
+		s := NewWithOptions(WithCentroids(16), WithDecay(0.999), WithMergeMetric(Relative))
+		rand.Seed(0)
+		for i := 0; i < 5000; i++ {
+			s.Add(rand.ExpFloat64())
+		}
+		s.AddBatch([]float64{1.0, 2.0, 2.0, 3.0})
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Want no error from MarshalBinary, got %v", err)
+		}
+		return b
+	}
+	if a, b := build(), build(); !bytes.Equal(a, b) {
+		t.Errorf("Want identical sketches from identical streams, got %v and %v", a, b)
+	}
+}
+
+// Compares a sketch against a golden copy, so that a change in how centroids
+// are merged, or a platform that computes them differently, shows up as a
+// failure. The values come from Float64, which is exact integer arithmetic,
+// rather than from ExpFloat64 or NormFloat64, which use math functions.
+func TestDeterministicGolden(t *testing.T) {
+	s := NewWithOptions(WithCentroids(8), WithDecay(0.999))
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		s.Add(r.Float64() * r.Float64() * 100)
+	}
+	want := "{centroids=8 count=864.8000746024984 min=0.0036145258796694735 max=92.77507740586324 dropped=0 " +
+		"[3.955302073263144:~252.91184079000138 14.617098838943626:~187.07119022261264 " +
+		"25.446387854916836:~148.35049916754753 36.83419955334555:~105.8656840063611 " +
+		"47.97977460430566:~65.95844376107809 58.621113528759295:~56.566797903260564 " +
+		"71.351559324865:~29.143010426829598 85.18061484828796:~18.932608324808747]}"
+	if got := s.String(); got != want {
+		t.Errorf("Want golden sketch\n%v\ngot\n%v", want, got)
+	}
+	x, err := Parse(want)
+	if err != nil {
+		t.Fatalf("Got error parsing golden sketch: %v", err)
+	}
+	x.AddWeighted(3.25, 2.5)
+	want = "{centroids=8 count=867.3000746024984 min=0.0036145258796694735 max=92.77507740586324 dropped=0 " +
+		"[3.9483984967582177:~255.41184079000138 14.617098838943626:~187.07119022261264 " +
+		"25.446387854916836:~148.35049916754753 36.83419955334555:~105.8656840063611 " +
+		"47.97977460430566:~65.95844376107809 58.621113528759295:~56.566797903260564 " +
+		"71.351559324865:~29.143010426829598 85.18061484828796:~18.932608324808747]}"
+	if got := x.String(); got != want {
+		t.Errorf("Want golden sketch after AddWeighted\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	s.Reset()
+	if got, want := fmt.Sprintf("%v", *s), fmt.Sprintf("%v", *New(8)); got != want {
+		t.Errorf("Want %v after Reset, got %v", want, got)
+	}
+	if s.capacity() != 8 {
+		t.Errorf("Want capacity 8 after Reset, got %v", s.capacity())
+	}
+	x := New(8)
+	for i := 0; i < 1000; i++ {
+		r := rand.NormFloat64()
+		s.Add(r)
+		x.Add(r)
+	}
+	if got, want := fmt.Sprintf("%v", *s), fmt.Sprintf("%v", *x); got != want {
+		t.Errorf("Want %v after Reset and Add, got %v", want, got)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	s := New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	if !s.Equal(s.Clone(), 0.0) {
+		t.Errorf("Want sketch to be Equal to its Clone")
+	}
+	c := s.Clone()
+	c.cs[3].p += 1e-10
+	if c.Equal(s, 0.0) || !c.Equal(s, 1e-9) {
+		t.Errorf("Want Equal to respect tolerance on centroid values")
+	}
+	c = s.Clone()
+	c.Add(s.Max() + 1.0)
+	if c.Equal(s, 1e-9) {
+		t.Errorf("Want sketches with different Count and Max to be unequal")
+	}
+	if New(8).Equal(New(16), 0.0) {
+		t.Errorf("Want empty sketches with different numbers of centroids to be unequal")
+	}
+	e, x := New(4), New(4)
+	e.AddMany(1.0, 2)
+	x.Add(0.5)
+	x.Add(1.5)
+	x.Merge(e)
+	e.Add(0.5)
+	e.Add(1.5)
+	if !e.Equal(x, 0.0) || !x.Equal(e, 0.0) {
+		t.Errorf("Want %v and %v to be Equal", *e, *x)
+	}
+	x.cs[0].m = -x.cs[0].m
+	if e.Equal(x, 10.0) {
+		t.Errorf("Want exact and merged centroids to be unequal")
+	}
+}
+
 func TestSumExact(t *testing.T) {
 	s := New(16)
 	for _, value := range []float64{1.0, 2.0, 3.0, 4.0, 4.0, 4.0, 5.0, 6.0} {
@@ -92,31 +1615,388 @@ func TestSumExact(t *testing.T) {
 	}
 }
 
-func TestQuantileExact(t *testing.T) {
-	s := New(16)
-	for _, value := range []float64{0.01, 0.1, 1.0, 2.0, 3.0, 4.0, 4.0, 4.0, 4.1, 4.2, 4.3, 4.3} {
-		s.Add(value)
-	}
-	if s.Quantile(0.0) != 0.01 {
-		t.Errorf("Want 0.01 for s.Quantile(0.0), got %v", s.Quantile(0.0))
+func TestSumClampedAndMonotonic(t *testing.T) {
+	for _, d := range []struct {
+		name string
+		dist func() float64
+		tol  float64
+	}{
+		{"uniform", rand.Float64, 0.03},
+		{"normal", rand.NormFloat64, 0.03},
+		// The density peaks at Min, where the interpolation assumes no
+		// weight, so Sum runs low there.
+		{"exponential", rand.ExpFloat64, 0.05},
+		// Lots of repeated values, so some centroids stay exact next to
+		// merged ones. Merged centroids here stand for spikes at integers,
+		// which the interpolation can't capture, so there's no error bound.
+		{"clumpy", func() float64 { return math.Floor(rand.ExpFloat64() * 4) }, 1.0},
+	} {
+		name, dist, tol := d.name, d.dist, d.tol
+		rand.Seed(0)
+		h, xs := New(32), []float64{}
+		for i := 0; i < 10000; i++ {
+			x := dist()
+			h.Add(x)
+			xs = append(xs, x)
+		}
+		sort.Float64s(xs)
+		exact := func(x float64) float64 {
+			return float64(sort.Search(len(xs), func(i int) bool { return xs[i] > x }))
+		}
+		if got := h.Sum(math.Nextafter(h.Min(), math.Inf(-1))); got != 0.0 {
+			t.Errorf("%v: want Sum just below Min to be 0, got %v", name, got)
+		}
+		if got := h.Sum(h.Min()); got > exact(h.Min()) {
+			t.Errorf("%v: want Sum(Min) at most %v, got %v", name, exact(h.Min()), got)
+		}
+		if got := h.Sum(h.Max()); got != h.Count() {
+			t.Errorf("%v: want Sum(Max) = Count %v, got %v", name, h.Count(), got)
+		}
+		if got := h.Sum(h.Max() + 1); got != h.Count() {
+			t.Errorf("%v: want Sum past Max = Count %v, got %v", name, h.Count(), got)
+		}
+		// Check at and right around every centroid, where the interpolation
+		// changes, as well as on an even grid.
+		ps := []float64{}
+		for i := 0; i <= 1000; i++ {
+			ps = append(ps, h.Min()+(h.Max()-h.Min())*float64(i)/1000)
+		}
+		for _, c := range h.Centroids() {
+			ps = append(ps, math.Nextafter(c.Value, math.Inf(-1)), c.Value, math.Nextafter(c.Value, math.Inf(1)))
+		}
+		sort.Float64s(ps)
+		prev := 0.0
+		for _, p := range ps {
+			got := h.Sum(p)
+			if got < prev {
+				t.Errorf("%v: want Sum to be non-decreasing, got %v after %v at %v", name, got, prev, p)
+			}
+			if got < 0 || got > h.Count() {
+				t.Errorf("%v: want Sum(%v) in [0, %v], got %v", name, p, h.Count(), got)
+			}
+			if want := exact(p); math.Abs(got-want) > tol*h.Count() {
+				t.Errorf("%v: want Sum(%v) within %v of %v, got %v", name, p, tol*h.Count(), want, got)
+			}
+			prev = got
+		}
+	}
+
+	// An exact centroid followed by a merged one used to make Sum drop just
+	// past the exact centroid.
+	s := New(3)
+	for _, x := range []float64{0, 10, 11, 12, 13} {
+		s.Add(x)
+	}
+	if a, b := s.Sum(0), s.Sum(0.001); a != 1.0 || b < a {
+		t.Errorf("Want Sum(0) = 1 <= Sum(0.001), got %v and %v", a, b)
+	}
+}
+
+func TestCDF(t *testing.T) {
+	s := New(16)
+	if !math.IsNaN(s.CDF(1.0)) {
+		t.Errorf("Want NaN for CDF of empty sketch, got %v", s.CDF(1.0))
+	}
+	rand.Seed(0)
+	for i := 0; i < 10000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	if s.CDF(s.Min()-1.0) != 0.0 {
+		t.Errorf("Want 0.0 for CDF below Min, got %v", s.CDF(s.Min()-1.0))
+	}
+	if s.CDF(s.Max()+1.0) != 1.0 {
+		t.Errorf("Want 1.0 for CDF above Max, got %v", s.CDF(s.Max()+1.0))
+	}
+	if e := math.Abs(s.CDF(0.0) - 0.5); e >= 0.02 {
+		t.Errorf("Got error %v for CDF(0.0) (got %v, want ~0.5)", e, s.CDF(0.0))
+	}
+	xs := []float64{1.5, -10.0, 0.0, 10.0, -1.0, 0.5, s.Min(), s.Max(), -0.5}
+	got := s.CDFs(xs)
+	for i, x := range xs {
+		if math.Abs(got[i]-s.CDF(x)) > 1e-12 {
+			t.Errorf("Want %v for CDFs entry for %v, got %v", s.CDF(x), x, got[i])
+		}
+	}
+}
+
+func TestPartialSum(t *testing.T) {
+	s := New(16)
+	if got := s.PartialSum(1.0); !math.IsNaN(got) {
+		t.Errorf("Want NaN for PartialSum of empty sketch, got %v", got)
+	}
+	for _, v := range []float64{1.0, 2.0, 3.0, 4.0, 4.0} {
+		s.Add(v)
+	}
+	for _, c := range []struct{ x, want float64 }{
+		{0.0, 0.0}, {1.0, 1.0}, {2.5, 3.0}, {4.0, 14.0}, {100.0, 14.0},
+	} {
+		if got := s.PartialSum(c.x); got != c.want {
+			t.Errorf("Want PartialSum(%v) = %v, got %v", c.x, c.want, got)
+		}
+	}
+
+	dists := []struct {
+		name string
+		dist func() float64
+	}{
+		{"uniform", rand.Float64},
+		{"normal", rand.NormFloat64},
+		{"exponential", rand.ExpFloat64},
+	}
+	for _, d := range dists {
+		rand.Seed(0)
+		s := New(32)
+		values := make([]float64, 10000)
+		for i := range values {
+			values[i] = d.dist()
+			s.Add(values[i])
+		}
+		if got, want := s.PartialSum(s.Max())/s.Count(), s.Mean(); math.Abs(got-want) > 1e-9 {
+			t.Errorf("Want PartialSum(Max)/Count = Mean = %v on %v, got %v", want, d.name, got)
+		}
+		sort.Float64s(values)
+		for _, q := range []float64{0.1, 0.5, 0.9} {
+			x := values[int(q*float64(len(values)))]
+			want := 0.0
+			for _, v := range values {
+				if v <= x {
+					want += v
+				}
+			}
+			if got := s.PartialSum(x); math.Abs(got-want) > 0.01*float64(len(values)) {
+				t.Errorf("Want PartialSum(%v) near %v on %v, got %v", x, want, d.name, got)
+			}
+		}
+		prev := math.Inf(-1)
+		if d.name != "normal" {
+			// With only non-negative values, PartialSum never decreases.
+			for i := 0; i <= 100; i++ {
+				x := s.Min() + float64(i)/100.0*(s.Max()-s.Min())
+				got := s.PartialSum(x)
+				if got < prev-1e-9 {
+					t.Errorf("Want PartialSum non-decreasing on %v, got %v then %v at %v", d.name, prev, got, x)
+				}
+				prev = got
+			}
+		}
+	}
+}
+
+func TestCountBetween(t *testing.T) {
+	s := New(16)
+	for _, value := range []float64{1.0, 2.0, 3.0, 4.0, 4.0, 4.0, 5.0, 6.0} {
+		s.Add(value)
+	}
+	if s.CountBetween(1.0, 6.0) != 7.0 {
+		t.Errorf("Want 7.0 for s.CountBetween(1.0, 6.0), got %v", s.CountBetween(1.0, 6.0))
+	}
+	if s.CountBetween(4.0, 4.5) != 3.0 {
+		t.Errorf("Want 3.0 for s.CountBetween(4.0, 4.5), got %v", s.CountBetween(4.0, 4.5))
+	}
+	if s.CountBetween(3.0, 4.0) != 1.0 {
+		t.Errorf("Want 1.0 for s.CountBetween(3.0, 4.0), got %v", s.CountBetween(3.0, 4.0))
+	}
+	if s.CountBetween(5.0, 2.0) != 0.0 {
+		t.Errorf("Want 0.0 for s.CountBetween(5.0, 2.0), got %v", s.CountBetween(5.0, 2.0))
+	}
+	if s.CountBetween(0.0, 100.0) != s.Count() {
+		t.Errorf("Want %v for s.CountBetween(0.0, 100.0), got %v", s.Count(), s.CountBetween(0.0, 100.0))
+	}
+
+	dists := map[string]func() float64{
+		"uniform":     rand.Float64,
+		"normal":      rand.NormFloat64,
+		"exponential": rand.ExpFloat64,
+	}
+	for name, dist := range dists {
+		rand.Seed(0)
+		s := New(32)
+		values := make([]float64, 10000)
+		for i := range values {
+			values[i] = dist()
+			s.Add(values[i])
+		}
+		if e := math.Abs(s.CountBetween(s.Min(), s.Max())-s.Count()) / s.Count(); e > 0.001 {
+			t.Errorf("Got error %v for CountBetween(Min, Max) on %v (got %v, want ~%v)",
+				e, name, s.CountBetween(s.Min(), s.Max()), s.Count())
+		}
+		for _, q := range [][]float64{{0.1, 0.5}, {0.25, 0.75}, {0.05, 0.95}, {0.5, 0.9}} {
+			a, b := s.Quantile(q[0]), s.Quantile(q[1])
+			want := 0.0
+			for _, v := range values {
+				if a <= v && v < b {
+					want += 1
+				}
+			}
+			if e := math.Abs(s.CountBetween(a, b)-want) / want; e >= 0.05 {
+				t.Errorf("Got error %v for CountBetween(%v, %v) on %v (got %v, want %v)",
+					e, a, b, name, s.CountBetween(a, b), want)
+			}
+		}
+	}
+}
+
+func TestRankQuantileRoundTrip(t *testing.T) {
+	for seed := 0; seed < 10; seed++ {
+		s := New(32)
+		rand.Seed(int64(seed))
+		for i := 0; i < 10000; i++ {
+			s.Add(rand.NormFloat64())
+		}
+		for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+			if e := math.Abs(s.Rank(s.Quantile(q)) - q); e >= 0.001 {
+				t.Errorf("Got error %v for Rank(Quantile(%v)) (got %v with seed = %v)",
+					e, q, s.Rank(s.Quantile(q)), seed)
+			}
+		}
+	}
+}
+
+func TestQuantileExact(t *testing.T) {
+	s := New(16)
+	for _, value := range []float64{0.01, 0.1, 1.0, 2.0, 3.0, 4.0, 4.0, 4.0, 4.1, 4.2, 4.3, 4.3} {
+		s.Add(value)
+	}
+	if s.Quantile(0.0) != 0.01 {
+		t.Errorf("Want 0.01 for s.Quantile(0.0), got %v", s.Quantile(0.0))
+	}
+	if s.Quantile(0.25) != 2.0 {
+		t.Errorf("Want 2.0 for s.Quantile(0.25), got %v", s.Quantile(0.25))
+	}
+	if s.Quantile(0.5) != 4.0 {
+		t.Errorf("Want 4.0 for s.Quantile(0.5), got %v", s.Quantile(0.5))
+	}
+	if s.Quantile(0.75) != 4.2 {
+		t.Errorf("Want 4.2 for s.Quantile(0.75), got %v", s.Quantile(0.75))
+	}
+	if s.Quantile(1.0) != 4.3 {
+		t.Errorf("Want 4.3 for s.Quantile(1.0), got %v", s.Quantile(1.0))
+	}
+	qs := []float64{0.001, 0.01, 0.1, 0.2, 0.4, 0.49, 0.5, 0.51, 0.75, 0.8, 0.9, 0.99, 0.999, 0.9999}
+	for i := 1; i < len(qs); i++ {
+		if s.Quantile(qs[i-1]) > s.Quantile(qs[i]) {
+			t.Errorf("Want monotonic non-decreasing quantiles, got s.Quantile(%v) = %v and "+
+				"s.Quantile(%v) = %v", qs[i-1], s.Quantile(qs[i-1]), qs[i], s.Quantile(qs[i]))
+		}
+	}
+}
+
+func TestQuantileWithinMinMax(t *testing.T) {
+	for _, method := range []QuantileMethod{Linear, NearestRank} {
+		for seed := 0; seed < 20; seed++ {
+			rand.Seed(int64(seed))
+			s := NewWithOptions(WithCentroids(8), WithQuantileMethod(method))
+			// Values packed close together near 1 make rounding in merged
+			// centroid values most likely to land outside of [Min, Max].
+			for i := 0; i < 1000; i++ {
+				s.Add(1.0 - rand.Float64()*1e-12)
+			}
+			qs := make([]float64, 1001)
+			for i := range qs {
+				qs[i] = float64(i) / 1000.0
+			}
+			for i, q := range s.Quantiles(qs) {
+				if v := s.Quantile(qs[i]); v < s.Min() || v > s.Max() {
+					t.Errorf("Want Quantile(%v) in [%v, %v], got %v", qs[i], s.Min(), s.Max(), v)
+				}
+				if q < s.Min() || q > s.Max() {
+					t.Errorf("Want Quantiles value for %v in [%v, %v], got %v", qs[i], s.Min(), s.Max(), q)
+				}
+			}
+		}
+	}
+}
+
+func TestConditionalQuantile(t *testing.T) {
+	s := New(16)
+	if got := s.ConditionalQuantile(0.5, 0.0, 1.0); !math.IsNaN(got) {
+		t.Errorf("Want NaN for ConditionalQuantile of empty sketch, got %v", got)
+	}
+	for i := 1; i <= 10; i++ {
+		s.Add(float64(i))
+	}
+	for _, c := range []struct{ q, lo, hi, want float64 }{
+		{0.5, 3, 6, 5}, {0.0, 3, 6, 3}, {1.0, 3, 6, 6}, {0.25, 3, 6, 4},
+		{0.5, -100, 100, s.Quantile(0.5)}, {0.5, 2.5, 2.5, math.NaN()},
+		{0.5, 6, 3, math.NaN()},
+	} {
+		got := s.ConditionalQuantile(c.q, c.lo, c.hi)
+		if got != c.want && !(math.IsNaN(got) && math.IsNaN(c.want)) {
+			t.Errorf("Want ConditionalQuantile(%v, %v, %v) = %v, got %v", c.q, c.lo, c.hi, c.want, got)
+		}
+	}
+
+	rand.Seed(0)
+	s = New(32)
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = rand.NormFloat64()
+		s.Add(values[i])
+	}
+	sort.Float64s(values)
+	for _, w := range [][]float64{{-1, 1}, {0, 2}, {math.Inf(-1), 0.5}, {-0.5, math.Inf(1)}} {
+		window := []float64{}
+		for _, v := range values {
+			if w[0] <= v && v <= w[1] {
+				window = append(window, v)
+			}
+		}
+		for _, q := range []float64{0.05, 0.25, 0.5, 0.75, 0.95} {
+			want := window[int(q*float64(len(window)))]
+			if got := s.ConditionalQuantile(q, w[0], w[1]); math.Abs(got-want) > 0.05 {
+				t.Errorf("Want ConditionalQuantile(%v, %v, %v) near %v, got %v", q, w[0], w[1], want, got)
+			}
+		}
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic on call to ConditionalQuantile(1.5, 0, 1)")
+			}
+		}()
+		s.ConditionalQuantile(1.5, 0, 1)
+	}()
+}
+
+func TestSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	if got := New(8).Sample(rng); !math.IsNaN(got) {
+		t.Errorf("Want NaN for Sample of empty sketch, got %v", got)
 	}
-	if s.Quantile(0.25) != 2.0 {
-		t.Errorf("Want 2.0 for s.Quantile(0.25), got %v", s.Quantile(0.25))
+	s := New(32)
+	for i := 0; i < 10000; i++ {
+		s.Add(rng.NormFloat64())
 	}
-	if s.Quantile(0.5) != 4.0 {
-		t.Errorf("Want 4.0 for s.Quantile(0.5), got %v", s.Quantile(0.5))
+	x, y := New(32), New(32)
+	for i := 0; i < 10000; i++ {
+		v := s.Sample(rng)
+		if v < s.Min() || v > s.Max() {
+			t.Errorf("Want Sample in [%v, %v], got %v", s.Min(), s.Max(), v)
+		}
+		x.Add(v)
 	}
-	if s.Quantile(0.75) != 4.2 {
-		t.Errorf("Want 4.2 for s.Quantile(0.75), got %v", s.Quantile(0.75))
+	vs := s.SampleN(rng, 10000)
+	if len(vs) != 10000 {
+		t.Errorf("Want 10000 values from SampleN, got %v", len(vs))
 	}
-	if s.Quantile(1.0) != 4.3 {
-		t.Errorf("Want 4.3 for s.Quantile(1.0), got %v", s.Quantile(1.0))
+	y.AddBatch(vs)
+	for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+		want := s.Quantile(q)
+		if got := x.Quantile(q); math.Abs(got-want) > 0.1 {
+			t.Errorf("Want Quantile(%v) near %v after resampling, got %v", q, want, got)
+		}
+		if got := y.Quantile(q); math.Abs(got-want) > 0.1 {
+			t.Errorf("Want Quantile(%v) near %v after resampling with SampleN, got %v", q, want, got)
+		}
 	}
-	qs := []float64{0.001, 0.01, 0.1, 0.2, 0.4, 0.49, 0.5, 0.51, 0.75, 0.8, 0.9, 0.99, 0.999, 0.9999}
-	for i := 1; i < len(qs); i++ {
-		if s.Quantile(qs[i-1]) > s.Quantile(qs[i]) {
-			t.Errorf("Want monotonic non-decreasing quantiles, got s.Quantile(%v) = %v and "+
-				"s.Quantile(%v) = %v", qs[i-1], s.Quantile(qs[i-1]), qs[i], s.Quantile(qs[i]))
+
+	// Values known exactly are drawn exactly.
+	e := New(8)
+	e.AddWeighted(1.0, 3.0)
+	e.AddWeighted(2.0, 1.0)
+	for _, v := range e.SampleN(rng, 1000) {
+		if v != 1.0 && v != 2.0 {
+			t.Errorf("Want only exact values from SampleN, got %v", v)
 		}
 	}
 }
@@ -147,6 +2027,512 @@ func TestQuantileArgTooLarge(t *testing.T) {
 	s.Quantile(1.1)
 }
 
+func TestMedian(t *testing.T) {
+	s := New(16)
+	if !math.IsNaN(s.Median()) {
+		t.Errorf("Want NaN for Median of empty sketch, got %v", s.Median())
+	}
+	for seed := 0; seed < 10; seed++ {
+		rand.Seed(int64(seed))
+		s := New(16)
+		n := 1 + rand.Intn(1000)
+		for i := 0; i < n; i++ {
+			s.Add(rand.NormFloat64())
+		}
+		if s.Median() != s.Quantile(0.5) {
+			t.Errorf("Want Median() == Quantile(0.5), got %v and %v (seed = %v)",
+				s.Median(), s.Quantile(0.5), seed)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	s := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	for _, c := range []struct{ p, q float64 }{
+		{95, 0.95}, {50, 0.5}, {99.9, 0.999}, {0, 0}, {100, 1}, {-5, 0}, {250, 1},
+	} {
+		if got, want := s.Percentile(c.p), s.Quantile(c.q); got != want {
+			t.Errorf("Want Percentile(%v) = Quantile(%v) = %v, got %v", c.p, c.q, want, got)
+		}
+	}
+	if got := s.Percentile(math.NaN()); !math.IsNaN(got) {
+		t.Errorf("Want NaN for Percentile(NaN), got %v", got)
+	}
+	if got := New(16).Percentile(95); !math.IsNaN(got) {
+		t.Errorf("Want NaN for Percentile on an empty Sketch, got %v", got)
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	s := New(16)
+	qs := []float64{0.99, 0.5, -1.0, 0.9, 0.0, 0.999, 2.0, 0.25}
+	for _, got := range s.Quantiles(qs) {
+		if !math.IsNaN(got) {
+			t.Errorf("Want NaN for Quantiles of empty sketch, got %v", got)
+		}
+	}
+	rand.Seed(0)
+	for i := 0; i < 10000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	got := s.Quantiles(qs)
+	if len(got) != len(qs) {
+		t.Fatalf("Want %v results from Quantiles, got %v", len(qs), len(got))
+	}
+	for i, q := range qs {
+		want := s.Quantile(math.Min(math.Max(q, 0.0), 1.0))
+		if got[i] != want {
+			t.Errorf("Want %v for Quantiles entry for %v, got %v", want, q, got[i])
+		}
+	}
+}
+
+func TestQuantilesNaN(t *testing.T) {
+	for _, m := range []QuantileMethod{Linear, NearestRank} {
+		s := NewWithOptions(WithCentroids(16), WithQuantileMethod(m))
+		for i := 0; i < 1000; i++ {
+			s.Add(float64(i))
+		}
+		for _, qs := range [][]float64{
+			{0.1, math.NaN(), 0.5},
+			{0.9, math.NaN(), 0.5, math.NaN()},
+			{math.NaN()},
+		} {
+			got := s.Quantiles(qs)
+			sum := s.Summary(qs)
+			for i, q := range qs {
+				want := math.NaN()
+				if !math.IsNaN(q) {
+					want = s.Quantile(q)
+				}
+				if !(got[i] == want || math.IsNaN(got[i]) && math.IsNaN(want)) {
+					t.Errorf("Want %v for Quantiles entry for %v in %v, got %v", want, q, qs, got[i])
+				}
+				if !(sum.Quantiles[i] == want || math.IsNaN(sum.Quantiles[i]) && math.IsNaN(want)) {
+					t.Errorf("Want %v for Summary quantile %v in %v, got %v", want, q, qs, sum.Quantiles[i])
+				}
+			}
+		}
+	}
+}
+
+func TestCountCompensated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping 10^8 adds in short mode")
+	}
+	s := New(4)
+	naive := 0.0
+	for i := 0; i < 100000000; i++ {
+		s.AddWeighted(float64(i%4), 1e-8)
+		naive += 1e-8
+	}
+	if got := s.Count(); math.Abs(got-1.0) > 1e-15 {
+		t.Errorf("Want Count within 1e-15 of 1 after 10^8 weights of 1e-8, got %v (naive sum %v)", got, naive)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Want valid sketch after 10^8 small weights, got %v", err)
+	}
+}
+
+func TestAddDuplicates(t *testing.T) {
+	s := New(16)
+	for i := 0; i < 1000000; i++ {
+		// -0 == 0, so these are duplicates too.
+		s.Add(math.Copysign(0, float64(i%2)-0.5))
+	}
+	if got := len(s.Centroids()); got != 1 {
+		t.Errorf("Want 1 centroid after adding 1M copies of 0, got %v", got)
+	}
+	if got := s.Count(); got != 1000000 {
+		t.Errorf("Want Count 1000000, got %v", got)
+	}
+	if got := s.Quantile(0.5); got != 0 {
+		t.Errorf("Want Quantile(0.5) = 0, got %v", got)
+	}
+	values := make([]float64, 1000000)
+	for i := range values {
+		values[i] = 7
+	}
+	b := New(batchMinCapacity)
+	b.AddBatch(values)
+	if got := len(b.Centroids()); got != 1 {
+		t.Errorf("Want 1 centroid after adding a batch of 1M copies of 7, got %v", got)
+	}
+	// The rest of the budget is still free for distinct values.
+	for i := 1; i <= 15; i++ {
+		s.Add(float64(i))
+	}
+	cs := s.Centroids()
+	if len(cs) != 16 || cs[0].Value != 0 || cs[0].Weight != 1000000 {
+		t.Errorf("Want 0 still in its own centroid among 16 exact centroids, got %v", cs)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	qs := []float64{0.99, 0.5, -1.0, 0.25}
+	got := New(16).Summary(qs)
+	if got.Count != 0 || !math.IsNaN(got.Min) || !math.IsNaN(got.Max) || !math.IsNaN(got.Mean) {
+		t.Errorf("Want 0 count and NaN min, max and mean for Summary of empty sketch, got %+v", got)
+	}
+	for _, s := range []*Sketch{New(16), NewWithOptions(WithCentroids(16), WithBufferFactor(2))} {
+		rand.Seed(0)
+		for i := 0; i < 10000; i++ {
+			s.Add(rand.ExpFloat64())
+		}
+		got := s.Summary(qs)
+		if got.Count != s.Count() || got.Min != s.Min() || got.Max != s.Max() || got.Mean != s.Mean() {
+			t.Errorf("Want count %v, min %v, max %v and mean %v from Summary, got %+v",
+				s.Count(), s.Min(), s.Max(), s.Mean(), got)
+		}
+		want := s.Quantiles(qs)
+		if len(got.Quantiles) != len(want) {
+			t.Fatalf("Want %v quantiles from Summary, got %v", len(want), len(got.Quantiles))
+		}
+		for i := range want {
+			if got.Quantiles[i] != want[i] {
+				t.Errorf("Want %v for Summary quantile %v, got %v", want[i], qs[i], got.Quantiles[i])
+			}
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	rand.Seed(0)
+	x := New(10000) // This histogram will be exact.
+	shards := []*Sketch{New(32), New(32), New(32), New(32)}
+	for i := 0; i < 10000; i++ {
+		r := rand.NormFloat64() + float64(i%4)
+		shards[i%4].Add(r)
+		x.Add(r)
+	}
+	forward, backward := New(32), New(32)
+	for i := range shards {
+		if err := forward.Merge(shards[i]); err != nil {
+			t.Errorf("Got error merging sketches: %v", err)
+		}
+		if err := backward.Merge(shards[len(shards)-1-i]); err != nil {
+			t.Errorf("Got error merging sketches: %v", err)
+		}
+	}
+	for _, s := range []*Sketch{forward, backward} {
+		if s.Count() != x.Count() {
+			t.Errorf("Want %v for Count after Merge, got %v", x.Count(), s.Count())
+		}
+		if s.Min() != x.Min() || s.Max() != x.Max() {
+			t.Errorf("Want Min, Max = %v, %v after Merge, got %v, %v",
+				x.Min(), x.Max(), s.Min(), s.Max())
+		}
+		if len(s.cs) > 32 {
+			t.Errorf("Want at most 32 centroids after Merge, got %v", len(s.cs))
+		}
+	}
+	for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+		if e := math.Abs(forward.Quantile(q)-backward.Quantile(q)) / x.Quantile(q); e >= 0.02 {
+			t.Errorf("Got difference %v between merge orders for Quantile(%v) (%v vs. %v)",
+				e, q, forward.Quantile(q), backward.Quantile(q))
+		}
+		if e := math.Abs(forward.Quantile(q)-x.Quantile(q)) / x.Quantile(q); e >= 0.05 {
+			t.Errorf("Got error %v for Quantile(%v) after Merge (got %v, want %v)",
+				e, q, forward.Quantile(q), x.Quantile(q))
+		}
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	// Values that are still exact are removed exactly.
+	a, b := New(16), New(16)
+	for _, v := range []float64{1, 2, 3, 4} {
+		a.Add(v)
+	}
+	want := fmt.Sprintf("%v", *a)
+	for _, v := range []float64{0, 2, 5} {
+		b.Add(v)
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Want no error from Merge, got %v", err)
+	}
+	if err := a.Subtract(b); err != nil {
+		t.Errorf("Want no error from Subtract, got %v", err)
+	}
+	if got := fmt.Sprintf("%v", *a); got != want {
+		t.Errorf("Want %v after Subtract, got %v", want, got)
+	}
+
+	// Subtracting an old window from merged windows leaves about the
+	// newer one.
+	old, cur, sum := New(32), New(32), New(32)
+	rand.Seed(0)
+	for i := 0; i < 10000; i++ {
+		old.Add(rand.NormFloat64())
+		cur.Add(rand.NormFloat64() + 3.0)
+	}
+	sum.Merge(old)
+	sum.Merge(cur)
+	if err := sum.Subtract(old); err != nil {
+		t.Errorf("Want no error from Subtract, got %v", err)
+	}
+	if math.Abs(sum.Count()-10000.0) > 1e-6 {
+		t.Errorf("Want Count 10000 after Subtract, got %v", sum.Count())
+	}
+	if err := sum.Validate(); err != nil {
+		t.Errorf("Want no error from Validate after Subtract, got %v", err)
+	}
+	for _, q := range []float64{0.1, 0.25, 0.5, 0.75, 0.9} {
+		if got, want := sum.Quantile(q), cur.Quantile(q); math.Abs(got-want) > 0.1 {
+			t.Errorf("Want Quantile(%v) within 0.1 of %v after Subtract, got %v", q, want, got)
+		}
+	}
+
+	// Subtracting more than is there removes everything it can.
+	if err := old.Subtract(cur); err == nil {
+		t.Errorf("Want error subtracting more weight than the Sketch has")
+	}
+	if old.Count() < 0 || old.Validate() != nil {
+		t.Errorf("Want a valid Sketch after subtracting too much, got %v", *old)
+	}
+	if err := cur.Subtract(cur.Clone()); err != nil || cur.Count() != 0 || len(cur.cs) != 0 {
+		t.Errorf("Want an empty Sketch after subtracting itself, got %v (error %v)", *cur, err)
+	}
+
+	// Like Merge, Subtract takes sketches with any maximum number of
+	// centroids, so it can undo merging a coarser window into a finer sum.
+	coarse, fine, total := New(8), New(64), New(64)
+	for i := 0; i < 10000; i++ {
+		coarse.Add(rand.NormFloat64())
+		fine.Add(rand.NormFloat64() + 3.0)
+	}
+	total.Merge(coarse)
+	total.Merge(fine)
+	if err := total.Subtract(coarse); err != nil {
+		t.Errorf("Want no error subtracting a Sketch with a different number of centroids, got %v", err)
+	}
+	if math.Abs(total.Count()-10000.0) > 1e-6 || total.Validate() != nil {
+		t.Errorf("Want a valid Sketch with Count 10000 after Subtract, got %v", total)
+	}
+	for _, q := range []float64{0.25, 0.5, 0.75} {
+		if got, want := total.Quantile(q), fine.Quantile(q); math.Abs(got-want) > 0.1 {
+			t.Errorf("Want Quantile(%v) within 0.1 of %v after Subtract, got %v", q, want, got)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	s := New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	want := s.Centroids()
+	min, max := s.Min(), s.Max()
+
+	// Growing keeps the centroids and makes room for more.
+	s.Resize(32)
+	if s.capacity() != 32 || !reflect.DeepEqual(s.Centroids(), want) {
+		t.Errorf("Want the same centroids with room for 32 after growing, got %v", *s)
+	}
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	if len(s.cs) != 32 || s.Count() != 2000 {
+		t.Errorf("Want 32 centroids and Count 2000 after adding to a grown sketch, got %v", *s)
+	}
+
+	// Shrinking compresses right away.
+	s.Resize(4)
+	if s.capacity() != 4 || len(s.cs) != 4 || s.Count() != 2000 {
+		t.Errorf("Want 4 centroids and Count 2000 after shrinking, got %v", *s)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Want no error from Validate after shrinking, got %v", err)
+	}
+	if q := s.Quantile(0.5); math.Abs(q) > 0.2 {
+		t.Errorf("Want median near 0 after shrinking, got %v", q)
+	}
+	if s.Min() != min || s.Max() < max {
+		t.Errorf("Want Min %v and Max at least %v after shrinking, got %v and %v", min, max, s.Min(), s.Max())
+	}
+	if err := s.Merge(New(4)); err != nil {
+		t.Errorf("Want no error merging with a sketch of the new size, got %v", err)
+	}
+
+	// Resizing a fork leaves the original alone.
+	x := New(8)
+	for i := 0; i < 100; i++ {
+		x.Add(float64(i))
+	}
+	xs := fmt.Sprintf("%v", *x)
+	f := x.Fork()
+	f.Resize(2)
+	if got := fmt.Sprintf("%v", *x); got != xs || len(f.cs) != 2 || f.Count() != 100 {
+		t.Errorf("Want %v unchanged after resizing Fork, got %v", xs, got)
+	}
+	for _, n := range []uint{0, maxCentroids + 1} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to Resize(%v)", n)
+				}
+			}()
+			s.Resize(n)
+		}()
+	}
+}
+
+func TestMergeDifferentCapacities(t *testing.T) {
+	rand.Seed(0)
+	x := New(10000) // This histogram will be exact.
+	coarse, fine := New(16), New(64)
+	for i := 0; i < 10000; i++ {
+		r := rand.NormFloat64()
+		if i%2 == 0 {
+			coarse.Add(r)
+		} else {
+			fine.Add(r)
+		}
+		x.Add(r)
+	}
+	// The coarse half limits how accurate the merged sketch can be, since
+	// each of its centroids keeps all of its weight at one point among the
+	// lighter centroids of the fine half.
+	var ce float64
+	for q := 0.01; q < 1.0; q += 0.01 {
+		ce += math.Abs(x.Rank(coarse.Quantile(q))-q) / 99.0
+	}
+	if err := fine.Merge(coarse); err != nil {
+		t.Fatalf("Got error merging a 16-centroid sketch into a 64-centroid sketch: %v", err)
+	}
+	if fine.Count() != x.Count() || fine.Min() != x.Min() || fine.Max() != x.Max() {
+		t.Errorf("Want Count, Min, Max = %v, %v, %v after Merge, got %v, %v, %v",
+			x.Count(), x.Min(), x.Max(), fine.Count(), fine.Min(), fine.Max())
+	}
+	if len(fine.cs) > 64 {
+		t.Errorf("Want at most 64 centroids after Merge, got %v", len(fine.cs))
+	}
+	var e float64
+	for q := 0.01; q < 1.0; q += 0.01 {
+		e += math.Abs(x.Rank(fine.Quantile(q))-q) / 99.0
+	}
+	if e >= 0.01 || e > 3*ce {
+		t.Errorf("Got mean rank error %v after merging a 16-centroid sketch into a 64-centroid sketch, "+
+			"%v for the 16-centroid sketch alone", e, ce)
+	}
+	// Merging a finer sketch into a coarser one compresses it down.
+	if err := coarse.Merge(x); err != nil {
+		t.Fatalf("Got error merging a 10000-centroid sketch into a 16-centroid sketch: %v", err)
+	}
+	if len(coarse.cs) > 16 || coarse.Count() != 15000 {
+		t.Errorf("Want at most 16 centroids and Count 15000 after Merge, got %v and %v",
+			len(coarse.cs), coarse.Count())
+	}
+}
+
+func TestCompress(t *testing.T) {
+	for seed := 0; seed < 10; seed++ {
+		rand.Seed(int64(seed))
+		cs := make([]centroid, 0, 500)
+		for i := 0; i < 500; i++ {
+			// Round values so that there are some ties between gaps.
+			cs = append(cs, centroid{math.Round(rand.NormFloat64()*100) + float64(i)*1000, 1})
+		}
+		want := append([]centroid{}, cs...)
+		for len(want) > 20 {
+			want = mergeClosest(want, Absolute)
+		}
+		got := compress(cs, 20, Absolute)
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", want) {
+			t.Errorf("Want %v, got %v (seed = %v)", want, got, seed)
+		}
+	}
+}
+
+func TestMergeMany(t *testing.T) {
+	rand.Seed(0)
+	x := New(10000) // This histogram will be exact.
+	folded := New(32)
+	shards := []*Sketch{}
+	for i := 0; i < 20; i++ {
+		shards = append(shards, New(32))
+	}
+	for i := 0; i < 10000; i++ {
+		r := rand.ExpFloat64()
+		shards[i%len(shards)].Add(r)
+		x.Add(r)
+	}
+	for _, shard := range shards {
+		folded.Merge(shard)
+	}
+	s, err := MergeMany(shards, 32)
+	if err != nil {
+		t.Fatalf("Got error from MergeMany: %v", err)
+	}
+	if s.Count() != x.Count() || s.Min() != x.Min() || s.Max() != x.Max() {
+		t.Errorf("Want Count, Min, Max = %v, %v, %v after MergeMany, got %v, %v, %v",
+			x.Count(), x.Min(), x.Max(), s.Count(), s.Min(), s.Max())
+	}
+	// Compare rank errors of MergeMany and repeated Merge against the exact
+	// histogram, they should be in the same ballpark.
+	se, fe := 0.0, 0.0
+	for i := 1; i < 100; i++ {
+		q := float64(i) / 100.0
+		se += math.Abs(x.Rank(s.Quantile(q))-q) / 99.0
+		fe += math.Abs(x.Rank(folded.Quantile(q))-q) / 99.0
+	}
+	if se >= 0.01 || se > 2*fe {
+		t.Errorf("Got mean rank error %v for MergeMany, %v for repeated Merge", se, fe)
+	}
+	if m, err := MergeMany([]*Sketch{shards[0], New(16), x}, 32); err != nil || m.Count() != shards[0].Count()+x.Count() {
+		t.Errorf("Want Count %v from MergeMany on sketches with different numbers of centroids, got %v, %v",
+			shards[0].Count()+x.Count(), m, err)
+	}
+	if e, err := MergeMany(nil, 8); err != nil || e.Count() != 0 {
+		t.Errorf("Want empty sketch from MergeMany with no inputs, got %v, %v", e, err)
+	}
+	if _, err := MergeMany([]*Sketch{shards[0], nil}, 8); err == nil {
+		t.Error("Expected error from MergeMany with a nil input")
+	}
+	if _, err := MergeMany(shards, maxCentroids+1); err == nil {
+		t.Errorf("Expected error from MergeMany with %v centroids", maxCentroids+1)
+	}
+}
+
+func TestMergeInto(t *testing.T) {
+	rand.Seed(0)
+	a, b := New(32), New(32)
+	for i := 0; i < 1000; i++ {
+		a.Add(rand.NormFloat64())
+		b.Add(rand.ExpFloat64())
+	}
+	b.AddWeighted(math.NaN(), 3)
+	want := a.Clone()
+	if err := want.Merge(b); err != nil {
+		t.Fatalf("Got error from Merge: %v", err)
+	}
+	dst := New(32)
+	for i := 0; i < 100; i++ {
+		dst.Add(float64(i))
+	}
+	if err := MergeInto(dst, a, b); err != nil {
+		t.Fatalf("Got error from MergeInto: %v", err)
+	}
+	if !dst.Equal(want, 0) || dst.Dropped() != want.Dropped() {
+		t.Errorf("Want %v after MergeInto, got %v", want, dst)
+	}
+	// dst can also be one of the inputs.
+	if err := MergeInto(a, a, b); err != nil {
+		t.Fatalf("Got error from MergeInto: %v", err)
+	}
+	if !a.Equal(want, 0) {
+		t.Errorf("Want %v after MergeInto(a, a, b), got %v", want, a)
+	}
+	if err := MergeInto(dst, a, New(16)); err != nil || !dst.Equal(a, 0) {
+		t.Errorf("Want %v from MergeInto with an empty 16-centroid sketch, got %v (error %v)", a, dst, err)
+	}
+}
+
 func TestGaussianSums(t *testing.T) {
 	// The relative errors here are just some arbitrary benchmarks on fixed seeds.
 	// Adjusting the error or domain tested is fine, they're just meant to be
@@ -224,67 +2610,375 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+func TestOptimalDecomposition(t *testing.T) {
+	// Sum of squared distances from each value to its closest centroid.
+	sse := func(values []float64, cs []Centroid) float64 {
+		total := 0.0
+		for _, v := range values {
+			best := math.Inf(1)
+			for _, c := range cs {
+				best = math.Min(best, (v-c.Value)*(v-c.Value))
+			}
+			total += best
+		}
+		return total
+	}
+	for seed := 0; seed < 5; seed++ {
+		rand.Seed(int64(seed))
+		sample := make([]float64, 500)
+		for i := range sample {
+			sample[i] = rand.ExpFloat64()
+		}
+		orig := make([]float64, len(sample))
+		copy(orig, sample)
+		streamed := New(8)
+		for _, v := range sample {
+			streamed.Add(v)
+		}
+		cs := OptimalDecomposition(sample, 8)
+		if !reflect.DeepEqual(sample, orig) {
+			t.Errorf("Want sample unchanged by OptimalDecomposition")
+		}
+		if len(cs) != 8 {
+			t.Errorf("Want 8 centroids, got %v", cs)
+		}
+		total := 0.0
+		for _, c := range cs {
+			total += c.Weight
+		}
+		if total != 500 {
+			t.Errorf("Want total weight 500, got %v", total)
+		}
+		if got, streaming := sse(sample, cs), sse(sample, streamed.Centroids()); got > streaming {
+			t.Errorf("Want squared error of optimal decomposition at most %v from streaming, got %v", streaming, got)
+		}
+	}
+	if got := OptimalDecomposition([]float64{}, 4); len(got) != 0 {
+		t.Errorf("Want no centroids for empty sample, got %v", got)
+	}
+	if got, want := OptimalDecomposition([]float64{3, 1, 3}, 4), []Centroid{{1, 1}, {3, 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+	for _, f := range []func(){
+		func() { OptimalDecomposition([]float64{1}, 0) },
+		func() { OptimalDecomposition([]float64{1, math.NaN()}, 2) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on bad call to OptimalDecomposition")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
 func TestOptimalOneDataPoint(t *testing.T) {
-	got := NewFromSample([]float64{ 1.0 }, 1)
-	want := "&{[{1 1}] 1 1 1}"
+	got, _ := NewFromSample([]float64{ 1.0 }, 1)
+	want := "{centroids=1 count=1 min=1 max=1 dropped=0 [1:1]}"
 	if fmt.Sprintf("%v", got) != want {
 		t.Errorf("Want %v, got %v", want, got)
 	}
 }
 
 func TestOptimalOneCentroid(t *testing.T) {
-	got := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 5.0 }, 1)
-	want := "&{[{3 -5}] 5 1 5}"
+	got, _ := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 5.0 }, 1)
+	want := "{centroids=1 count=5 min=1 max=5 dropped=0 [3:~5]}"
 	if fmt.Sprintf("%v", got) != want {
 		t.Errorf("Want %v, got %v", want, got)
 	}
 }
 
 func TestOptimalTwoCentroids(t *testing.T) {
-	got := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 5.0, 6.0 }, 2)
-	want := "&{[{2 -3} {5 -3}] 6 1 6}"
+	got, _ := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 5.0, 6.0 }, 2)
+	want := "{centroids=2 count=6 min=1 max=6 dropped=0 [2:~3 5:~3]}"
 	if fmt.Sprintf("%v", got) != want {
 		t.Errorf("Want %v, got %v", want, got)
 	}
 }
 
 func TestOptimalTwoCentroidsSkewed(t *testing.T) {
-	got := NewFromSample([]float64{ 1.0, 7.0, 7.0, 8.0, 8.0, 9.0, 9.0 }, 2)
-	want := "&{[{1 1} {8 -6}] 7 1 9}"
+	got, _ := NewFromSample([]float64{ 1.0, 7.0, 7.0, 8.0, 8.0, 9.0, 9.0 }, 2)
+	want := "{centroids=2 count=7 min=1 max=9 dropped=0 [1:1 8:~6]}"
 	if fmt.Sprintf("%v", got) != want {
 		t.Errorf("Want %v, got %v", want, got)
 	}
 }
 
 func TestOptimalManyCentroids(t *testing.T) {
-	got := NewFromSample([]float64{ 1.0, 7.0, 7.0, 8.0, 8.0, 9.0, 9.0 }, 7)
-	want := "&{[{1 1} {7 1} {7 1} {8 1} {8 1} {9 1} {9 1}] 7 1 9}"
+	got, _ := NewFromSample([]float64{ 1.0, 7.0, 7.0, 8.0, 8.0, 9.0, 9.0 }, 7)
+	want := "{centroids=7 count=7 min=1 max=9 dropped=0 [1:1 7:1 7:1 8:1 8:1 9:1 9:1]}"
 	if fmt.Sprintf("%v", got) != want {
 		t.Errorf("Want %v, got %v", want, got)
 	}
 }
 
 func TestOptimalMaxCentroids(t *testing.T) {
-	got := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 4.0, 5.0, 6.0 }, 6)
-	want := "&{[{1 1} {2 1} {3 1} {4 -2} {5 1} {6 1}] 7 1 6}"
+	got, _ := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 4.0, 5.0, 6.0 }, 6)
+	want := "{centroids=6 count=7 min=1 max=6 dropped=0 [1:1 2:1 3:1 4:~2 5:1 6:1]}"
 	if fmt.Sprintf("%v", got) != want {
 		t.Errorf("Want %v, got %v", want, got)
 	}
 }
 
 func TestOptimalTooFewCentroids(t *testing.T) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Error("Expected panic on call to NewFromSample with 0 centroids")
+	if _, err := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 4.0, 5.0, 6.0 }, 0); err == nil {
+		t.Error("Expected error on call to NewFromSample with 0 centroids")
+	}
+	if _, err := NewFromSample([]float64{1.0}, maxCentroids+1); err == nil {
+		t.Errorf("Expected error on call to NewFromSample with %v centroids", maxCentroids+1)
+	}
+}
+
+func TestOptimalBadSample(t *testing.T) {
+	for _, sample := range [][]float64{
+		nil,
+		{},
+		{1.0, math.NaN(), 3.0},
+		{1.0, math.Inf(-1)},
+	} {
+		if h, err := NewFromSample(sample, 2); err == nil {
+			t.Errorf("Expected error on call to NewFromSample with sample %v, got %v", sample, h)
 		}
-	}()
-	NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 4.0, 5.0, 6.0 }, 0)
+	}
 }
 
 func TestOptimalTooManyCentroids(t *testing.T) {
-	got := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 4.0, 5.0, 6.0 }, 10)
-	want := "&{[{1 1} {2 1} {3 1} {4 2} {5 1} {6 1}] 7 1 6}"
+	got, _ := NewFromSample([]float64{ 1.0, 2.0, 3.0, 4.0, 4.0, 5.0, 6.0 }, 10)
+	want := "{centroids=10 count=7 min=1 max=6 dropped=0 [1:1 2:1 3:1 4:2 5:1 6:1]}"
 	if fmt.Sprintf("%v", got) != want {
 		t.Errorf("Want %v, got %v", want, got)
 	}
 }
+
+func BenchmarkAdd(b *testing.B) {
+	for _, n := range []uint{16, 128, 1024} {
+		b.Run(fmt.Sprintf("centroids=%v", n), func(b *testing.B) {
+			s := New(n)
+			r := rand.New(rand.NewSource(0))
+			values := make([]float64, 4096)
+			for i := range values {
+				values[i] = r.NormFloat64()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Add(values[i%len(values)])
+			}
+		})
+	}
+}
+
+func BenchmarkAddBatch(b *testing.B) {
+	for _, n := range []uint{16, 128, 1024} {
+		values := make([]float64, 10000)
+		r := rand.New(rand.NewSource(0))
+		for i := range values {
+			values[i] = r.NormFloat64()
+		}
+		b.Run(fmt.Sprintf("loop/centroids=%v", n), func(b *testing.B) {
+			s := New(n)
+			for i := 0; i < b.N; i++ {
+				for _, v := range values {
+					s.Add(v)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("batch/centroids=%v", n), func(b *testing.B) {
+			s := New(n)
+			for i := 0; i < b.N; i++ {
+				s.AddBatch(values)
+			}
+		})
+	}
+}
+
+// Compares calling Add on each value with the sort-and-merge path AddBatch
+// takes for large sketches, for a range of sketch and batch sizes, to justify
+// batchMinCapacity and batchMinValues.
+func BenchmarkAddBatchCrossover(b *testing.B) {
+	r := rand.New(rand.NewSource(0))
+	warm := make([]float64, 10000)
+	for i := range warm {
+		warm[i] = r.NormFloat64()
+	}
+	for _, n := range []uint{16, 128, 256, 1024} {
+		for _, m := range []int{16, 64, 1024} {
+			values := make([]float64, m)
+			for i := range values {
+				values[i] = r.NormFloat64()
+			}
+			b.Run(fmt.Sprintf("centroids=%v/values=%v/loop", n, m), func(b *testing.B) {
+				s := New(n)
+				for _, v := range warm {
+					s.Add(v)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for _, v := range values {
+						s.Add(v)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("centroids=%v/values=%v/merge", n, m), func(b *testing.B) {
+				s := New(n)
+				for _, v := range warm {
+					s.Add(v)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					s.mergeBatch(values)
+				}
+			})
+		}
+	}
+}
+
+// Compares the allocations of MergeInto with merging into a fresh clone.
+func BenchmarkMergeInto(b *testing.B) {
+	r := rand.New(rand.NewSource(0))
+	x, y := New(64), New(64)
+	for i := 0; i < 10000; i++ {
+		x.Add(r.NormFloat64())
+		y.Add(r.NormFloat64())
+	}
+	b.Run("clone", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dst := x.Clone()
+			dst.Merge(y)
+		}
+	})
+	b.Run("into", func(b *testing.B) {
+		b.ReportAllocs()
+		dst := New(64)
+		for i := 0; i < b.N; i++ {
+			MergeInto(dst, x, y)
+		}
+	})
+}
+
+// Compares Summary with separate calls to Count, Min, Max, Mean and Quantile
+// for the quantiles an exporter typically reports.
+func BenchmarkSummary(b *testing.B) {
+	qs := []float64{0.5, 0.9, 0.99, 0.999}
+	for _, f := range []float64{1, 2} {
+		s := NewWithOptions(WithCentroids(64), WithBufferFactor(f))
+		r := rand.New(rand.NewSource(0))
+		for i := 0; i < 10000; i++ {
+			s.Add(r.ExpFloat64())
+		}
+		b.Run(fmt.Sprintf("separate/factor=%v", f), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _, _, _ = s.Count(), s.Min(), s.Max(), s.Mean()
+				for _, q := range qs {
+					s.Quantile(q)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("summary/factor=%v", f), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Summary(qs)
+			}
+		})
+	}
+}
+
+// Reports the time per Add and the mean absolute quantile error, in units of
+// the standard deviation, of sketches with different buffer factors.
+func BenchmarkAddBufferFactor(b *testing.B) {
+	values := make([]float64, 100000)
+	r := rand.New(rand.NewSource(0))
+	for i := range values {
+		values[i] = r.ExpFloat64()
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	for _, n := range []uint{16, 128} {
+		for _, f := range []float64{1, 1.5, 2, 4} {
+			b.Run(fmt.Sprintf("centroids=%v/factor=%v", n, f), func(b *testing.B) {
+				var s *Sketch
+				for i := 0; i < b.N; i++ {
+					if i%len(values) == 0 {
+						s = NewWithOptions(WithCentroids(n), WithBufferFactor(f))
+					}
+					s.Add(values[i%len(values)])
+				}
+				b.StopTimer()
+				s = NewWithOptions(WithCentroids(n), WithBufferFactor(f))
+				for _, v := range values {
+					s.Add(v)
+				}
+				total := 0.0
+				for i := 1; i < 1000; i++ {
+					q := float64(i) / 1000.0
+					total += math.Abs(s.Quantile(q) - sorted[int(q*float64(len(sorted)))])
+				}
+				b.ReportMetric(total/999.0, "quantile-error")
+			})
+		}
+	}
+}
+
+// Feeds arbitrary sequences of float64s, 8 bytes each, through Add and checks
+// the invariants that every Sketch should satisfy. The first byte picks the
+// number of centroids. Run with go test -fuzz=FuzzHistosketch.
+func FuzzHistosketch(f *testing.F) {
+	floats := func(n byte, vs ...float64) []byte {
+		b := []byte{n}
+		for _, v := range vs {
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+		}
+		return b
+	}
+	f.Add(floats(4))
+	f.Add(floats(1, 1, 2, 3))
+	f.Add(floats(2, 1, 1, 1, 1, 1))
+	f.Add(floats(4, math.NaN(), math.Inf(1), math.Inf(-1), 0))
+	f.Add(floats(3, 0, math.Copysign(0, -1), 0, math.Copysign(0, -1)))
+	f.Add(floats(2, math.MaxFloat64, -math.MaxFloat64, math.MaxFloat64, 0))
+	f.Add(floats(3, math.SmallestNonzeroFloat64, -math.SmallestNonzeroFloat64, 0, 1e-300))
+	f.Add(floats(5, 1e300, 1e300*(1+1e-15), 1e300*(1+2e-15), 1, 2, 3))
+	f.Add(floats(2, 5, 4, 3, 2, 1, 0, -1, -2))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		s := New(uint(data[0]%32) + 1)
+		for b := data[1:]; len(b) >= 8; b = b[8:] {
+			s.Add(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+			if err := s.Validate(); err != nil {
+				t.Fatalf("Validate failed after adding %v: %v", s.String(), err)
+			}
+		}
+		if s.Count() == 0 {
+			return
+		}
+		prevq, prevx, prevs := math.Inf(-1), math.Inf(-1), 0.0
+		for i := 0; i <= 100; i++ {
+			q := s.Quantile(float64(i) / 100.0)
+			if !(q >= s.Min() && q <= s.Max()) {
+				t.Fatalf("Quantile(%v) = %v outside of [%v, %v] for %v", float64(i)/100.0, q, s.Min(), s.Max(), s)
+			} else if q < prevq {
+				t.Fatalf("Quantile(%v) = %v less than previous quantile %v for %v", float64(i)/100.0, q, prevq, s)
+			}
+			prevq = q
+		}
+		for i := 0; i <= 100; i++ {
+			// Step from Min to Max without overflowing. Rounding can make
+			// the steps uneven when Min and Max are close, so keep x from
+			// ever decreasing.
+			x := s.Min() + float64(i)/100.0*s.Max() - float64(i)/100.0*s.Min()
+			x = math.Min(math.Max(x, prevx), s.Max())
+			prevx = x
+			sum := s.Sum(x)
+			if !(sum >= 0 && sum <= s.Count()) {
+				t.Fatalf("Sum(%v) = %v outside of [0, %v] for %v", x, sum, s.Count(), s)
+			} else if sum < prevs {
+				t.Fatalf("Sum(%v) = %v less than previous sum %v for %v", x, sum, prevs, s)
+			}
+			prevs = sum
+		}
+	})
+}
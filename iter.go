@@ -0,0 +1,25 @@
+//go:build go1.23
+
+package histosketch
+
+import (
+	"iter"
+	"math"
+)
+
+// Returns an iterator over the value and weight of each centroid in h, in
+// ascending order of value, so the centroids can be visited with
+//
+//	for value, weight := range h.All() { ... }
+//
+// This visits the same centroids as ForEachCentroid and, like it, doesn't
+// allocate anything per centroid. h must not be modified during iteration.
+func (h Sketch) All() iter.Seq2[float64, float64] {
+	return func(yield func(float64, float64) bool) {
+		for _, c := range h.cs {
+			if !yield(c.p, math.Abs(c.m)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//go:build go1.23
+
+package histosketch
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	s := New(8)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.NormFloat64())
+	}
+	got := []Centroid{}
+	for v, w := range s.All() {
+		got = append(got, Centroid{v, w})
+	}
+	if want := s.Centroids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Want All to visit %v, got %v", want, got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1].Value >= got[i].Value {
+			t.Errorf("Want ascending values, got %v then %v", got[i-1].Value, got[i].Value)
+		}
+	}
+	calls := 0
+	for range s.All() {
+		calls++
+		if calls == 3 {
+			break
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Want 3 iterations before stopping early, got %v", calls)
+	}
+	total := 0.0
+	if n := testing.AllocsPerRun(100, func() {
+		for _, w := range s.All() {
+			total += w
+		}
+	}); n > 1 {
+		t.Errorf("Want at most one allocation per range over All, got %v", n)
+	}
+	for range New(8).All() {
+		t.Errorf("Want no centroids from an empty sketch")
+	}
+}
@@ -0,0 +1,313 @@
+package histosketch
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// The number of centroids used by NewWithOptions if WithCentroids isn't given.
+const DefaultCentroids = 32
+
+// A NaNPolicy determines what a Sketch does when it's asked to add a NaN or
+// infinite value.
+type NaNPolicy int
+
+const (
+	// Skip NaN and infinite values, counting their weight in Dropped. This is
+	// the default.
+	SkipNaN NaNPolicy = iota
+	// Panic when asked to add a NaN or infinite value.
+	PanicOnNaN
+)
+
+// A QuantileMethod determines how a Sketch turns a quantile into a value.
+type QuantileMethod int
+
+const (
+	// Interpolate linearly between the centroids on either side of the
+	// quantile, as described in Ben-Haim and Tom-Tov's paper. Quantile(0.0)
+	// is Min and Quantile(1.0) is Max, and quantiles in the tails are
+	// interpolated between the outermost centroids and Min or Max. This is the
+	// default.
+	Linear QuantileMethod = iota
+	// Return the value of the first centroid at which the cumulative weight
+	// reaches the quantile's rank, so that every estimate is a centroid value.
+	// For a sketch whose centroids are all exact, this is the nearest-rank
+	// definition: Quantile(q) is the smallest value with at least q * Count
+	// values at or below it. Quantile(0.0) is still Min and Quantile(1.0) is
+	// still Max, even if the outermost centroids have been merged.
+	NearestRank
+)
+
+// A MergeMetric determines how a Sketch measures the gap between two
+// neighboring centroids when deciding which pair to merge. The pair with the
+// smallest gap is merged first.
+type MergeMetric int
+
+const (
+	// Measure gaps by the absolute difference of the centroid values, as
+	// described in Ben-Haim and Tom-Tov's paper. This is the default.
+	Absolute MergeMetric = iota
+	// Measure gaps by the difference of the centroid values relative to their
+	// magnitudes, (b - a) / (|a| + |b|), so that resolution is spread evenly
+	// over orders of magnitude instead of over the range of values. This
+	// helps a lot for positive data spanning many orders of magnitude, like
+	// log-normal or power-law latencies: with Absolute gaps, the sparse
+	// outliers in the far tail each keep a centroid while the bulk of the
+	// data near 0 is crushed into a few, so even the median and the 99th
+	// percentile can be far off. For data within one or two orders of
+	// magnitude, like an exponential distribution, Absolute gaps already keep
+	// the tail well resolved and Relative gaps make tail quantiles worse.
+	// Values near 0 are kept apart, since gaps between values with different
+	// signs are always relatively large.
+	Relative
+)
+
+// Returns the gap between centroid values a <= b according to m.
+func (m MergeMetric) gap(a, b float64) float64 {
+	if m == Relative {
+		if s := math.Abs(a) + math.Abs(b); s > 0 {
+			return (b - a) / s
+		}
+		return 0
+	}
+	return b - a
+}
+
+// Settings for a Sketch that can be configured with an Option.
+type options struct {
+	nanPolicy  NaNPolicy
+	decay      float64 // 0 if values shouldn't decay.
+	quantile   QuantileMethod
+	merge      MergeMetric
+	halfLife   time.Duration // 0 if AddTimestamped shouldn't decay.
+	buffer     float64       // 0 if centroids should be merged one at a time.
+	exactBelow int           // 0 if values shouldn't be kept exactly.
+	extra      int           // Number of centroids held beyond the maximum.
+	clamped    bool          // Whether added values are clamped to [lo, hi].
+	lo, hi     float64
+	probe      int // Size of the reservoir for WithAccuracyProbe, or 0.
+}
+
+// An Option configures a Sketch created with NewWithOptions.
+type Option func(*Sketch)
+
+// Use a maximum of n centroids. Panics if n is 0 or more than 2^24, the most
+// that every serialization of a Sketch can describe.
+func WithCentroids(n uint) Option {
+	if n == 0 {
+		panic("Number of centroids must be at least 1.")
+	} else if n > maxCentroids {
+		panic(fmt.Sprintf("bad argument, number of centroids must be at most %v, got %v", maxCentroids, n))
+	}
+	return func(h *Sketch) {
+		h.cs = h.allocate(int(n))
+	}
+}
+
+// Handle NaN and infinite values according to p.
+func WithNaNPolicy(p NaNPolicy) Option {
+	if p != SkipNaN && p != PanicOnNaN {
+		panic(fmt.Sprintf("bad argument, unknown NaNPolicy %v", p))
+	}
+	return func(h *Sketch) {
+		h.opts.nanPolicy = p
+	}
+}
+
+// Decay the weight of every value already in the sketch by factor each time a
+// new value is added, as if Decay(factor) were called before each Add, so
+// that quantiles reflect mostly recent values. factor must be in (0.0, 1.0].
+// Since this touches every centroid, it makes adding values a little slower.
+func WithDecay(factor float64) Option {
+	if !(factor > 0 && factor <= 1) {
+		panic(fmt.Sprintf("bad argument, decay factor must be in (0.0, 1.0], got %v", factor))
+	}
+	return func(h *Sketch) {
+		h.opts.decay = factor
+	}
+}
+
+// Estimate quantiles according to m.
+func WithQuantileMethod(m QuantileMethod) Option {
+	if m != Linear && m != NearestRank {
+		panic(fmt.Sprintf("bad argument, unknown QuantileMethod %v", m))
+	}
+	return func(h *Sketch) {
+		h.opts.quantile = m
+	}
+}
+
+// Decay the weight of every value already in the sketch by half for every
+// halfLife of time that passes between timestamps given to AddTimestamped, so
+// that a value added halfLife ago counts half as much as one added now. This
+// gives an exponentially weighted moving distribution over wall-clock time,
+// unlike WithDecay, which decays by the number of values added. Panics unless
+// halfLife is positive.
+func WithHalfLife(halfLife time.Duration) Option {
+	if halfLife <= 0 {
+		panic(fmt.Sprintf("bad argument, half-life must be positive, got %v", halfLife))
+	}
+	return func(h *Sketch) {
+		h.opts.halfLife = halfLife
+	}
+}
+
+// Choose which neighboring centroids to merge according to m.
+func WithMergeMetric(m MergeMetric) Option {
+	if m != Absolute && m != Relative {
+		panic(fmt.Sprintf("bad argument, unknown MergeMetric %v", m))
+	}
+	return func(h *Sketch) {
+		h.opts.merge = m
+	}
+}
+
+// Let the sketch hold up to factor times its maximum number of centroids
+// before compressing back down to the maximum all at once, instead of merging
+// a pair of centroids every time a value is added once the sketch is full.
+// Compressing a whole buffer at a time chooses which centroids to merge with
+// more of the data in view, which can make estimates of small sketches more
+// accurate: on 100,000 exponentially distributed values, a factor of 2 cuts
+// the mean quantile error of a 16-centroid sketch by about a third, though it
+// makes no difference for 128 centroids. The cost is the memory for the
+// buffer and slower Adds, typically 2 to 7 times slower, since each Add still
+// inserts into the sorted centroids and the buffer is compressed with a heap.
+// Run BenchmarkAddBufferFactor to see the tradeoff for other sizes. factor
+// must be at least 1 and finite; 1 is the default and means no buffering.
+// Estimates include buffered values but are made from a compressed copy of
+// the centroids, so queries cost a little more while values are buffered.
+// Serializing the sketch also compresses a copy first, so the serialized form
+// is the same size with or without a buffer.
+func WithBufferFactor(factor float64) Option {
+	if !(factor >= 1) || math.IsInf(factor, 0) {
+		panic(fmt.Sprintf("bad argument, buffer factor must be at least 1 and finite, got %v", factor))
+	}
+	return func(h *Sketch) {
+		n := h.capacity()
+		h.opts.buffer = factor
+		h.cs = h.allocate(n)
+	}
+}
+
+// Keep every value exactly, as if the sketch had no maximum number of
+// centroids, until more than n values (or n distinct values) have been added,
+// and only then compress down to the maximum number of centroids. Until then,
+// Quantile, Sum and every other estimate are computed exactly from the values
+// themselves, so sparse metrics are reported exactly while busy ones degrade
+// to the usual approximation. A sketch already keeps values exactly until it
+// has more distinct values than its maximum number of centroids; this only
+// matters if n is larger than that, and costs memory for n centroids. AddBatch
+// on large sketches, Merge and AddSketch compress down to the maximum number
+// of centroids as usual, as does serializing the sketch. n must be
+// non-negative; 0 is the default and means no extra values are kept exactly.
+func WithExactBelow(n int) Option {
+	if n < 0 {
+		panic(fmt.Sprintf("bad argument, exact threshold must be non-negative, got %v", n))
+	}
+	return func(h *Sketch) {
+		c := h.capacity()
+		h.opts.exactBelow = n
+		h.cs = h.allocate(c)
+	}
+}
+
+// Clamp every value added to the sketch to [lo, hi] before inserting it, so
+// that a few wild readings, like a 10^12 ms latency from a glitching sensor,
+// can't stretch Min and Max and the centroids out to cover them. Clamped
+// values are still counted, at the edge of the range they fell outside of: a
+// value above hi is added as hi, with its full weight, so Count is unchanged
+// and the outliers show up as a spike at the edge instead of disappearing.
+// Either bound can be infinite to clamp only one side. NaN and infinite values
+// are still handled by the NaNPolicy rather than clamped. Merge, AddSketch and
+// the other ways of combining sketches don't clamp the centroids they bring
+// in. Panics if lo or hi is NaN or lo > hi.
+func WithClamp(lo, hi float64) Option {
+	if !(lo <= hi) {
+		panic(fmt.Sprintf("bad argument, clamp range must have lo <= hi, got [%v, %v]", lo, hi))
+	}
+	return func(h *Sketch) {
+		h.opts.clamped, h.opts.lo, h.opts.hi = true, lo, hi
+	}
+}
+
+// Keep a reservoir sample of up to reservoirSize of the raw values added to
+// the sketch, so that EstimatedQuantileError can report how far off its
+// quantiles are without a parallel exact histogram. This costs 8 bytes per
+// sampled value on top of the centroids, so a reservoir of 1,000 values takes
+// about as much memory as 500 centroids, plus a little time per Add to decide
+// whether to keep the value. Values are sampled in proportion to their
+// weight, and in a sketch created with WithDecay or WithHalfLife, or one that
+// is scaled or decayed, the sample favors recent values the same way the
+// centroids do. Only values added directly are sampled: values merged in
+// from other sketches aren't, so EstimatedQuantileError returns NaN once any
+// are, and those sketches should be probed instead of the merged result. The
+// reservoir isn't serialized either, so the same goes for a decoded Sketch
+// until it's Reset. Panics if reservoirSize is less than 1.
+func WithAccuracyProbe(reservoirSize int) Option {
+	if reservoirSize < 1 {
+		panic(fmt.Sprintf("bad argument, reservoir size must be at least 1, got %v", reservoirSize))
+	}
+	return func(h *Sketch) {
+		h.opts.probe = reservoirSize
+	}
+}
+
+// Returns value clamped to the range set by WithClamp, if any.
+func (o options) bound(value float64) float64 {
+	if !o.clamped {
+		return value
+	}
+	return math.Min(math.Max(value, o.lo), o.hi)
+}
+
+// Returns the most centroids a Sketch with a maximum of n centroids can hold
+// at once, counting the buffer configured by WithBufferFactor and any values
+// kept exactly because of WithExactBelow.
+func (o options) slots(n int) int {
+	s := n
+	if o.buffer > 1 {
+		s = int(math.Ceil(float64(n) * o.buffer))
+	}
+	if o.exactBelow > s {
+		s = o.exactBelow
+	}
+	return s
+}
+
+// Returns an empty slice of centroids for a Sketch with a maximum of n
+// centroids, with room for the centroids it can hold beyond that (see slots),
+// and records how many of those there are in h.
+func (h *Sketch) allocate(n int) []centroid {
+	h.opts.extra = h.opts.slots(n) - n
+	return make([]centroid, 0, n+h.opts.extra+1)
+}
+
+// Create a new Sketch configured by the given options. Options are applied in
+// order, so later options override earlier ones. Without WithCentroids, the
+// Sketch has a maximum of DefaultCentroids centroids.
+func NewWithOptions(opts ...Option) *Sketch {
+	h := &Sketch{
+		cs:  make([]centroid, 0, DefaultCentroids+1),
+		min: math.MaxFloat64,
+		max: -math.MaxFloat64,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Reports whether value should be skipped instead of added to h, counting
+// weight as dropped if so. Panics instead if h's NaNPolicy is PanicOnNaN.
+func (h *Sketch) skip(value, weight float64) bool {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		return false
+	}
+	if h.opts.nanPolicy == PanicOnNaN {
+		panic(fmt.Sprintf("bad argument, can't add non-finite value %v", value))
+	}
+	h.dropped += weight
+	return true
+}
@@ -0,0 +1,350 @@
+package histosketch
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	if s := NewWithOptions(); s.capacity() != DefaultCentroids {
+		t.Errorf("Want %v centroids by default, got %v", DefaultCentroids, s.capacity())
+	}
+	if s := NewWithOptions(WithCentroids(8), WithCentroids(16)); s.capacity() != 16 {
+		t.Errorf("Want the last WithCentroids to win, got %v centroids", s.capacity())
+	}
+	s, x := NewWithOptions(WithCentroids(8)), New(8)
+	for i := 0; i < 100; i++ {
+		s.Add(float64(i % 17))
+		x.Add(float64(i % 17))
+	}
+	if !s.Equal(x, 0) {
+		t.Errorf("Want New(8) to be the same as NewWithOptions(WithCentroids(8)), got %v and %v", *x, *s)
+	}
+}
+
+func TestWithNaNPolicy(t *testing.T) {
+	s := NewWithOptions(WithNaNPolicy(SkipNaN))
+	s.Add(math.NaN())
+	if s.Dropped() != 1 || s.Count() != 0 {
+		t.Errorf("Want SkipNaN to drop NaN, got Dropped %v, Count %v", s.Dropped(), s.Count())
+	}
+	p := NewWithOptions(WithCentroids(512), WithNaNPolicy(PanicOnNaN))
+	for name, add := range map[string]func(){
+		"Add":      func() { p.Add(math.Inf(1)) },
+		// Large enough to take AddBatch's merge path, which checks every
+		// value before adding any.
+		"AddBatch": func() { p.AddBatch(append(make([]float64, batchMinValues), math.NaN())) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to %v with PanicOnNaN", name)
+				}
+			}()
+			add()
+		}()
+	}
+	p.Add(1.0)
+	if p.Count() != 1 {
+		t.Errorf("Want PanicOnNaN to still add finite values, got Count %v", p.Count())
+	}
+}
+
+func TestWithDecay(t *testing.T) {
+	s, x := NewWithOptions(WithCentroids(16), WithDecay(0.99)), New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		r := rand.Float64()
+		s.Add(r)
+		x.Decay(0.99)
+		x.Add(r)
+	}
+	if !s.Equal(x, 1e-9) {
+		t.Errorf("Want WithDecay to match calling Decay before each Add, got %v and %v", *s, *x)
+	}
+	// Almost all of the weight should be on the most recent ~500 values.
+	if c := s.Count(); c > 100.0 {
+		t.Errorf("Want decayed Count under 100, got %v", c)
+	}
+	b := NewWithOptions(WithCentroids(512), WithDecay(0.5))
+	b.AddBatch([]float64{1.0, 2.0, 3.0})
+	if b.Count() != 1.75 {
+		t.Errorf("Want AddBatch to decay each value in turn, got Count %v", b.Count())
+	}
+	b.Reset()
+	b.Add(1.0)
+	b.Add(2.0)
+	if b.Count() != 1.5 {
+		t.Errorf("Want Reset to keep WithDecay, got Count %v", b.Count())
+	}
+}
+
+func TestBadOptions(t *testing.T) {
+	for name, opt := range map[string]func(){
+		"WithCentroids(0)":       func() { WithCentroids(0) },
+		"WithCentroids(2^24+1)":  func() { WithCentroids(maxCentroids + 1) },
+		"WithDecay(0)":           func() { WithDecay(0) },
+		"WithDecay(1.5)":         func() { WithDecay(1.5) },
+		"WithNaNPolicy(42)":      func() { WithNaNPolicy(NaNPolicy(42)) },
+		"WithDecay(math.NaN)":    func() { WithDecay(math.NaN()) },
+		"WithQuantileMethod(42)": func() { WithQuantileMethod(QuantileMethod(42)) },
+		"WithMergeMetric(42)":    func() { WithMergeMetric(MergeMetric(42)) },
+		"WithHalfLife(0)":        func() { WithHalfLife(0) },
+		"WithBufferFactor(0.5)":  func() { WithBufferFactor(0.5) },
+		"WithBufferFactor(Inf)":  func() { WithBufferFactor(math.Inf(1)) },
+		"WithExactBelow(-1)":     func() { WithExactBelow(-1) },
+		"WithClamp(1, 0)":        func() { WithClamp(1, 0) },
+		"WithClamp(NaN, 0)":      func() { WithClamp(math.NaN(), 0) },
+		"WithAccuracyProbe(0)":   func() { WithAccuracyProbe(0) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to %v", name)
+				}
+			}()
+			opt()
+		}()
+	}
+}
+
+func TestWithQuantileMethod(t *testing.T) {
+	lin, nr := New(8), NewWithOptions(WithCentroids(8), WithQuantileMethod(NearestRank))
+	for i := 1; i <= 5; i++ {
+		lin.Add(float64(i))
+		nr.Add(float64(i))
+	}
+	for _, c := range []struct{ q, lin, nr float64 }{
+		{0.0, 1, 1}, {0.1, 2, 1}, {0.2, 2, 1}, {0.21, 2, 2}, {0.5, 4, 3},
+		{0.6, 4, 3}, {0.61, 4, 4}, {0.9, 5, 5}, {1.0, 5, 5},
+	} {
+		if got := lin.Quantile(c.q); got != c.lin {
+			t.Errorf("Want Linear Quantile(%v) = %v, got %v", c.q, c.lin, got)
+		}
+		if got := nr.Quantile(c.q); got != c.nr {
+			t.Errorf("Want NearestRank Quantile(%v) = %v, got %v", c.q, c.nr, got)
+		}
+	}
+
+	// With merged centroids, NearestRank returns centroid values in the
+	// middle but still returns Min and Max at the extremes.
+	lin, nr = New(2), NewWithOptions(WithCentroids(2), WithQuantileMethod(NearestRank))
+	for i := 1; i <= 6; i++ {
+		lin.Add(float64(i))
+		nr.Add(float64(i))
+	}
+	for _, c := range []struct{ q, lin, nr float64 }{
+		{0.0, 1, 1}, {0.2, 1.786335345030997, 1.5}, {0.5, 3.696152422706632, 4.5},
+		{0.9, 5.178416163742251, 4.5}, {1.0, 6, 6},
+	} {
+		if got := lin.Quantile(c.q); math.Abs(got-c.lin) > 1e-9 {
+			t.Errorf("Want Linear Quantile(%v) = %v, got %v", c.q, c.lin, got)
+		}
+		if got := nr.Quantile(c.q); got != c.nr {
+			t.Errorf("Want NearestRank Quantile(%v) = %v, got %v", c.q, c.nr, got)
+		}
+	}
+
+	qs := []float64{0.9, 0.0, 0.5, 1.0, 0.2}
+	for i, got := range nr.Quantiles(qs) {
+		if want := nr.Quantile(qs[i]); got != want {
+			t.Errorf("Want NearestRank Quantiles to match Quantile(%v) = %v, got %v", qs[i], want, got)
+		}
+	}
+	if q := NewWithOptions(WithQuantileMethod(NearestRank)).Quantile(0.5); !math.IsNaN(q) {
+		t.Errorf("Want NaN from NearestRank Quantile on an empty Sketch, got %v", q)
+	}
+}
+
+func TestWithMergeMetric(t *testing.T) {
+	// Compare the relative error of quantile estimates on Pareto data, which
+	// spans several orders of magnitude, averaged over a few seeds.
+	errs := map[MergeMetric][]float64{}
+	for _, m := range []MergeMetric{Absolute, Relative} {
+		errs[m] = make([]float64, 2)
+		for seed := 0; seed < 10; seed++ {
+			rand.Seed(int64(seed))
+			h, xs := NewWithOptions(WithCentroids(32), WithMergeMetric(m)), []float64{}
+			for i := 0; i < 20000; i++ {
+				x := math.Pow(rand.Float64(), -1/1.2)
+				h.Add(x)
+				xs = append(xs, x)
+			}
+			sort.Float64s(xs)
+			for i, q := range []float64{0.5, 0.99} {
+				actual := xs[int(q*float64(len(xs)))]
+				errs[m][i] += math.Abs(h.Quantile(q)-actual) / actual / 10
+			}
+		}
+	}
+	abs, rel := errs[Absolute], errs[Relative]
+	if !(rel[0] < abs[0]/10) {
+		t.Errorf("Want Relative to greatly improve the median, got error %v vs. %v for Absolute", rel[0], abs[0])
+	}
+	if !(rel[1] < abs[1]) {
+		t.Errorf("Want Relative to improve the 99th percentile, got error %v vs. %v for Absolute", rel[1], abs[1])
+	}
+
+	// The metric also applies when merging sketches.
+	rand.Seed(0)
+	xs := []float64{}
+	a, r := New(32), NewWithOptions(WithCentroids(32), WithMergeMetric(Relative))
+	a2, r2 := a.Clone(), r.Clone()
+	for i := 0; i < 2000; i++ {
+		v := math.Pow(rand.Float64(), -1/1.2)
+		if i%2 == 0 {
+			a.Add(v)
+			r.Add(v)
+		} else {
+			a2.Add(v)
+			r2.Add(v)
+		}
+		xs = append(xs, v)
+	}
+	sort.Float64s(xs)
+	a.Merge(a2)
+	r.Merge(r2)
+	if ae, re := math.Abs(a.Median()-xs[1000]), math.Abs(r.Median()-xs[1000]); !(re < ae) {
+		t.Errorf("Want Relative Merge to improve the median, got error %v vs. %v for Absolute", re, ae)
+	}
+}
+
+func TestWithBufferFactor(t *testing.T) {
+	// The order of WithCentroids and WithBufferFactor doesn't matter.
+	for _, s := range []*Sketch{
+		NewWithOptions(WithCentroids(8), WithBufferFactor(2.5)),
+		NewWithOptions(WithBufferFactor(2.5), WithCentroids(8)),
+	} {
+		rand.Seed(0)
+		most := 0
+		for i := 0; i < 1000; i++ {
+			s.Add(rand.NormFloat64())
+			if len(s.cs) > most {
+				most = len(s.cs)
+			}
+		}
+		if most != 20 {
+			t.Errorf("Want at most 20 centroids buffered, got %v", most)
+		}
+		if s.Count() != 1000 {
+			t.Errorf("Want Count 1000, got %v", s.Count())
+		}
+		if err := s.Validate(); err != nil {
+			t.Errorf("Want no error from Validate, got %v", err)
+		}
+
+		// Serialized sketches are compressed to the maximum number of centroids.
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Want no error from MarshalBinary, got %v", err)
+		}
+		x := New(8)
+		if err := x.UnmarshalBinary(b); err != nil {
+			t.Fatalf("Want no error from UnmarshalBinary, got %v", err)
+		}
+		if len(x.cs) != 8 || x.Count() != 1000 {
+			t.Errorf("Want 8 centroids and Count 1000 after UnmarshalBinary, got %v", *x)
+		}
+		if got := fmt.Sprintf("%v", *s); got != fmt.Sprintf("%v", *x) {
+			t.Errorf("Want %v for buffered sketch, got %v", *x, got)
+		}
+		for _, q := range []float64{0.01, 0.25, 0.5, 0.75, 0.99} {
+			if got, want := s.Quantile(q), x.Quantile(q); got != want {
+				t.Errorf("Want Quantile(%v) = %v from buffered sketch, got %v", q, want, got)
+			}
+		}
+		if err := x.Merge(s); err != nil {
+			t.Errorf("Want no error merging buffered sketch, got %v", err)
+		}
+	}
+}
+
+func TestWithExactBelow(t *testing.T) {
+	for _, s := range []*Sketch{
+		NewWithOptions(WithCentroids(4), WithExactBelow(100)),
+		NewWithOptions(WithExactBelow(100), WithCentroids(4)),
+	} {
+		exact := New(100)
+		rand.Seed(0)
+		for i := 0; i < 100; i++ {
+			v := rand.NormFloat64()
+			s.Add(v)
+			exact.Add(v)
+		}
+		if len(s.cs) != 100 {
+			t.Errorf("Want 100 exact centroids, got %v", len(s.cs))
+		}
+		for i := 0; i <= 100; i++ {
+			q := float64(i) / 100.0
+			if got, want := s.Quantile(q), exact.Quantile(q); got != want {
+				t.Errorf("Want exact Quantile(%v) = %v, got %v", q, want, got)
+			}
+		}
+		if got, want := s.Sum(0.5), exact.Sum(0.5); got != want {
+			t.Errorf("Want exact Sum(0.5) = %v, got %v", want, got)
+		}
+		if err := s.Validate(); err != nil {
+			t.Errorf("Want no error from Validate, got %v", err)
+		}
+
+		// Serializing compresses to the maximum number of centroids.
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Want no error from MarshalBinary, got %v", err)
+		}
+		x := New(4)
+		if err := x.UnmarshalBinary(b); err != nil || len(x.cs) != 4 {
+			t.Errorf("Want 4 centroids after UnmarshalBinary, got %v (error %v)", *x, err)
+		}
+
+		// Adding another copy of a value already there goes past the
+		// threshold and compresses the sketch.
+		s.Add(s.cs[0].p)
+		if len(s.cs) != 4 || s.Count() != 101 {
+			t.Errorf("Want 4 centroids and Count 101 past the threshold, got %v", *s)
+		}
+		for i := 0; i < 100; i++ {
+			s.Add(rand.NormFloat64())
+		}
+		if len(s.cs) != 4 || s.Count() != 201 {
+			t.Errorf("Want 4 centroids and Count 201, got %v", *s)
+		}
+	}
+}
+
+func TestWithClamp(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		s := NewWithOptions(WithCentroids(batchMinCapacity), WithClamp(0, 100))
+		values := []float64{-5, 1e12, 50, 20, 100, 0, 1e12, math.NaN()}
+		if batch {
+			s.AddBatch(values)
+		} else {
+			for _, v := range values {
+				s.Add(v)
+			}
+		}
+		if s.Min() != 0 || s.Max() != 100 {
+			t.Errorf("Want Min, Max = 0, 100 with clamped values, got %v, %v", s.Min(), s.Max())
+		}
+		if s.Count() != 7 || s.Dropped() != 1 {
+			t.Errorf("Want Count 7 and Dropped 1 with clamped values, got %v and %v", s.Count(), s.Dropped())
+		}
+		// The clamped values are counted at the edges: -5 with 0, and both
+		// 1e12s with 100.
+		if got := s.Sum(0); got != 2 {
+			t.Errorf("Want Sum(0) = 2 with -5 clamped to 0, got %v", got)
+		}
+		if got := s.Count() - s.Sum(99); got != 3 {
+			t.Errorf("Want 3 values at 100 with 1e12 clamped to 100, got %v", got)
+		}
+	}
+	one := NewWithOptions(WithCentroids(8), WithClamp(math.Inf(-1), 10))
+	one.Add(-1e12)
+	one.Add(1e12)
+	if one.Min() != -1e12 || one.Max() != 10 {
+		t.Errorf("Want Min, Max = -1e12, 10 when only clamping above, got %v, %v", one.Min(), one.Max())
+	}
+}
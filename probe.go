@@ -0,0 +1,108 @@
+package histosketch
+
+import (
+	"math"
+	"sort"
+)
+
+// A reservoir sample of the raw values added to a Sketch, kept by
+// WithAccuracyProbe. Values are sampled with probability proportional to
+// their weight, using Chao's weighted reservoir sampling: total is the weight
+// of every value offered so far, decayed along with the Sketch, so that recent
+// values are favored in a decaying sketch just as they are in its centroids.
+type probe struct {
+	vs    []float64
+	total float64
+	state uint64 // splitmix64 state, so sampling is deterministic.
+}
+
+// Returns a copy of p that doesn't share its sample, or nil if p is nil.
+func (p *probe) clone() *probe {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.vs = append(make([]float64, 0, cap(p.vs)), p.vs...)
+	return &c
+}
+
+// Returns a pseudo-random number in [0.0, 1.0).
+func (p *probe) float64() float64 {
+	p.state += 0x9e3779b97f4a7c15
+	z := p.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return float64(z>>11) / (1 << 53)
+}
+
+// Offers value with the given weight to the sample, which holds at most n
+// values.
+func (p *probe) add(value, weight float64, n int) {
+	p.total += weight
+	if len(p.vs) < n {
+		p.vs = append(p.vs, value)
+		return
+	}
+	if p.float64()*p.total < float64(n)*weight {
+		p.vs[int(p.float64()*float64(n))] = value
+	}
+}
+
+// Offers value to h's accuracy probe, if it has one.
+func (h *Sketch) sample(value, weight float64) {
+	if h.opts.probe == 0 {
+		return
+	}
+	if h.probe == nil {
+		h.probe = &probe{vs: make([]float64, 0, h.opts.probe)}
+	}
+	h.probe.add(value, weight, h.opts.probe)
+}
+
+// Lowers the weight h's accuracy probe has seen to Count after weight has been
+// removed from h, so that weight merged in later still counts as unsampled.
+func (h *Sketch) shrinkProbe() {
+	if h.probe != nil && h.probe.total > h.count {
+		h.probe.total = h.count
+	}
+}
+
+// Returns an estimate of how far off h's quantiles are, from the reservoir of
+// raw values kept by WithAccuracyProbe: the mean, over the sampled values, of
+// the difference between the rank h estimates for each value and its rank in
+// the sample, so 0.01 means quantile estimates are typically off by about one
+// percentile. Since it's measured against a sample rather than every value,
+// it's only an estimate: the sample's own ranks are off from the true ones by
+// about 0.3/sqrt(reservoirSize) on average, and since that noise adds to
+// rather than cancels h's error, the estimate tends to overstate the error
+// when h is more accurate than that. Returns NaN if h wasn't created with
+// WithAccuracyProbe, if no values have been sampled since h was created or
+// Reset, or if h holds weight the probe never saw: weight merged in from
+// another Sketch, or all of the weight of a decoded Sketch, since the
+// reservoir isn't serialized. Reset starts the probe over.
+func (h Sketch) EstimatedQuantileError() float64 {
+	if h.probe == nil || len(h.probe.vs) == 0 || len(h.cs) == 0 {
+		return math.NaN()
+	}
+	if h.count > h.probe.total*(1+validateTolerance) {
+		return math.NaN()
+	}
+	vs := append([]float64{}, h.probe.vs...)
+	sort.Float64s(vs)
+	ranks := h.CDFs(vs)
+	n := float64(len(vs))
+	var e float64
+	for i := 0; i < len(vs); {
+		// Like Rank, the rank of a value in the sample counts every value
+		// equal to it.
+		j := i + 1
+		for j < len(vs) && vs[j] == vs[i] {
+			j++
+		}
+		for r := float64(j) / n; i < j; i++ {
+			e += math.Abs(ranks[i] - r)
+		}
+	}
+	return e / n
+}
@@ -0,0 +1,191 @@
+package histosketch
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestEstimatedQuantileError(t *testing.T) {
+	rand.Seed(0)
+	const k = 2000
+	prev := math.Inf(1)
+	for _, n := range []uint{4, 16, 64} {
+		h := NewWithOptions(WithCentroids(n), WithAccuracyProbe(k))
+		vs := make([]float64, 100000)
+		for i := range vs {
+			vs[i] = rand.ExpFloat64()
+			h.Add(vs[i])
+		}
+		sort.Float64s(vs)
+		// The estimate should be close to the mean rank error of h against
+		// every value, give or take the sample's own error.
+		var want float64
+		for i, r := range h.CDFs(vs) {
+			want += math.Abs(r-(float64(i)+0.5)/float64(len(vs))) / float64(len(vs))
+		}
+		got := h.EstimatedQuantileError()
+		if math.Abs(got-want) > 2*0.3/math.Sqrt(k) {
+			t.Errorf("Want EstimatedQuantileError near %v for %v centroids, got %v", want, n, got)
+		}
+		if got >= prev {
+			t.Errorf("Want EstimatedQuantileError below %v for %v centroids, got %v", prev, n, got)
+		}
+		prev = got
+	}
+}
+
+func TestEstimatedQuantileErrorNaN(t *testing.T) {
+	if e := New(16).EstimatedQuantileError(); !math.IsNaN(e) {
+		t.Errorf("Want NaN from a Sketch without a probe, got %v", e)
+	}
+	h := NewWithOptions(WithCentroids(16), WithAccuracyProbe(100))
+	if e := h.EstimatedQuantileError(); !math.IsNaN(e) {
+		t.Errorf("Want NaN from an empty Sketch, got %v", e)
+	}
+	h.Add(1.0)
+	h.Add(1.0)
+	h.Add(2.0)
+	if e := h.EstimatedQuantileError(); e != 0 {
+		t.Errorf("Want 0 from an exact Sketch, got %v", e)
+	}
+	h.Reset()
+	if e := h.EstimatedQuantileError(); !math.IsNaN(e) {
+		t.Errorf("Want NaN after Reset, got %v", e)
+	}
+}
+
+func TestAccuracyProbeReservoir(t *testing.T) {
+	h := NewWithOptions(WithCentroids(16), WithAccuracyProbe(100))
+	before := h.SizeBytes()
+	for i := 0; i < 10000; i++ {
+		h.Add(float64(i))
+	}
+	if len(h.probe.vs) != 100 {
+		t.Errorf("Want 100 values in the reservoir, got %v", len(h.probe.vs))
+	}
+	if got, want := h.SizeBytes(), before+800; got < want {
+		t.Errorf("Want SizeBytes of at least %v with a reservoir, got %v", want, got)
+	}
+	// The reservoir should be a roughly uniform sample of all of the values.
+	var below float64
+	for _, v := range h.probe.vs {
+		if v < 5000 {
+			below++
+		}
+	}
+	if below < 30 || below > 70 {
+		t.Errorf("Want about half of the reservoir below the median, got %v of 100", below)
+	}
+	// Clones sample on their own, and the same values give the same sample.
+	c := h.Clone()
+	f := h.Fork()
+	for i := 0; i < 10000; i++ {
+		c.Add(-1.0)
+		f.Add(-1.0)
+	}
+	if c.EstimatedQuantileError() != f.EstimatedQuantileError() {
+		t.Errorf("Want the same estimate from a Clone and a Fork given the same values, got %v and %v",
+			c.EstimatedQuantileError(), f.EstimatedQuantileError())
+	}
+	for _, v := range h.probe.vs {
+		if v == -1.0 {
+			t.Fatalf("Want reservoir unchanged by adding to a Clone or Fork, got %v", h.probe.vs)
+		}
+	}
+	// Decoding starts the sample over.
+	data, _ := h.MarshalBinary()
+	if err := c.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Got error from UnmarshalBinary: %v", err)
+	}
+	if e := c.EstimatedQuantileError(); !math.IsNaN(e) {
+		t.Errorf("Want NaN after decoding, got %v", e)
+	}
+}
+
+func TestAccuracyProbeUnsampledWeight(t *testing.T) {
+	newProbed := func() *Sketch {
+		h := NewWithOptions(WithCentroids(16), WithAccuracyProbe(100))
+		for i := 0; i < 10000; i++ {
+			h.Add(float64(i))
+		}
+		return h
+	}
+	other := New(16)
+	other.Add(-1.0)
+	low := New(100)
+	for i := 0; i < 100; i++ {
+		low.Add(float64(i))
+	}
+	binary, _ := newProbed().MarshalBinary()
+	js, _ := json.Marshal(newProbed())
+	for _, c := range []struct {
+		name string
+		f    func(h *Sketch)
+	}{
+		{"UnmarshalBinary", func(h *Sketch) { h.UnmarshalBinary(binary) }},
+		{"UnmarshalJSON", func(h *Sketch) { json.Unmarshal(js, h) }},
+		{"Merge", func(h *Sketch) { h.Merge(other) }},
+		{"AddSketch", func(h *Sketch) { h.AddSketch(other, 0.5) }},
+		{"MergeInto", func(h *Sketch) { MergeInto(h, h, other) }},
+		{"Subtract and Merge", func(h *Sketch) {
+			h.Subtract(low)
+			h.Merge(other)
+		}},
+	} {
+		h := newProbed()
+		c.f(h)
+		h.Add(1.0)
+		if e := h.EstimatedQuantileError(); !math.IsNaN(e) {
+			t.Errorf("Want NaN after %v and Add, got %v", c.name, e)
+		}
+		// Reset starts the probe over, so h is fully sampled again.
+		h.Reset()
+		h.Add(1.0)
+		if e := h.EstimatedQuantileError(); e != 0 {
+			t.Errorf("Want 0 after %v, Reset and Add, got %v", c.name, e)
+		}
+	}
+	// Scaling and removing weight don't add any weight the probe hasn't seen.
+	h := newProbed()
+	h.Scale(0.5)
+	h.Prune(2.0)
+	h.Subtract(low)
+	h.Add(1.0)
+	if e := h.EstimatedQuantileError(); math.IsNaN(e) {
+		t.Errorf("Want an estimate after Scale, Prune and Subtract, got %v", e)
+	}
+}
+
+func TestAccuracyProbeDecay(t *testing.T) {
+	h := NewWithOptions(WithCentroids(16), WithDecay(0.99), WithAccuracyProbe(100))
+	for i := 0; i < 10000; i++ {
+		h.Add(float64(i))
+	}
+	// With this much decay, values more than about a thousand adds old have
+	// almost no weight left in the sketch, and shouldn't be in the sample.
+	for _, v := range h.probe.vs {
+		if v < 8000 {
+			t.Fatalf("Want only recent values in a decaying sketch's reservoir, got %v", v)
+		}
+	}
+}
+
+func TestAccuracyProbeAddBatch(t *testing.T) {
+	h := NewWithOptions(WithCentroids(batchMinCapacity), WithAccuracyProbe(50))
+	vs := []float64{}
+	for i := 0; i < 2000; i++ {
+		vs = append(vs, float64(i))
+	}
+	h.AddBatch(append(vs, math.NaN()))
+	if len(h.probe.vs) != 50 {
+		t.Errorf("Want 50 values in the reservoir after AddBatch, got %v", len(h.probe.vs))
+	}
+	for _, v := range h.probe.vs {
+		if math.IsNaN(v) {
+			t.Errorf("Want NaN skipped by the reservoir, got %v", h.probe.vs)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package prometheus exports histosketch quantile estimates as Prometheus
+// metrics. It's a separate module so that the histosketch package itself
+// doesn't depend on the Prometheus client library.
+//
+// To export the 50th, 90th and 99th percentiles of a sketch that's being
+// updated by other goroutines, wrap it in a SyncSketch and register a
+// collector for it:
+//
+//	import (
+//		"github.com/aaw/histosketch"
+//		hp "github.com/aaw/histosketch/prometheus"
+//		"github.com/prometheus/client_golang/prometheus"
+//	)
+//
+//	s := histosketch.NewSync(histosketch.New(32))
+//	prometheus.MustRegister(hp.NewQuantileCollector(prometheus.GaugeOpts{
+//		Name: "request_latency_seconds",
+//		Help: "Estimated request latency quantiles.",
+//	}, []float64{0.5, 0.9, 0.99}, s))
+package prometheus
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Source is anything that can estimate quantiles, like a *histosketch.Sketch
+// or a *histosketch.SyncSketch. A plain Sketch isn't safe to query while other
+// goroutines are adding values to it, so use a SyncSketch if that's possible.
+type Source interface {
+	Quantiles(qs []float64) []float64
+}
+
+// A QuantileCollector is a prometheus.Collector that reports one gauge sample
+// per quantile of a Source, each labeled with "quantile". The quantiles are
+// estimated from the Source on each scrape.
+type QuantileCollector struct {
+	desc      *prometheus.Desc
+	quantiles []float64
+	labels    []string
+	src       Source
+}
+
+// Create a new QuantileCollector that reports the given quantiles of src as
+// gauges named and labeled according to opts. The quantile label is added to
+// any constant labels in opts.
+func NewQuantileCollector(opts prometheus.GaugeOpts, quantiles []float64, src Source) *QuantileCollector {
+	c := &QuantileCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help, []string{"quantile"}, opts.ConstLabels),
+		quantiles: append([]float64{}, quantiles...),
+		labels:    make([]string, len(quantiles)),
+		src:       src,
+	}
+	for i, q := range quantiles {
+		c.labels[i] = strconv.FormatFloat(q, 'g', -1, 64)
+	}
+	return c
+}
+
+// Sends the descriptor of the quantile gauges to ch.
+func (c *QuantileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Estimates all of the quantiles from the Source in a single pass and sends
+// one gauge sample for each to ch. The samples are NaN if the Source is empty.
+func (c *QuantileCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, v := range c.src.Quantiles(c.quantiles) {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, v, c.labels[i])
+	}
+}
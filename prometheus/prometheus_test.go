@@ -0,0 +1,46 @@
+package prometheus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aaw/histosketch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQuantileCollector(t *testing.T) {
+	s := histosketch.NewSync(histosketch.New(8))
+	for i := 1; i <= 5; i++ {
+		s.Add(float64(i))
+	}
+	c := NewQuantileCollector(prometheus.GaugeOpts{
+		Namespace:   "test",
+		Name:        "latency",
+		Help:        "Latency quantiles.",
+		ConstLabels: prometheus.Labels{"service": "api"},
+	}, []float64{0.0, 0.5, 1.0}, s)
+	q := s.Quantiles([]float64{0.0, 0.5, 1.0})
+	want := fmt.Sprintf(`
+# HELP test_latency Latency quantiles.
+# TYPE test_latency gauge
+test_latency{quantile="0",service="api"} %v
+test_latency{quantile="0.5",service="api"} %v
+test_latency{quantile="1",service="api"} %v
+`, q[0], q[1], q[2])
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuantileCollectorEmpty(t *testing.T) {
+	c := NewQuantileCollector(prometheus.GaugeOpts{Name: "empty", Help: "Empty."},
+		[]float64{0.5}, histosketch.New(8))
+	if n := testutil.CollectAndCount(c); n != 1 {
+		t.Errorf("Want 1 sample from an empty sketch, got %v", n)
+	}
+	if v := testutil.ToFloat64(c); v == v {
+		t.Errorf("Want NaN sample from an empty sketch, got %v", v)
+	}
+}
@@ -0,0 +1,84 @@
+package histosketch
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// A ShardedSketch spreads concurrent Adds over several independent
+// sub-sketches, each with its own lock, so that goroutines adding values
+// rarely wait on each other. Queries are answered from a Snapshot, which merges
+// all of the shards into a single Sketch.
+//
+// The tradeoff compared to a SyncSketch is accuracy and query cost for
+// throughput: each shard compresses its own values independently, and merging
+// the shards compresses once more, so estimates from a Snapshot are typically
+// a little less accurate than those from a single Sketch with the same number
+// of centroids. Taking a Snapshot also takes time on the order of the number
+// of shards times the number of centroids, so it's meant to be done
+// periodically rather than once per query.
+type ShardedSketch struct {
+	next   uint32
+	n      uint
+	shards []shard
+}
+
+type shard struct {
+	mu sync.Mutex
+	h  *Sketch
+	// Pad each shard out to its own cache line to avoid false sharing.
+	_ [64]byte
+}
+
+// Create a new ShardedSketch with the given number of shards, each with a
+// maximum of n centroids. If shards is 0, one shard is created per CPU.
+func NewSharded(shards int, n uint) *ShardedSketch {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	s := &ShardedSketch{n: n, shards: make([]shard, shards)}
+	for i := range s.shards {
+		s.shards[i].h = New(n)
+	}
+	return s
+}
+
+// Add a single value to one of the shards, chosen round-robin.
+func (s *ShardedSketch) Add(value float64) {
+	s.AddWeighted(value, 1)
+}
+
+// Add a value with the given weight to one of the shards. See
+// Sketch.AddWeighted. Shards are tried round-robin, skipping any that are
+// currently locked by another goroutine.
+func (s *ShardedSketch) AddWeighted(value float64, weight float64) {
+	start := int(atomic.AddUint32(&s.next, 1) % uint32(len(s.shards)))
+	for i := 0; i < len(s.shards); i++ {
+		sh := &s.shards[(start+i)%len(s.shards)]
+		if sh.mu.TryLock() {
+			sh.h.AddWeighted(value, weight)
+			sh.mu.Unlock()
+			return
+		}
+	}
+	// Every shard is busy, wait for the one we started with.
+	sh := &s.shards[start]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.h.AddWeighted(value, weight)
+}
+
+// Returns a new Sketch, with the same maximum number of centroids as each
+// shard, containing all of the values added to all of the shards so far.
+func (s *ShardedSketch) Snapshot() *Sketch {
+	hs := make([]*Sketch, len(s.shards))
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		hs[i] = sh.h.Clone()
+		sh.mu.Unlock()
+	}
+	h, _ := MergeMany(hs, s.n)
+	return h
+}
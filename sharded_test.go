@@ -0,0 +1,69 @@
+package histosketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestShardedSnapshot(t *testing.T) {
+	s := NewSharded(4, 32)
+	values := make([]float64, 40000)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := g; i < len(values); i += 8 {
+				values[i] = r.NormFloat64()
+				s.Add(values[i])
+			}
+		}(g)
+	}
+	wg.Wait()
+	sort.Float64s(values)
+	h := s.Snapshot()
+	if h.Count() != 40000.0 || h.Min() != values[0] || h.Max() != values[len(values)-1] {
+		t.Errorf("Want Count, Min, Max = %v, %v, %v for Snapshot, got %v, %v, %v",
+			len(values), values[0], values[len(values)-1], h.Count(), h.Min(), h.Max())
+	}
+	for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+		rank := float64(sort.SearchFloat64s(values, h.Quantile(q))) / float64(len(values))
+		if e := math.Abs(rank - q); e >= 0.01 {
+			t.Errorf("Got rank error %v for Snapshot Quantile(%v)", e, q)
+		}
+	}
+}
+
+func TestShardedDefaultShards(t *testing.T) {
+	s := NewSharded(0, 8)
+	if len(s.shards) < 1 {
+		t.Errorf("Want at least one shard, got %v", len(s.shards))
+	}
+	if h := s.Snapshot(); h.Count() != 0 || h.capacity() != 8 {
+		t.Errorf("Want empty Snapshot with 8 centroids, got %v", *h)
+	}
+}
+
+func BenchmarkSyncSketchParallelAdd(b *testing.B) {
+	s := NewSync(New(64))
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			s.Add(r.NormFloat64())
+		}
+	})
+}
+
+func BenchmarkShardedSketchParallelAdd(b *testing.B) {
+	s := NewSharded(0, 64)
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			s.Add(r.NormFloat64())
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package histosketch
+
+// A QuantileReader answers read-only queries about a distribution. Both
+// *Sketch and the snapshots returned by Snapshot implement it.
+type QuantileReader interface {
+	Count() float64
+	Min() float64
+	Max() float64
+	Sum(p float64) float64
+	CDF(x float64) float64
+	Quantile(p float64) float64
+	Quantiles(qs []float64) []float64
+}
+
+// An immutable copy of the parts of a Sketch needed to answer queries. Since
+// nothing can modify it, any number of goroutines can query it at once
+// without locking.
+type snapshot struct {
+	h Sketch
+}
+
+// Returns an immutable, read-only view of h as it is now. Values added to h
+// afterwards don't show up in the snapshot, and the snapshot is safe to query
+// from many goroutines at once while h keeps changing. Only the centroids in
+// use are copied, so this is cheaper than Clone for a Sketch that isn't full.
+func (h Sketch) Snapshot() QuantileReader {
+	cs := h.compacted()
+	s := &snapshot{h}
+	// Leave room for one more centroid, as a Sketch always does, so the copy
+	// never looks like it has more centroids than its maximum.
+	s.h.cs = make([]centroid, len(cs), len(cs)+1)
+	s.h.opts.extra = 0
+	copy(s.h.cs, cs)
+	return s
+}
+
+func (s *snapshot) Count() float64                   { return s.h.Count() }
+func (s *snapshot) Min() float64                     { return s.h.Min() }
+func (s *snapshot) Max() float64                     { return s.h.Max() }
+func (s *snapshot) Sum(p float64) float64            { return s.h.Sum(p) }
+func (s *snapshot) CDF(x float64) float64            { return s.h.CDF(x) }
+func (s *snapshot) Quantile(p float64) float64       { return s.h.Quantile(p) }
+func (s *snapshot) Quantiles(qs []float64) []float64 { return s.h.Quantiles(qs) }
+
+// Returns a function that estimates quantiles of h as it is now, exactly like
+// h.Quantile. The function reads from a snapshot (see Snapshot), so values
+// added to h afterwards don't change its results, and it's safe to call from
+// many goroutines at once while h keeps changing.
+func (h Sketch) QuantileFunc() func(p float64) float64 {
+	return h.Snapshot().Quantile
+}
+
+// Returns a function that estimates sums of h as it is now, exactly like
+// h.Sum. Like QuantileFunc, it reads from a snapshot, so it doesn't change as
+// values are added to h and it's safe to call concurrently.
+func (h Sketch) SumFunc() func(p float64) float64 {
+	return h.Snapshot().Sum
+}
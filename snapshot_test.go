@@ -0,0 +1,103 @@
+package histosketch
+
+import (
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var _ QuantileReader = (*Sketch)(nil)
+
+func TestSnapshot(t *testing.T) {
+	h := NewWithOptions(WithCentroids(16), WithQuantileMethod(NearestRank))
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		h.Add(rand.NormFloat64())
+	}
+	before := h.Clone()
+	s := h.Snapshot()
+	for i := 0; i < 1000; i++ {
+		h.Add(rand.ExpFloat64() + 5)
+	}
+	qs := []float64{0.0, 0.1, 0.5, 0.9, 1.0}
+	if s.Count() != before.Count() || s.Min() != before.Min() || s.Max() != before.Max() {
+		t.Errorf("Want Count, Min, Max %v, %v, %v from snapshot, got %v, %v, %v",
+			before.Count(), before.Min(), before.Max(), s.Count(), s.Min(), s.Max())
+	}
+	if got, want := s.Quantiles(qs), before.Quantiles(qs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Want Quantiles %v from snapshot, got %v", want, got)
+	}
+	for _, x := range []float64{-1.0, 0.0, 1.0} {
+		if s.Sum(x) != before.Sum(x) || s.CDF(x) != before.CDF(x) {
+			t.Errorf("Want Sum, CDF(%v) %v, %v from snapshot, got %v, %v",
+				x, before.Sum(x), before.CDF(x), s.Sum(x), s.CDF(x))
+		}
+	}
+	if s.Quantile(0.5) != before.Quantile(0.5) {
+		t.Errorf("Want Quantile(0.5) %v from snapshot, got %v", before.Quantile(0.5), s.Quantile(0.5))
+	}
+}
+
+func TestQuantileFuncSumFunc(t *testing.T) {
+	h := New(16)
+	rand.Seed(0)
+	for i := 0; i < 1000; i++ {
+		h.Add(rand.NormFloat64())
+	}
+	before := h.Clone()
+	quantile, sum := h.QuantileFunc(), h.SumFunc()
+	for i := 0; i < 1000; i++ {
+		h.Add(rand.ExpFloat64() + 5)
+	}
+	for _, q := range []float64{0.0, 0.1, 0.5, 0.9, 1.0} {
+		if got, want := quantile(q), before.Quantile(q); got != want {
+			t.Errorf("Want %v from QuantileFunc for %v, got %v", want, q, got)
+		}
+	}
+	for _, x := range []float64{-1.0, 0.0, 1.0, 6.0} {
+		if got, want := sum(x), before.Sum(x); got != want {
+			t.Errorf("Want %v from SumFunc for %v, got %v", want, x, got)
+		}
+	}
+}
+
+// Run with go test -race to check for data races.
+func TestSyncSnapshot(t *testing.T) {
+	s := NewSync(New(32))
+	s.Add(0.0)
+	var wg sync.WaitGroup
+	snaps := make(chan QuantileReader, 100)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			snaps <- s.Snapshot()
+		}
+		close(snaps)
+	}()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 2000; i++ {
+				s.Add(r.NormFloat64())
+			}
+		}(g)
+	}
+	prev := 0.0
+	for snap := range snaps {
+		if snap.Count() < prev {
+			t.Errorf("Want each snapshot to have at least %v values, got %v", prev, snap.Count())
+		}
+		if q := snap.Quantile(0.5); q < snap.Min() || q > snap.Max() {
+			t.Errorf("Got Quantile(0.5) %v outside of [%v, %v] from snapshot", q, snap.Min(), snap.Max())
+		}
+		prev = snap.Count()
+	}
+	wg.Wait()
+	if snap := s.Snapshot(); snap.Count() != 8001.0 {
+		t.Errorf("Want 8001 for Count of final snapshot, got %v", snap.Count())
+	}
+}
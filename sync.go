@@ -0,0 +1,141 @@
+package histosketch
+
+import "sync"
+
+// A SyncSketch wraps a Sketch so that it's safe to use from multiple
+// goroutines at once. Methods that add values take a write lock and queries
+// take a read lock, so concurrent queries don't block each other. Sketch
+// itself does no locking, so use it directly if you only need it from a
+// single goroutine.
+type SyncSketch struct {
+	mu sync.RWMutex
+	h  *Sketch
+}
+
+// Create a new SyncSketch wrapping h. h shouldn't be used directly after
+// it's been wrapped.
+func NewSync(h *Sketch) *SyncSketch {
+	return &SyncSketch{h: h}
+}
+
+// Add a single value to the Histogram.
+func (s *SyncSketch) Add(value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.h.Add(value)
+}
+
+// Add count values to the Histogram. See Sketch.AddMany.
+func (s *SyncSketch) AddMany(value float64, count int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.h.AddMany(value, count)
+}
+
+// Add a value with the given weight to the Histogram. See Sketch.AddWeighted.
+func (s *SyncSketch) AddWeighted(value float64, weight float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.h.AddWeighted(value, weight)
+}
+
+// Merges x into the Histogram. See Sketch.Merge. x isn't locked, so it
+// shouldn't be modified by another goroutine during the merge.
+func (s *SyncSketch) Merge(x *Sketch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.h.Merge(x)
+}
+
+// Merges src into dst, where both may be in use by other goroutines. See
+// Sketch.Merge. src is copied while holding its read lock, which is then
+// released before dst's write lock is taken, so MergeSync never holds both
+// locks at once and can't deadlock, even if another goroutine is merging dst
+// into src at the same time or src and dst are the same. The price is that
+// the merge sees src as it was when it was copied, which may be slightly
+// before values that other goroutines add to src during the merge.
+func MergeSync(dst, src *SyncSketch) error {
+	src.mu.RLock()
+	x := src.h.Clone()
+	src.mu.RUnlock()
+	return dst.Merge(x)
+}
+
+// Total number of values added to the Histogram.
+func (s *SyncSketch) Count() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Count()
+}
+
+// Total weight of the NaN and infinite values skipped. See Sketch.Dropped.
+func (s *SyncSketch) Dropped() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Dropped()
+}
+
+// Maximum value added to the Histogram.
+func (s *SyncSketch) Max() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Max()
+}
+
+// Minimum value added to the Histogram.
+func (s *SyncSketch) Min() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Min()
+}
+
+// Returns an estimate of the number of values <= p in the histogram. See
+// Sketch.Sum.
+func (s *SyncSketch) Sum(p float64) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Sum(p)
+}
+
+// Returns an estimate of the fraction of values <= x in the histogram. See
+// Sketch.CDF.
+func (s *SyncSketch) CDF(x float64) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.CDF(x)
+}
+
+// Returns an estimate of the pth quantile of the histogram. See
+// Sketch.Quantile.
+func (s *SyncSketch) Quantile(p float64) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Quantile(p)
+}
+
+// Returns estimates of the quantiles qs of the histogram. See
+// Sketch.Quantiles.
+func (s *SyncSketch) Quantiles(qs []float64) []float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Quantiles(qs)
+}
+
+// Returns the count, minimum, maximum, mean and estimates of the quantiles qs
+// of the histogram, all read under the same lock so that they're consistent
+// with each other. See Sketch.Summary.
+func (s *SyncSketch) Summary(qs []float64) Summary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Summary(qs)
+}
+
+// Returns an immutable, read-only view of the Histogram as it is now, taken
+// while holding the lock so that it never reflects a half-finished Add. Queries
+// on the snapshot don't take the lock, so they never wait on writers. See
+// Sketch.Snapshot.
+func (s *SyncSketch) Snapshot() QuantileReader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Snapshot()
+}
@@ -0,0 +1,99 @@
+package histosketch
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// Run with go test -race to check for data races.
+func TestSyncConcurrentAddAndQuantile(t *testing.T) {
+	s := NewSync(New(32))
+	s.Add(0.0)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 2000; i++ {
+				s.Add(r.NormFloat64())
+			}
+		}(g)
+	}
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if q := s.Quantile(0.5); math.IsNaN(q) || q < s.Min() || q > s.Max() {
+					t.Errorf("Got bad Quantile(0.5) %v during concurrent adds", q)
+				}
+				s.Sum(0.0)
+				s.CDF(1.0)
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	if s.Count() != 16001.0 {
+		t.Errorf("Want 16001 for Count after concurrent adds, got %v", s.Count())
+	}
+	if e := math.Abs(s.Quantile(0.5)); e > 0.05 {
+		t.Errorf("Want Quantile(0.5) near 0, got %v", s.Quantile(0.5))
+	}
+}
+
+func TestSyncMerge(t *testing.T) {
+	s := NewSync(New(16))
+	x := New(16)
+	for i := 0; i < 100; i++ {
+		s.AddWeighted(float64(i), 2.0)
+		x.Add(float64(-i))
+	}
+	if err := s.Merge(x); err != nil {
+		t.Errorf("Got error merging into SyncSketch: %v", err)
+	}
+	if s.Count() != 300.0 || s.Min() != -99.0 || s.Max() != 99.0 {
+		t.Errorf("Want Count, Min, Max = 300, -99, 99 after Merge, got %v, %v, %v",
+			s.Count(), s.Min(), s.Max())
+	}
+	if err := s.Merge(New(8)); err != nil || s.Count() != 300.0 {
+		t.Errorf("Want Count 300 after merging an empty 8-centroid sketch, got %v (error %v)", s.Count(), err)
+	}
+}
+
+// Run with go test -race to check for data races.
+func TestMergeSyncBothDirections(t *testing.T) {
+	a, b := NewSync(New(16)), NewSync(New(16))
+	for i := 0; i < 100; i++ {
+		a.Add(float64(i))
+		b.Add(float64(-i))
+	}
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*SyncSketch{{a, b}, {b, a}, {a, a}} {
+		wg.Add(1)
+		go func(dst, src *SyncSketch) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := MergeSync(dst, src); err != nil {
+					t.Errorf("Got error from MergeSync: %v", err)
+				}
+				dst.Add(float64(i))
+			}
+		}(pair[0], pair[1])
+	}
+	wg.Wait()
+	for _, s := range []*SyncSketch{a, b} {
+		if s.Min() != -99.0 || s.Max() != 99.0 || !(s.Count() > 200.0) {
+			t.Errorf("Want Min, Max = -99, 99 and Count > 200 after merges, got %v, %v, %v",
+				s.Min(), s.Max(), s.Count())
+		}
+	}
+	if err := MergeSync(a, NewSync(New(8))); err != nil {
+		t.Errorf("Got error merging an 8-centroid sketch: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package histosketch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Create a new Sketch with a maximum of centroids centroids from the centroids
+// of a t-digest, given as parallel slices of means and weights in any order.
+// Like a Sketch, a t-digest is an ordered list of weighted centroids, so the
+// conversion just re-compresses the t-digest's centroids down to the target
+// number by repeatedly merging the closest pair.
+//
+// The two differ in how they choose what to merge, though. A t-digest keeps
+// the centroids near its extremes small so that its extreme quantiles are
+// accurate, while this sketch merges whichever centroids are closest
+// together, so converting a t-digest into a Sketch with fewer centroids than
+// the t-digest loses most of that extra accuracy in the tails. A t-digest
+// also doesn't generally say which centroids represent a single repeated
+// value, so only centroids with weight 1 are treated as exact. Min and Max
+// are the smallest and largest means, since the t-digest's own min and max
+// aren't part of its centroids, so quantile estimates in the tails, beyond
+// the first and last centroids, are squeezed toward those means. Panics if
+// means and weights have different lengths or if any weight is negative,
+// infinite or NaN.
+func FromTDigestCentroids(means, weights []float64, centroids uint) *Sketch {
+	if len(means) != len(weights) {
+		panic(fmt.Sprintf("bad argument, got %v means but %v weights", len(means), len(weights)))
+	}
+	h := New(centroids)
+	cs := make([]centroid, 0, len(means))
+	for i, p := range means {
+		w := weights[i]
+		if !(w >= 0) || math.IsInf(w, 0) {
+			panic(fmt.Sprintf("bad argument, weight must be non-negative and finite, got %v", w))
+		}
+		if w == 0 || h.skip(p, w) {
+			continue
+		}
+		h.addCount(w)
+		if w == 1 {
+			cs = append(cs, centroid{p, 1})
+		} else {
+			cs = append(cs, centroid{p, -w})
+		}
+	}
+	if len(cs) == 0 {
+		return h
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].p < cs[j].p })
+	// Combine any centroids with the same mean, since a Sketch never has two.
+	j := 0
+	for _, c := range cs[1:] {
+		if c.p == cs[j].p {
+			cs[j] = mergeCentroids(cs[j:j+1], []centroid{c})[0]
+		} else {
+			j++
+			cs[j] = c
+		}
+	}
+	cs = compress(cs[:j+1], h.capacity(), h.opts.merge)
+	h.cs = append(h.cs, cs...)
+	h.min, h.max = cs[0].p, cs[len(cs)-1].p
+	return h
+}
+
+// Returns the centroids of h as parallel slices of means and weights, sorted
+// by mean, in the form a t-digest expects. Whether a centroid is exact isn't
+// part of a t-digest, so that's lost, along with Min and Max.
+func (h Sketch) TDigestCentroids() (means, weights []float64) {
+	means, weights = make([]float64, len(h.cs)), make([]float64, len(h.cs))
+	for i, c := range h.cs {
+		means[i], weights[i] = c.p, math.Abs(c.m)
+	}
+	return means, weights
+}
@@ -0,0 +1,68 @@
+package histosketch
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestTDigestRoundTrip(t *testing.T) {
+	rand.Seed(0)
+	s := New(32)
+	for i := 0; i < 10000; i++ {
+		s.Add(rand.ExpFloat64())
+	}
+	means, weights := s.TDigestCentroids()
+	if len(means) != 32 || len(weights) != 32 {
+		t.Fatalf("Want 32 means and weights, got %v and %v", len(means), len(weights))
+	}
+	// Shuffle, since t-digest centroids don't have to arrive in order.
+	rand.Shuffle(len(means), func(i, j int) {
+		means[i], means[j] = means[j], means[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	})
+	u := FromTDigestCentroids(means, weights, 32)
+	if got, want := u.Centroids(), s.Centroids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Want centroids %v after round trip, got %v", want, got)
+	}
+	if u.Count() != s.Count() {
+		t.Errorf("Want Count %v after round trip, got %v", s.Count(), u.Count())
+	}
+	// Compressing to fewer centroids should still give reasonable quantiles
+	// away from the tails, where the lack of a true Min and Max hurts.
+	c := FromTDigestCentroids(means, weights, 16)
+	for _, q := range []float64{0.25, 0.5, 0.75, 0.9} {
+		if e := math.Abs(s.CDF(c.Quantile(q)) - q); e > 0.05 {
+			t.Errorf("Want Quantile(%v) within 0.05 in rank of %v after compressing, got %v",
+				q, s.Quantile(q), c.Quantile(q))
+		}
+	}
+}
+
+func TestFromTDigestCentroids(t *testing.T) {
+	h := FromTDigestCentroids([]float64{3.0, 1.0, 3.0, 7.0}, []float64{2.0, 1.0, 1.0, 0.0}, 8)
+	want := "{centroids=8 count=4 min=1 max=3 dropped=0 [1:1 3:~3]}"
+	if got := fmt.Sprintf("%v", *h); got != want {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+	if e := FromTDigestCentroids(nil, nil, 8); e.Count() != 0 {
+		t.Errorf("Want empty sketch from no centroids, got %v", *e)
+	}
+	// Each weight of 1 is too small to change a count of 10^16 on its own,
+	// but the count is compensated, so they all still add up.
+	means, weights := []float64{0.0}, []float64{1e16}
+	for i := 1; i <= 1000; i++ {
+		means, weights = append(means, float64(i)), append(weights, 1.0)
+	}
+	if c := FromTDigestCentroids(means, weights, 8).Count(); c != 1e16+1000 {
+		t.Errorf("Want Count %v from many small weights, got %v", 1e16+1000, c)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected panic on call to FromTDigestCentroids with mismatched lengths")
+		}
+	}()
+	FromTDigestCentroids([]float64{1.0}, nil, 8)
+}
@@ -0,0 +1,74 @@
+package histosketch
+
+import (
+	"fmt"
+	"math"
+)
+
+// A quantile being watched by WatchQuantile. lo and hi are the quantiles
+// just below and above q that have to cross the threshold before cb is
+// called, and above records which side of the threshold q was last seen on.
+type watch struct {
+	q, lo, hi float64
+	threshold float64
+	above     bool
+	cb        func(value float64)
+}
+
+// Calls cb with the estimate of the qth quantile whenever that estimate
+// crosses threshold as values are added to h, so that alerts don't have to
+// poll the sketch. cb is called once when the estimate rises above threshold
+// and once when it falls back to threshold or below, and then not again until
+// it crosses back. The estimate starts out on the side of threshold it's on
+// when WatchQuantile is called, or at or below threshold if h is empty.
+//
+// To keep cb from firing over and over as the estimate wobbles around
+// threshold, crossings are debounced with a band of ranks around q: the
+// estimate only counts as above threshold once the quantile just below q is
+// too, and only counts as back at or below threshold once the quantile just
+// above q is too. The band reaches 1% of the way from q to the nearer of 0.0
+// and 1.0, so it's [0.495, 0.505] for the median and [0.9899, 0.9901] for the
+// 99th percentile. Values piling up near threshold can still move the
+// estimate back and forth across it, but only as fast as the rank of the
+// threshold actually moves through the band.
+//
+// The check runs after every Add, AddWeighted and AddTimestamped, and at
+// least once per AddBatch, and costs about as much as a call to Quantiles, so
+// adding values gets slower with each watch. Merging, scaling and decaying h
+// don't trigger a check on their own. cb runs synchronously in the goroutine
+// that added the value and must not change h. Watches belong to h alone:
+// Clone and Fork don't copy them, and decoding a sketch into h removes them.
+// Panics if q is outside of [0.0, 1.0], threshold is NaN or cb is nil.
+func (h *Sketch) WatchQuantile(q, threshold float64, cb func(value float64)) {
+	if !(q >= 0 && q <= 1) {
+		panic(fmt.Sprintf("bad argument, quantile must be in [0.0, 1.0], got %v", q))
+	}
+	if math.IsNaN(threshold) {
+		panic("bad argument, threshold must not be NaN")
+	}
+	if cb == nil {
+		panic("bad argument, callback must not be nil")
+	}
+	d := math.Min(q, 1-q) / 100.0
+	w := &watch{q: q, lo: q - d, hi: q + d, threshold: threshold, cb: cb}
+	w.above = len(h.cs) > 0 && h.Quantile(q) > threshold
+	h.watches = append(h.watches, w)
+}
+
+// Checks each quantile being watched and calls its callback if it has crossed
+// its threshold. See WatchQuantile.
+func (h *Sketch) notify() {
+	if len(h.watches) == 0 || len(h.cs) == 0 {
+		return
+	}
+	for _, w := range h.watches {
+		vs := h.Quantiles([]float64{w.lo, w.q, w.hi})
+		if !w.above && vs[0] > w.threshold {
+			w.above = true
+			w.cb(vs[1])
+		} else if w.above && vs[2] <= w.threshold {
+			w.above = false
+			w.cb(vs[1])
+		}
+	}
+}
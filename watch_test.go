@@ -0,0 +1,75 @@
+package histosketch
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestWatchQuantile(t *testing.T) {
+	rand.Seed(0)
+	s := New(32)
+	for i := 0; i < 1000; i++ {
+		s.Add(rand.Float64())
+	}
+	var got []float64
+	s.WatchQuantile(0.5, 5.0, func(v float64) { got = append(got, v) })
+	for i := 0; i < 3000; i++ {
+		s.Add(10.0 + rand.Float64())
+	}
+	if len(got) != 1 || got[0] <= 5.0 {
+		t.Fatalf("Want one callback with a median above 5 after adding large values, got %v", got)
+	}
+	for i := 0; i < 10000; i++ {
+		s.Add(rand.Float64())
+	}
+	if len(got) != 2 || got[1] > 5.0 {
+		t.Fatalf("Want a second callback with a median at most 5 after adding small values, got %v", got)
+	}
+	if c := s.Clone(); len(c.watches) != 0 {
+		t.Errorf("Want no watches on a Clone, got %v", len(c.watches))
+	}
+}
+
+func TestWatchQuantileDebounce(t *testing.T) {
+	// Alternating values on either side of 0.5 keep the median estimate
+	// wobbling back and forth across 0.5, but its rank soon moves much less
+	// than the band around the median.
+	s := New(16)
+	calls := 0
+	s.WatchQuantile(0.5, 0.5, func(float64) { calls++ })
+	flips := 0
+	above := false
+	for i := 0; i < 10000; i++ {
+		s.Add(0.25 + 0.5*float64(i%2) + float64(i)*1e-9)
+		if a := s.Quantile(0.5) > 0.5; a != above {
+			flips++
+			above = a
+		}
+	}
+	if calls*10 > flips {
+		t.Errorf("Want at most a tenth as many callbacks as the %v times the median crossed 0.5, got %v",
+			flips, calls)
+	}
+}
+
+func TestWatchQuantileBadArguments(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fn   func()
+	}{
+		{"q < 0", func() { New(8).WatchQuantile(-0.1, 1, func(float64) {}) }},
+		{"q > 1", func() { New(8).WatchQuantile(1.1, 1, func(float64) {}) }},
+		{"NaN threshold", func() { New(8).WatchQuantile(0.5, math.NaN(), func(float64) {}) }},
+		{"nil callback", func() { New(8).WatchQuantile(0.5, 1, nil) }},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to WatchQuantile with %v", test.name)
+				}
+			}()
+			test.fn()
+		}()
+	}
+}
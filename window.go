@@ -0,0 +1,94 @@
+package histosketch
+
+import (
+	"fmt"
+	"math"
+)
+
+// The largest window a WindowSketch can be created with. A window of this size
+// holds 128 MB of raw values.
+const MaxWindowSize = 1 << 24
+
+// A WindowSketch estimates quantiles and sums over only the most recent values
+// added to it, instead of over every value ever added.
+//
+// Unlike a Sketch, which has a fixed size no matter how many values are added
+// to it, a WindowSketch keeps the raw values in the window in a ring buffer,
+// so it uses memory on the order of the window size. Values can't be removed
+// from a Sketch once added, so the internal Sketch is rebuilt from the ring
+// buffer the first time it's queried after an Add. A rebuild takes time on the
+// order of the window size times the number of centroids, so a WindowSketch
+// works best when queries are much less frequent than Adds. Since queries can
+// rebuild the internal Sketch, even concurrent queries on a WindowSketch
+// aren't safe without external locking.
+type WindowSketch struct {
+	values []float64
+	next   int
+	full   bool
+	h      *Sketch
+	stale  bool
+}
+
+// Create a new WindowSketch over the last size values added, estimated with a
+// maximum of n centroids. Panics if size isn't in [1, MaxWindowSize].
+func NewWindow(size int, n uint) *WindowSketch {
+	if size < 1 || size > MaxWindowSize {
+		panic(fmt.Sprintf("Window size must be in [1, %v], got %v", MaxWindowSize, size))
+	}
+	return &WindowSketch{values: make([]float64, 0, size), h: New(n)}
+}
+
+// Add a single value to the window, evicting the oldest value if the window
+// is full. NaN and infinite values are skipped, just like Sketch.Add does,
+// and don't take up space in the window.
+func (w *WindowSketch) Add(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if !w.full {
+		w.values = append(w.values, value)
+		w.full = len(w.values) == cap(w.values)
+	} else {
+		w.values[w.next] = value
+		w.next = (w.next + 1) % len(w.values)
+	}
+	w.stale = true
+}
+
+// Returns the Sketch of the values currently in the window, rebuilding it
+// first if any values have been added since it was last built.
+func (w *WindowSketch) sketch() *Sketch {
+	if w.stale {
+		w.h.Reset()
+		w.h.AddBatch(w.values)
+		w.stale = false
+	}
+	return w.h
+}
+
+// Number of values currently in the window.
+func (w *WindowSketch) Count() float64 {
+	return float64(len(w.values))
+}
+
+// Maximum value in the window, or NaN if the window is empty.
+func (w *WindowSketch) Max() float64 {
+	return w.sketch().Max()
+}
+
+// Minimum value in the window, or NaN if the window is empty.
+func (w *WindowSketch) Min() float64 {
+	return w.sketch().Min()
+}
+
+// Returns an estimate of the number of values in the window that are <= p.
+// See Sketch.Sum.
+func (w *WindowSketch) Sum(p float64) float64 {
+	return w.sketch().Sum(p)
+}
+
+// Returns an estimate of the pth quantile of the values in the window. See
+// Sketch.Quantile.
+func (w *WindowSketch) Quantile(p float64) float64 {
+	return w.sketch().Quantile(p)
+}
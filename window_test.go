@@ -0,0 +1,55 @@
+package histosketch
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(100, 8)
+	if !math.IsNaN(w.Quantile(0.5)) || w.Count() != 0 {
+		t.Errorf("Want NaN quantile and zero count for empty window, got %v, %v", w.Quantile(0.5), w.Count())
+	}
+	for i := 0; i < 50; i++ {
+		w.Add(float64(i))
+	}
+	if w.Count() != 50 || w.Min() != 0 || w.Max() != 49 {
+		t.Errorf("Want Count, Min, Max = 50, 0, 49, got %v, %v, %v", w.Count(), w.Min(), w.Max())
+	}
+	// Push the first 1000 values out of the window entirely.
+	for i := 50; i < 1100; i++ {
+		w.Add(float64(i))
+	}
+	w.Add(math.NaN())
+	if w.Count() != 100 || w.Min() != 1000 || w.Max() != 1099 {
+		t.Errorf("Want Count, Min, Max = 100, 1000, 1099, got %v, %v, %v", w.Count(), w.Min(), w.Max())
+	}
+	if m := w.Quantile(0.5); m < 1040 || m > 1060 {
+		t.Errorf("Want median of window near 1050, got %v", m)
+	}
+	if s := w.Sum(999); s != 0 {
+		t.Errorf("Want Sum(999) = 0 after old values were evicted, got %v", s)
+	}
+	if s := w.Sum(1099); s != 100 {
+		t.Errorf("Want Sum(1099) = 100, got %v", s)
+	}
+}
+
+func TestWindowSize(t *testing.T) {
+	for _, size := range []int{0, -1, MaxWindowSize + 1} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected panic on call to NewWindow(%v, 8)", size)
+				}
+			}()
+			NewWindow(size, 8)
+		}()
+	}
+	w := NewWindow(1, 8)
+	w.Add(1.0)
+	w.Add(2.0)
+	if w.Count() != 1 || w.Quantile(0.5) != 2.0 {
+		t.Errorf("Want a window of size 1 to hold only the last value, got %v, %v", w.Count(), w.Quantile(0.5))
+	}
+}